@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/pingcap-incubator/tinykv/log"
@@ -25,6 +26,9 @@ type Config struct {
 	RaftLogGCTickInterval time.Duration
 	// When entry count exceed this value, gc will be forced trigger.
 	RaftLogGcCountLimit uint64
+	// When the region has grown by more than this many bytes since the last
+	// gc, gc will be forced trigger as well. 0 disables the size trigger.
+	RaftLogGcSizeLimit uint64
 
 	// Interval (ms) to check region whether need to be split or not.
 	SplitRegionCheckTickInterval time.Duration
@@ -37,8 +41,18 @@ type Config struct {
 	// [b,c), [c,d) will be regionSplitSize (maybe a little larger).
 	RegionMaxSize   uint64
 	RegionSplitSize uint64
+
+	// The largest Limit a RawScan request may ask for, larger scans are
+	// rejected and should be paginated by the client instead.
+	MaxScanLimit uint32
+
+	// How long a health check waits for the storage to hand out a reader
+	// before the node is reported as unavailable.
+	HealthCheckTimeout time.Duration
 }
 
+// Validate checks the raft timing options and, through ValidateDBPath, that
+// DBPath is usable.
 func (c *Config) Validate() error {
 	if c.RaftHeartbeatTicks == 0 {
 		return fmt.Errorf("heartbeat tick must greater than 0")
@@ -53,14 +67,49 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("election tick must be greater than heartbeat tick.")
 	}
 
+	return c.ValidateDBPath()
+}
+
+// ValidateDBPath makes sure the kv and raft directories under DBPath exist and
+// are writable, so a bad path is reported before badger fails on it.
+func (c *Config) ValidateDBPath() error {
+	if c.DBPath == "" {
+		return fmt.Errorf("DBPath must not be empty")
+	}
+	for _, dir := range []string{filepath.Join(c.DBPath, "kv"), filepath.Join(c.DBPath, "raft")} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("DBPath %s is not writable: %v", c.DBPath, unwrapPathError(err))
+		}
+		f, err := os.CreateTemp(dir, "validate")
+		if err != nil {
+			return fmt.Errorf("DBPath %s is not writable: %v", c.DBPath, unwrapPathError(err))
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
 	return nil
 }
 
+// unwrapPathError drops the path and operation of a *os.PathError, the caller
+// already names the path in its own message.
+func unwrapPathError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
 const (
 	KB uint64 = 1024
 	MB uint64 = 1024 * 1024
 )
 
+// DefaultMaxScanLimit is the default value of Config.MaxScanLimit.
+const DefaultMaxScanLimit uint32 = 10000
+
+// DefaultHealthCheckTimeout is the default value of Config.HealthCheckTimeout.
+const DefaultHealthCheckTimeout = 100 * time.Millisecond
+
 func getLogLevel() (logLevel string) {
 	logLevel = "info"
 	if l := os.Getenv("LOG_LEVEL"); len(l) != 0 {
@@ -87,6 +136,8 @@ func NewDefaultConfig() *Config {
 		RegionMaxSize:                       144 * MB,
 		RegionSplitSize:                     96 * MB,
 		DBPath:                              "/tmp/badger",
+		MaxScanLimit:                        DefaultMaxScanLimit,
+		HealthCheckTimeout:                  DefaultHealthCheckTimeout,
 	}
 }
 
@@ -106,5 +157,7 @@ func NewTestConfig() *Config {
 		RegionMaxSize:                       144 * MB,
 		RegionSplitSize:                     96 * MB,
 		DBPath:                              "/tmp/badger",
+		MaxScanLimit:                        DefaultMaxScanLimit,
+		HealthCheckTimeout:                  DefaultHealthCheckTimeout,
 	}
 }
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDBPath(t *testing.T) {
+	dir, err := os.MkdirTemp("", "config")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := NewTestConfig()
+	conf.DBPath = filepath.Join(dir, "db")
+	require.Nil(t, conf.ValidateDBPath())
+	for _, sub := range []string{"kv", "raft"} {
+		entries, err := os.ReadDir(filepath.Join(conf.DBPath, sub))
+		require.Nil(t, err)
+		require.Empty(t, entries)
+	}
+
+	conf.DBPath = ""
+	require.NotNil(t, conf.ValidateDBPath())
+
+	// a regular file can't hold the data directories
+	file := filepath.Join(dir, "file")
+	require.Nil(t, os.WriteFile(file, nil, 0644))
+	conf.DBPath = file
+	err = conf.ValidateDBPath()
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "DBPath "+file+" is not writable: "), err.Error())
+}
+
+func TestValidateChecksDBPath(t *testing.T) {
+	dir, err := os.MkdirTemp("", "config")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := NewTestConfig()
+	conf.DBPath = filepath.Join(dir, "db")
+	require.Nil(t, conf.Validate())
+
+	file := filepath.Join(dir, "file")
+	require.Nil(t, os.WriteFile(file, nil, 0644))
+	conf.DBPath = file
+	require.Equal(t, conf.ValidateDBPath(), conf.Validate())
+}
@@ -48,6 +48,10 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 	log.Infof("Server started with conf %+v", conf)
 
+	if err := conf.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	var storage storage.Storage
 	if conf.Raft {
 		storage = raft_storage.NewRaftStorage(conf)
@@ -57,7 +61,7 @@ func main() {
 	if err := storage.Start(); err != nil {
 		log.Fatal(err)
 	}
-	server := server.NewServer(storage)
+	server := server.NewServerWithConfig(storage, conf)
 
 	var alivePolicy = keepalive.EnforcementPolicy{
 		MinTime:             2 * time.Second, // If a client pings more than once every 2 seconds, terminate the connection
@@ -69,6 +73,7 @@ func main() {
 		grpc.InitialWindowSize(1<<30),
 		grpc.InitialConnWindowSize(1<<30),
 		grpc.MaxRecvMsgSize(10*1024*1024),
+		grpc.UnaryInterceptor(server.UnaryInterceptor()),
 	)
 	tinykvpb.RegisterTinyKvServer(grpcServer, server)
 	listenAddr := conf.StoreAddr[strings.IndexByte(conf.StoreAddr, ':'):]
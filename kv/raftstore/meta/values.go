@@ -1,7 +1,10 @@
 package meta
 
 import (
+	"bytes"
+
 	"github.com/Connor1996/badger"
+	"github.com/pingcap/errors"
 	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/metapb"
@@ -32,6 +35,69 @@ func GetApplyState(db *badger.DB, regionId uint64) (*rspb.RaftApplyState, error)
 	return applyState, nil
 }
 
+// CheckConsistency compares, for every live region, the raft state persisted in
+// the raft engine with the apply state persisted in the kv engine. After a crash
+// the applied index may trail the commit index, the gap is replayed from the raft
+// log, so the log must still hold every entry in (applied, commit]: it must not be
+// truncated past the applied index nor end before the commit index. It is meant
+// to run at startup before any peer is created.
+func CheckConsistency(engines *engine_util.Engines) error {
+	var regionIDs []uint64
+	err := engines.Kv.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(RegionMetaMinKey); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.Compare(item.Key(), RegionMetaMaxKey) >= 0 {
+				break
+			}
+			regionID, suffix, err := DecodeRegionMetaKey(item.Key())
+			if err != nil {
+				return err
+			}
+			if suffix != RegionStateSuffix {
+				continue
+			}
+			val, err := item.Value()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			localState := new(rspb.RegionLocalState)
+			if err := localState.Unmarshal(val); err != nil {
+				return errors.WithStack(err)
+			}
+			if localState.State != rspb.PeerState_Tombstone {
+				regionIDs = append(regionIDs, regionID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, regionID := range regionIDs {
+		raftState, err := GetRaftLocalState(engines.Raft, regionID)
+		if err != nil {
+			return errors.Annotatef(err, "region %d: read raft state", regionID)
+		}
+		applyState, err := GetApplyState(engines.Kv, regionID)
+		if err != nil {
+			return errors.Annotatef(err, "region %d: read apply state", regionID)
+		}
+		commit, applied := raftState.GetHardState().GetCommit(), applyState.AppliedIndex
+		if applied > commit {
+			return errors.Errorf("region %d: applied index %d is ahead of commit index %d", regionID, applied, commit)
+		}
+		if truncated := applyState.GetTruncatedState().GetIndex(); truncated > applied {
+			return errors.Errorf("region %d: raft log is truncated to %d, past applied index %d", regionID, truncated, applied)
+		}
+		if raftState.LastIndex < commit {
+			return errors.Errorf("region %d: raft log ends at %d, before commit index %d", regionID, raftState.LastIndex, commit)
+		}
+	}
+	return nil
+}
+
 func GetRaftEntry(db *badger.DB, regionId, idx uint64) (*eraftpb.Entry, error) {
 	entry := new(eraftpb.Entry)
 	if err := engine_util.GetMeta(db, RaftLogKey(regionId, idx), entry); err != nil {
@@ -0,0 +1,62 @@
+package meta
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/metapb"
+	rspb "github.com/pingcap-incubator/tinykv/proto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	dir, err := os.MkdirTemp("", "meta")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	kvPath, raftPath := filepath.Join(dir, "kv"), filepath.Join(dir, "raft")
+	engines := engine_util.NewEngines(engine_util.CreateDB(kvPath, false), engine_util.CreateDB(raftPath, true), kvPath, raftPath)
+	defer engines.Close()
+
+	region := &metapb.Region{Id: 1, Peers: []*metapb.Peer{{Id: 1, StoreId: 1}}}
+	kvWB := new(engine_util.WriteBatch)
+	WriteRegionState(kvWB, region, rspb.PeerState_Normal)
+	require.Nil(t, kvWB.WriteToDB(engines.Kv))
+	_, err = InitRaftLocalState(engines.Raft, region)
+	require.Nil(t, err)
+	_, err = InitApplyState(engines.Kv, region)
+	require.Nil(t, err)
+	require.Nil(t, CheckConsistency(engines))
+
+	tests := []struct {
+		truncated, applied, commit, last uint64
+		wok                              bool
+	}{
+		{5, 10, 15, 15, true},
+		// a wide gap is fine as long as the log still holds it
+		{5, 10, 1000, 1000, true},
+		{10, 10, 20, 25, true},
+		// log truncated past applied
+		{11, 10, 20, 20, false},
+		// log ends before commit
+		{5, 10, 20, 19, false},
+		// applied ahead of commit
+		{5, 11, 10, 10, false},
+	}
+	for i, tt := range tests {
+		raftState := &rspb.RaftLocalState{HardState: &eraftpb.HardState{Term: 5, Commit: tt.commit}, LastIndex: tt.last, LastTerm: 5}
+		require.Nil(t, engine_util.PutMeta(engines.Raft, RaftStateKey(region.Id), raftState))
+		applyState := &rspb.RaftApplyState{AppliedIndex: tt.applied, TruncatedState: &rspb.RaftTruncatedState{Index: tt.truncated, Term: 5}}
+		require.Nil(t, engine_util.PutMeta(engines.Kv, ApplyStateKey(region.Id), applyState))
+		err := CheckConsistency(engines)
+		require.Equal(t, tt.wok, err == nil, "#%d: %v", i, err)
+	}
+
+	// tombstone regions are not checked
+	kvWB = new(engine_util.WriteBatch)
+	WriteRegionState(kvWB, region, rspb.PeerState_Tombstone)
+	require.Nil(t, kvWB.WriteToDB(engines.Kv))
+	require.Nil(t, CheckConsistency(engines))
+}
@@ -109,6 +109,30 @@ type peer struct {
 	// It's updated everytime the split checker scan the data
 	// (Used in 3B split)
 	ApproximateSize *uint64
+	// Approximate size of the region when the raft log was compacted last time.
+	lastCompactSize uint64
+}
+
+// StorageStats is what the raft log gc decision is based on.
+type StorageStats struct {
+	FirstIndex   uint64
+	AppliedIndex uint64
+	// ApproximateSize is the approximate size of the region, 0 if the split
+	// checker has not measured it yet.
+	ApproximateSize uint64
+}
+
+// Stats returns the current StorageStats of the peer.
+func (p *peer) Stats() StorageStats {
+	firstIdx, _ := p.peerStorage.FirstIndex()
+	stats := StorageStats{
+		FirstIndex:   firstIdx,
+		AppliedIndex: p.peerStorage.AppliedIndex(),
+	}
+	if p.ApproximateSize != nil {
+		stats.ApproximateSize = *p.ApproximateSize
+	}
+	return stats
 }
 
 func NewPeer(storeId uint64, cfg *config.Config, engines *engine_util.Engines, region *metapb.Region, regionSched chan<- worker.Task,
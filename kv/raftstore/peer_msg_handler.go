@@ -1,10 +1,12 @@
 package raftstore
 
 import (
+	stderrors "errors"
 	"fmt"
 	"time"
 
 	"github.com/Connor1996/badger/y"
+	"github.com/pingcap-incubator/tinykv/kv/config"
 	"github.com/pingcap-incubator/tinykv/kv/raftstore/message"
 	"github.com/pingcap-incubator/tinykv/kv/raftstore/runner"
 	"github.com/pingcap-incubator/tinykv/kv/raftstore/snap"
@@ -13,6 +15,7 @@ import (
 	"github.com/pingcap-incubator/tinykv/proto/pkg/metapb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/raft_cmdpb"
 	rspb "github.com/pingcap-incubator/tinykv/proto/pkg/raft_serverpb"
+	"github.com/pingcap-incubator/tinykv/raft"
 	"github.com/pingcap-incubator/tinykv/scheduler/pkg/btree"
 	"github.com/pingcap/errors"
 )
@@ -196,6 +199,10 @@ func (d *peerMsgHandler) onRaftMsg(msg *rspb.RaftMessage) error {
 	}
 	d.insertPeerCache(msg.GetFromPeer())
 	err = d.RaftGroup.Step(*msg.GetMessage())
+	if stderrors.Is(err, raft.ErrDropped) {
+		log.Debugf("%s %v", d.Tag, err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -409,20 +416,30 @@ func (d *peerMsgHandler) onRaftGCLogTick() {
 		return
 	}
 
-	appliedIdx := d.peerStorage.AppliedIndex()
-	firstIdx, _ := d.peerStorage.FirstIndex()
-	var compactIdx uint64
-	if appliedIdx > firstIdx && appliedIdx-firstIdx >= d.ctx.cfg.RaftLogGcCountLimit {
-		compactIdx = appliedIdx
-	} else {
+	stats := d.Stats()
+	request := d.compactLogRequest(stats)
+	if request == nil {
 		return
 	}
+	d.proposeRaftCommand(request, nil)
+	d.lastCompactSize = stats.ApproximateSize
+}
+
+// compactLogRequest returns the CompactLog request the raft log gc tick proposes
+// for stats, or nil if the log doesn't need to be compacted yet. The log is
+// compacted up to the entry before the applied index.
+func (d *peerMsgHandler) compactLogRequest(stats StorageStats) *raft_cmdpb.RaftCmdRequest {
+	appliedIdx, firstIdx := stats.AppliedIndex, stats.FirstIndex
+	if !needCompactLog(d.ctx.cfg, stats, d.lastCompactSize) {
+		return nil
+	}
+	compactIdx := appliedIdx
 
 	y.Assert(compactIdx > 0)
 	compactIdx -= 1
 	if compactIdx < firstIdx {
 		// In case compact_idx == first_idx before subtraction.
-		return
+		return nil
 	}
 
 	term, err := d.RaftGroup.Raft.RaftLog.Term(compactIdx)
@@ -432,9 +449,20 @@ func (d *peerMsgHandler) onRaftGCLogTick() {
 	}
 
 	// Create a compact log request and notify directly.
-	regionID := d.regionId
-	request := newCompactLogRequest(regionID, d.Meta, compactIdx, term)
-	d.proposeRaftCommand(request, nil)
+	return newCompactLogRequest(d.regionId, d.Meta, compactIdx, term)
+}
+
+// needCompactLog reports whether the raft log should be compacted, either because
+// too many entries have been applied since the first index, or because the region
+// has grown by more than RaftLogGcSizeLimit bytes since the last compaction.
+func needCompactLog(cfg *config.Config, stats StorageStats, lastCompactSize uint64) bool {
+	if stats.AppliedIndex <= stats.FirstIndex {
+		return false
+	}
+	if stats.AppliedIndex-stats.FirstIndex >= cfg.RaftLogGcCountLimit {
+		return true
+	}
+	return cfg.RaftLogGcSizeLimit != 0 && stats.ApproximateSize >= lastCompactSize+cfg.RaftLogGcSizeLimit
 }
 
 func (d *peerMsgHandler) onSplitRegionCheckTick() {
@@ -0,0 +1,110 @@
+package raftstore
+
+import (
+	"testing"
+
+	"github.com/pingcap-incubator/tinykv/kv/config"
+	"github.com/pingcap-incubator/tinykv/kv/raftstore/util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/raft_cmdpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNeedCompactLog(t *testing.T) {
+	cfg := config.NewTestConfig()
+	cfg.RaftLogGcCountLimit = 100
+	cfg.RaftLogGcSizeLimit = 1024
+
+	tests := []struct {
+		stats           StorageStats
+		lastCompactSize uint64
+		want            bool
+	}{
+		// nothing applied beyond the first index
+		{StorageStats{FirstIndex: 5, AppliedIndex: 5, ApproximateSize: 4096}, 0, false},
+		// below both limits
+		{StorageStats{FirstIndex: 5, AppliedIndex: 10, ApproximateSize: 1023}, 0, false},
+		// the count limit is crossed
+		{StorageStats{FirstIndex: 5, AppliedIndex: 105}, 0, true},
+		// the region grew past the size limit since the last compaction
+		{StorageStats{FirstIndex: 5, AppliedIndex: 10, ApproximateSize: 2048}, 1024, true},
+		{StorageStats{FirstIndex: 5, AppliedIndex: 10, ApproximateSize: 2047}, 1024, false},
+	}
+	for i, tt := range tests {
+		require.Equal(t, tt.want, needCompactLog(cfg, tt.stats, tt.lastCompactSize), "#%d", i)
+	}
+
+	// the size trigger is disabled by a zero limit
+	cfg.RaftLogGcSizeLimit = 0
+	require.False(t, needCompactLog(cfg, StorageStats{FirstIndex: 5, AppliedIndex: 10, ApproximateSize: 1 << 30}, 0))
+}
+
+// newTestPeerMsgHandler returns the handler of the only peer of a freshly
+// bootstrapped region. The peer campaigns on creation, so it is the leader and
+// its log holds the noop entry of its term right after the initial truncated
+// state.
+func newTestPeerMsgHandler(t *testing.T, cfg *config.Config) *peerMsgHandler {
+	engines := util.NewTestEngines()
+	t.Cleanup(func() { engines.Destroy() })
+	require.Nil(t, BootstrapStore(engines, 1, 1))
+	region, err := PrepareBootstrap(engines, 1, 1, 1)
+	require.Nil(t, err)
+	p, err := NewPeer(1, cfg, engines, region, nil, region.Peers[0])
+	require.Nil(t, err)
+	require.True(t, p.IsLeader())
+	return newPeerMsgHandler(p, &GlobalContext{cfg: cfg, engine: engines})
+}
+
+func TestRaftGCLogTickProposesCompactLog(t *testing.T) {
+	cfg := config.NewTestConfig()
+	cfg.RaftLogGcCountLimit = 2
+	d := newTestPeerMsgHandler(t, cfg)
+	require.Nil(t, d.RaftGroup.Propose([]byte("data")))
+	firstIdx, term := d.Stats().FirstIndex, d.Term()
+	lastIdx := d.RaftGroup.Raft.RaftLog.LastIndex()
+	require.Equal(t, firstIdx+1, lastIdx)
+
+	// one entry applied beyond the first index is below the count limit
+	d.peerStorage.applyState.AppliedIndex = firstIdx + 1
+	require.Nil(t, d.compactLogRequest(d.Stats()))
+
+	// crossing it compacts up to the entry before the applied one
+	require.Nil(t, d.RaftGroup.Propose([]byte("data")))
+	d.peerStorage.applyState.AppliedIndex = firstIdx + 2
+	req := d.compactLogRequest(d.Stats())
+	require.NotNil(t, req)
+	require.Equal(t, raft_cmdpb.AdminCmdType_CompactLog, req.AdminRequest.CmdType)
+	require.Equal(t, &raft_cmdpb.CompactLogRequest{CompactIndex: firstIdx + 1, CompactTerm: term}, req.AdminRequest.CompactLog)
+	require.Equal(t, d.regionId, req.Header.RegionId)
+	require.Equal(t, d.Meta, req.Header.Peer)
+	// the leader accepts the request it builds
+	require.Nil(t, d.preProposeRaftCommand(req))
+}
+
+func TestRaftGCLogTickSizeLimit(t *testing.T) {
+	cfg := config.NewTestConfig()
+	cfg.RaftLogGcSizeLimit = 1024
+	d := newTestPeerMsgHandler(t, cfg)
+	require.Nil(t, d.RaftGroup.Propose([]byte("data")))
+	d.peerStorage.applyState.AppliedIndex = d.Stats().FirstIndex + 1
+
+	setSize := func(size uint64) { d.ApproximateSize = &size }
+	setSize(1023)
+	require.Nil(t, d.compactLogRequest(d.Stats()))
+
+	setSize(2048)
+	require.NotNil(t, d.compactLogRequest(d.Stats()))
+	// the tick remembers the size it compacted at, the region has to grow by
+	// another RaftLogGcSizeLimit before the next compaction
+	d.onRaftGCLogTick()
+	require.Equal(t, uint64(2048), d.lastCompactSize)
+	require.Nil(t, d.compactLogRequest(d.Stats()))
+	setSize(3072)
+	require.NotNil(t, d.compactLogRequest(d.Stats()))
+
+	// only the leader compacts
+	d.RaftGroup.Raft.Step(eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppend, From: 2, To: 1, Term: d.Term() + 1})
+	require.False(t, d.IsLeader())
+	d.onRaftGCLogTick()
+	require.Equal(t, uint64(2048), d.lastCompactSize)
+}
@@ -86,12 +86,15 @@ func (ps *PeerStorage) InitialState() (eraftpb.HardState, eraftpb.ConfState, err
 	return *raftState.HardState, util.ConfStateFromRegion(ps.region), nil
 }
 
-func (ps *PeerStorage) Entries(low, high uint64) ([]eraftpb.Entry, error) {
+// Entries returns the entries in [low, high), cut short once their total size
+// would exceed maxSize but always including the first one.
+func (ps *PeerStorage) Entries(low, high, maxSize uint64) ([]eraftpb.Entry, error) {
 	if err := ps.checkRange(low, high); err != nil || low == high {
 		return nil, err
 	}
 	buf := make([]eraftpb.Entry, 0, high-low)
 	nextIndex := low
+	size := uint64(0)
 	txn := ps.Engines.Raft.NewTransaction(false)
 	defer txn.Discard()
 	startKey := meta.RaftLogKey(ps.region.Id, low)
@@ -115,6 +118,10 @@ func (ps *PeerStorage) Entries(low, high uint64) ([]eraftpb.Entry, error) {
 		if entry.Index != nextIndex {
 			break
 		}
+		size += uint64(entry.Size())
+		if len(buf) > 0 && size > maxSize {
+			return buf, nil
+		}
 		nextIndex++
 		buf = append(buf, entry)
 	}
@@ -2,6 +2,7 @@ package raftstore
 
 import (
 	"bytes"
+	"math"
 	"testing"
 
 	"github.com/Connor1996/badger"
@@ -189,7 +190,7 @@ func TestPeerStorageEntries(t *testing.T) {
 	for i, tt := range tests {
 		peerStore := newTestPeerStorageFromEnts(t, ents)
 		defer cleanUpTestData(peerStore)
-		entries, err := peerStore.Entries(tt.low, tt.high)
+		entries, err := peerStore.Entries(tt.low, tt.high, math.MaxUint64)
 		if err != nil {
 			assert.Equal(t, tt.err, err)
 		} else {
@@ -240,7 +241,7 @@ func TestPeerStorageAppend(t *testing.T) {
 		defer cleanUpTestData(peerStore)
 		appendEnts(t, peerStore, tt.appends)
 		li := peerStore.raftState.LastIndex
-		acutualEntries, err := peerStore.Entries(4, li+1)
+		acutualEntries, err := peerStore.Entries(4, li+1, math.MaxUint64)
 		require.Nil(t, err)
 		assert.Equal(t, tt.results, acutualEntries)
 	}
@@ -107,6 +107,10 @@ type Transport interface {
 /// loadPeers loads peers in this store. It scans the db engine, loads all regions and their peers from it
 /// WARN: This store should not be used before initialized.
 func (bs *Raftstore) loadPeers() ([]*peer, error) {
+	if err := meta.CheckConsistency(bs.ctx.engine); err != nil {
+		return nil, err
+	}
+
 	// Scan region meta to get saved regions.
 	startKey := meta.RegionMetaMinKey
 	endKey := meta.RegionMetaMaxKey
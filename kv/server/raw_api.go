@@ -1,9 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/pingcap-incubator/tinykv/kv/storage"
+	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
 )
 
@@ -11,7 +15,14 @@ import (
 // Some helper methods can be found in sever.go in the current directory
 
 // RawGet return the corresponding Get response based on RawGetRequest's CF and Key fields
-func (server *Server) RawGet(_ context.Context, req *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
+func (server *Server) RawGet(ctx context.Context, req *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
 	// Your Code Here (1).
 	reader, err := server.storage.Reader(req.Context)
 	if err != nil {
@@ -23,7 +34,14 @@ func (server *Server) RawGet(_ context.Context, req *kvrpcpb.RawGetRequest) (*kv
 }
 
 // RawPut puts the target data into storage and returns the corresponding response
-func (server *Server) RawPut(_ context.Context, req *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+func (server *Server) RawPut(ctx context.Context, req *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
 	// Your Code Here (1).
 	// Hint: Consider using Storage.Modify to store data to be modified
 	put := storage.Put{
@@ -37,7 +55,14 @@ func (server *Server) RawPut(_ context.Context, req *kvrpcpb.RawPutRequest) (*kv
 }
 
 // RawDelete delete the target data from storage and returns the corresponding response
-func (server *Server) RawDelete(_ context.Context, req *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+func (server *Server) RawDelete(ctx context.Context, req *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
 	// Your Code Here (1).
 	// Hint: Consider using Storage.Modify to store data to be deleted
 	delete := storage.Delete{
@@ -50,7 +75,23 @@ func (server *Server) RawDelete(_ context.Context, req *kvrpcpb.RawDeleteRequest
 }
 
 // RawScan scan the data starting from the start key up to limit. and return the corresponding result
-func (server *Server) RawScan(_ context.Context, req *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
+// in strictly ascending key order. Only the pairs of the requested CF are returned, so a scan never
+// crosses into another CF however the storage lays the CFs out.
+func (server *Server) RawScan(ctx context.Context, req *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	return server.rawScan(ctx, req, false)
+}
+
+func (server *Server) rawScan(ctx context.Context, req *kvrpcpb.RawScanRequest, keysOnly bool) (*kvrpcpb.RawScanResponse, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	if resp := server.checkScanLimit(req.Limit); resp != nil {
+		return resp, nil
+	}
 	// Your Code Here (1).
 	// Hint: Consider using reader.IterCF
 	reader, err := server.storage.Reader(req.Context)
@@ -58,16 +99,101 @@ func (server *Server) RawScan(_ context.Context, req *kvrpcpb.RawScanRequest) (*
 		return nil, err
 	}
 	defer reader.Close()
-	iter := reader.IterCF(req.Cf)
-	defer iter.Close()
-	iter.Seek(req.StartKey)
 	var pairs []*kvrpcpb.KvPair
-	for i := 0; i < int(req.Limit) && iter.Valid(); i++ {
-		item := iter.Item()
-		key := item.Key()
-		value, _ := item.Value()
-		pairs = append(pairs, &kvrpcpb.KvPair{Key: key, Value: value})
-		iter.Next()
+	err = scanCF(ctx, reader, req.Cf, req.StartKey, req.Limit, keysOnly, func(pair *kvrpcpb.KvPair) bool {
+		pairs = append(pairs, pair)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &kvrpcpb.RawScanResponse{Kvs: pairs}, nil
 }
+
+// ErrScanLimitExceeded is reported in the Error field of the response to a
+// scan whose Limit is above Config.MaxScanLimit.
+var ErrScanLimitExceeded = errors.New("scan limit exceeds the max scan limit")
+
+// checkScanLimit returns the response rejecting a scan of limit pairs, or nil
+// if the limit is allowed. Clients that need more pairs paginate the scan.
+func (server *Server) checkScanLimit(limit uint32) *kvrpcpb.RawScanResponse {
+	if limit <= server.maxScanLimit {
+		return nil
+	}
+	err := fmt.Errorf("%w: %d > %d, paginate the scan instead", ErrScanLimitExceeded, limit, server.maxScanLimit)
+	return &kvrpcpb.RawScanResponse{Error: err.Error()}
+}
+
+// scanCF visits at most limit pairs of cf in key order starting from start,
+// it stops early when fn returns false. Pairs are handed to fn one by one so
+// the caller decides how many of them to keep in memory. The scan is aborted
+// with the context error once ctx is cancelled or its deadline passes.
+func scanCF(ctx context.Context, reader storage.StorageReader, cf string, start []byte, limit uint32, keysOnly bool, fn func(*kvrpcpb.KvPair) bool) error {
+	if limit == 0 {
+		return nil
+	}
+	visited := uint32(0)
+	return visitCF(ctx, reader, cf, start, keysOnly, func(pair *kvrpcpb.KvPair) bool {
+		visited++
+		return fn(pair) && visited < limit
+	})
+}
+
+// visitCF hands the pairs of cf to fn in key order starting from start until fn
+// returns false or the CF is exhausted, checking ctx before every pair. With
+// keysOnly the values are not read and the pairs carry a nil Value. A key that
+// does not sort after the previous one fails the scan with ErrScanOutOfOrder.
+func visitCF(ctx context.Context, reader storage.StorageReader, cf string, start []byte, keysOnly bool, fn func(*kvrpcpb.KvPair) bool) error {
+	iter := reader.IterCF(cf)
+	defer iter.Close()
+	var order scanOrder
+	for iter.Seek(start); iter.Valid(); iter.Next() {
+		if err := ctxErr(ctx); err != nil {
+			return err
+		}
+		item := iter.Item()
+		key := item.KeyCopy(nil)
+		if err := order.check(key); err != nil {
+			return err
+		}
+		var value []byte
+		if !keysOnly {
+			var err error
+			if value, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+		if !fn(&kvrpcpb.KvPair{Key: key, Value: value}) {
+			return nil
+		}
+	}
+	return engine_util.IterErr(iter)
+}
+
+// ErrScanOutOfOrder is returned by the scans when the storage iterator hands
+// out a key that does not sort strictly after the previous one. Every scan
+// promises its pairs in key order, so such a scan fails rather than returning
+// pairs a client would wrongly assume to be sorted.
+var ErrScanOutOfOrder = errors.New("storage iterator returned keys out of order")
+
+// scanOrder checks that the keys of a scan arrive in strictly ascending order.
+type scanOrder struct {
+	prev    []byte
+	started bool
+}
+
+func (o *scanOrder) check(key []byte) error {
+	if o.started && bytes.Compare(key, o.prev) <= 0 {
+		return fmt.Errorf("%w: %q after %q", ErrScanOutOfOrder, key, o.prev)
+	}
+	o.prev, o.started = key, true
+	return nil
+}
+
+// ctxErr returns the error of ctx, a nil ctx is never done.
+func ctxErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Err()
+}
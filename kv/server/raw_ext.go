@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
+)
+
+// The functions below extend the Raw API for in-process callers such as tools and
+// tests that link the server. Their requests are Go types with no proto definition,
+// so they are not part of TinyKvServer and cannot be called over gRPC.
+
+// RawBatchGetRequest is the request of RawBatchGet, all keys are read from the same CF.
+type RawBatchGetRequest struct {
+	Context *kvrpcpb.Context
+	Cf      string
+	Keys    [][]byte
+}
+
+// RawBatchGetResponse holds one pair for each requested key in request order, the value of a missing key is nil.
+type RawBatchGetResponse struct {
+	Kvs []*kvrpcpb.KvPair
+}
+
+// RawBatchGet reads several keys from a single storage reader, so the result is one consistent view of the store:
+// it reflects every write completed before the call. With StandAloneStorage there is only one node to read from.
+// With RaftStorage the reader is taken by proposing a snap command through the region's raft group, which confirms
+// leadership and waits for the command to be applied, so the batch is linearizable as well.
+func (server *Server) RawBatchGet(ctx context.Context, req *RawBatchGetRequest) (*RawBatchGetResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	reader, err := server.storage.Reader(req.Context)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// a key repeated in the batch is read once and its value shared by every position
+	values := make(map[string][]byte, len(req.Keys))
+	kvs := make([]*kvrpcpb.KvPair, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		value, ok := values[string(key)]
+		if !ok {
+			if err := ctxErr(ctx); err != nil {
+				return nil, err
+			}
+			value, err = reader.GetCF(req.Cf, key)
+			if err != nil {
+				return nil, err
+			}
+			values[string(key)] = value
+		}
+		kvs = append(kvs, &kvrpcpb.KvPair{Key: key, Value: value})
+	}
+	return &RawBatchGetResponse{Kvs: kvs}, nil
+}
+
+// RawKeyScanRequest is a RawScanRequest that can leave the values out. With
+// ReturnOnlyKeys the scan never reads a value, sparing the value log reads of
+// large values when only the keys are wanted, e.g. for existence checks.
+type RawKeyScanRequest struct {
+	*kvrpcpb.RawScanRequest
+	ReturnOnlyKeys bool
+}
+
+// RawKeyScan scans like RawScan, in the same ascending key order, the
+// returned pairs have a nil Value when ReturnOnlyKeys is set.
+func (server *Server) RawKeyScan(ctx context.Context, req *RawKeyScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	return server.rawScan(ctx, req.RawScanRequest, req.ReturnOnlyKeys)
+}
+
+// RawVersionScanRequest is a RawScanRequest that only returns the keys whose
+// latest version lies in [MinVersion, MaxVersion], a zero MaxVersion leaves
+// the window unbounded above. Versions are the commit timestamps badger
+// assigns to writes, so the window selects keys by when they were last written.
+type RawVersionScanRequest struct {
+	*kvrpcpb.RawScanRequest
+	MinVersion uint64
+	MaxVersion uint64
+}
+
+// ErrVersionUnsupported is returned by RawVersionScan when the storage does
+// not expose the versions of its items, e.g. MemStorage.
+var ErrVersionUnsupported = errors.New("storage does not expose key versions")
+
+// versionedItem is implemented by items that know the version they were written at.
+type versionedItem interface {
+	Version() uint64
+}
+
+// RawVersionScan scans like RawScan but skips keys written outside the version window,
+// Limit bounds the number of pairs returned rather than the number of keys visited.
+// The pairs are returned in ascending key order.
+func (server *Server) RawVersionScan(ctx context.Context, req *RawVersionScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	if resp := server.checkScanLimit(req.Limit); resp != nil {
+		return resp, nil
+	}
+	reader, err := server.storage.Reader(req.Context)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	iter := reader.IterCF(req.Cf)
+	defer iter.Close()
+	var pairs []*kvrpcpb.KvPair
+	var order scanOrder
+	for iter.Seek(req.StartKey); iter.Valid() && uint32(len(pairs)) < req.Limit; iter.Next() {
+		if err := ctxErr(ctx); err != nil {
+			return nil, err
+		}
+		key := iter.Item().KeyCopy(nil)
+		if err := order.check(key); err != nil {
+			return nil, err
+		}
+		item, ok := iter.Item().(versionedItem)
+		if !ok {
+			return nil, ErrVersionUnsupported
+		}
+		if v := item.Version(); v < req.MinVersion || (req.MaxVersion != 0 && v > req.MaxVersion) {
+			continue
+		}
+		value, err := iter.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, &kvrpcpb.KvPair{Key: key, Value: value})
+	}
+	if err := engine_util.IterErr(iter); err != nil {
+		return nil, err
+	}
+	return &kvrpcpb.RawScanResponse{Kvs: pairs}, nil
+}
+
+// RawRangeScanRequest is a RawScanRequest bounded on both sides that can scan in
+// either direction. A forward scan visits keys from StartKey up to EndKey, a
+// Reverse scan from StartKey down to EndKey in descending order. StartKey is
+// inclusive and EndKey exclusive unless StartExclusive or EndInclusive is set,
+// a nil key leaves that side of the range unbounded.
+type RawRangeScanRequest struct {
+	*kvrpcpb.RawScanRequest
+	EndKey         []byte
+	Reverse        bool
+	StartExclusive bool
+	EndInclusive   bool
+}
+
+// RawRangeScan returns up to Limit pairs of the range in scan order, ascending keys
+// for a forward scan and descending keys for a reverse one. Storage iterators only
+// move forward, so a reverse scan walks the whole range upwards from EndKey keeping
+// the keys of the last Limit pairs and returns them reversed: it costs O(range)
+// rather than O(Limit), bound the range to keep it cheap. Only the kept keys have
+// their values read.
+func (server *Server) RawRangeScan(ctx context.Context, req *RawRangeScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	if resp := server.checkScanLimit(req.Limit); resp != nil {
+		return resp, nil
+	}
+	reader, err := server.storage.Reader(req.Context)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// lo and hi are the lower and upper bound of the range whichever the direction
+	lo, loIncl, hi, hiIncl := req.StartKey, !req.StartExclusive, req.EndKey, req.EndInclusive
+	if req.Reverse {
+		lo, loIncl, hi, hiIncl = req.EndKey, req.EndInclusive, req.StartKey, !req.StartExclusive
+	}
+	var pairs []*kvrpcpb.KvPair
+	if req.Limit == 0 {
+		return &kvrpcpb.RawScanResponse{Kvs: pairs}, nil
+	}
+	err = visitCF(ctx, reader, req.Cf, lo, req.Reverse, func(pair *kvrpcpb.KvPair) bool {
+		if lo != nil && !loIncl && bytes.Equal(pair.Key, lo) {
+			return true
+		}
+		if hi != nil {
+			if c := bytes.Compare(pair.Key, hi); c > 0 || (c == 0 && !hiIncl) {
+				return false
+			}
+		}
+		pairs = append(pairs, pair)
+		if !req.Reverse {
+			return uint32(len(pairs)) < req.Limit
+		}
+		if uint32(len(pairs)) > req.Limit {
+			pairs = pairs[1:]
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if req.Reverse {
+		for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+			pairs[i], pairs[j] = pairs[j], pairs[i]
+		}
+		// read through the same reader, i.e. the same snapshot the keys came from
+		for _, pair := range pairs {
+			if pair.Value, err = reader.GetCF(req.Cf, pair.Key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &kvrpcpb.RawScanResponse{Kvs: pairs}, nil
+}
@@ -2,7 +2,15 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pingcap-incubator/tinykv/kv/config"
 	"github.com/pingcap-incubator/tinykv/kv/coprocessor"
 	"github.com/pingcap-incubator/tinykv/kv/storage"
 	"github.com/pingcap-incubator/tinykv/kv/storage/raft_storage"
@@ -11,6 +19,7 @@ import (
 	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/tinykvpb"
 	"github.com/pingcap/tidb/kv"
+	"google.golang.org/grpc"
 )
 
 var _ tinykvpb.TinyKvServer = new(Server)
@@ -24,15 +33,206 @@ type Server struct {
 
 	// coprocessor API handler, out of course scope
 	copHandler *coprocessor.CopHandler
+
+	// in-flight requests, waited for by Close. closing is set by Close, closeMu
+	// orders it against wg.Add so no request is added once Close waits.
+	wg      sync.WaitGroup
+	closeMu sync.RWMutex
+	closing atomic.Bool
+
+	// the largest Limit accepted by RawScan
+	maxScanLimit uint32
+
+	// how long Health waits for the storage to hand out a reader
+	healthCheckTimeout time.Duration
+
+	// the middleware chain every unary RPC runs through, outermost first
+	middlewares []Middleware
 }
 
+// Middleware wraps the handling of a unary RPC for cross-cutting concerns such as
+// authentication, rate limiting or request logging. req is the request of the RPC,
+// handler runs the rest of the chain and the RPC itself. A middleware may return
+// without calling handler to reject the request, its response must then be nil or
+// of the RPC's response type. The chain runs in the interceptor returned by
+// UnaryInterceptor.
+type Middleware func(ctx context.Context, req interface{}, handler func() (interface{}, error)) (interface{}, error)
+
 func NewServer(storage storage.Storage) *Server {
+	return NewServerWithConfig(storage, config.NewDefaultConfig())
+}
+
+// NewServerWithConfig creates a Server that enforces the request limits and
+// timeouts of conf.
+func NewServerWithConfig(storage storage.Storage, conf *config.Config) *Server {
+	maxScanLimit := conf.MaxScanLimit
+	if maxScanLimit == 0 {
+		maxScanLimit = config.DefaultMaxScanLimit
+	}
+	healthCheckTimeout := conf.HealthCheckTimeout
+	if healthCheckTimeout == 0 {
+		healthCheckTimeout = config.DefaultHealthCheckTimeout
+	}
 	return &Server{
-		storage: storage,
-		Latches: latches.NewLatches(),
+		storage:            storage,
+		Latches:            latches.NewLatches(),
+		maxScanLimit:       maxScanLimit,
+		healthCheckTimeout: healthCheckTimeout,
 	}
 }
 
+// Use appends m to the middleware chain, the first middleware added is the outermost.
+// It is not safe to call Use while the server is handling requests.
+func (server *Server) Use(m Middleware) {
+	server.middlewares = append(server.middlewares, m)
+}
+
+// ErrServerClosed is returned by the RPCs of a Server that is closing or closed.
+var ErrServerClosed = errors.New("server: closed")
+
+// ErrMiddlewareResponse is returned for an RPC whose middleware chain returned
+// a response that is not of the RPC's response type.
+var ErrMiddlewareResponse = errors.New("server: middleware returned a response of the wrong type")
+
+// UnaryInterceptor returns a gRPC interceptor running every unary RPC through the
+// middleware chain of server, register it with grpc.UnaryInterceptor. The grpc-go
+// version in use has no ChainUnaryInterceptor on the server side, so the chain is
+// composed here. Calling the RPC methods directly bypasses the middlewares.
+func (server *Server) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := func() (interface{}, error) { return handler(ctx, req) }
+		for i := len(server.middlewares) - 1; i >= 0; i-- {
+			m, inner := server.middlewares[i], next
+			next = func() (interface{}, error) { return m(ctx, req, inner) }
+		}
+		resp, err := next()
+		if resp != nil {
+			if want, ok := respType(info.FullMethod); ok && reflect.TypeOf(resp) != want {
+				return nil, fmt.Errorf("%w: %T for %s, want %v", ErrMiddlewareResponse, resp, info.FullMethod, want)
+			}
+		}
+		return resp, err
+	}
+}
+
+// respType returns the response type of the Server method serving fullMethod,
+// e.g. *kvrpcpb.RawGetResponse for "/tinykvpb.TinyKv/RawGet".
+func respType(fullMethod string) (reflect.Type, bool) {
+	name := fullMethod[strings.LastIndexByte(fullMethod, '/')+1:]
+	method, ok := reflect.TypeOf((*Server)(nil)).MethodByName(name)
+	if !ok || method.Type.NumOut() != 2 {
+		return nil, false
+	}
+	return method.Type.Out(0), true
+}
+
+// enter registers a new in-flight request, unless the server is closing.
+func (server *Server) enter() error {
+	server.closeMu.RLock()
+	defer server.closeMu.RUnlock()
+	if server.closing.Load() {
+		return ErrServerClosed
+	}
+	server.wg.Add(1)
+	return nil
+}
+
+// Close rejects new requests with ErrServerClosed, waits for in-flight requests
+// to finish and stops the underlying storage. Only the first call stops the
+// storage, later calls return ErrServerClosed.
+func (server *Server) Close() error {
+	server.closeMu.Lock()
+	closed := server.closing.Swap(true)
+	server.closeMu.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	server.wg.Wait()
+	return server.storage.Stop()
+}
+
+// HealthStatus is the state of a node as reported by Health.
+type HealthStatus int
+
+const (
+	// HealthStatusUnavailable means the storage could not be read in time.
+	HealthStatusUnavailable HealthStatus = iota
+	// HealthStatusHealthy means the storage is readable and is not replicated by raft.
+	HealthStatusHealthy
+	// HealthStatusLeader means the storage is readable and this node leads the region.
+	HealthStatusLeader
+	// HealthStatusFollower means the storage is up but another node leads the region.
+	HealthStatusFollower
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case HealthStatusHealthy:
+		return "HEALTHY"
+	case HealthStatusLeader:
+		return "LEADER"
+	case HealthStatusFollower:
+		return "FOLLOWER"
+	default:
+		return "UNAVAILABLE"
+	}
+}
+
+// Health reports whether the storage hands out a reader within the configured
+// HealthCheckTimeout and, for a RaftStorage, whether this node is the leader of
+// the region selected by reqCtx. Any failure, including the timeout and a closed
+// server, is reported as HealthStatusUnavailable. It is meant for in-process
+// callers such as a status endpoint, it is not part of the gRPC API.
+func (server *Server) Health(ctx context.Context, reqCtx *kvrpcpb.Context) HealthStatus {
+	if server.enter() != nil {
+		return HealthStatusUnavailable
+	}
+	defer server.wg.Done()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, server.healthCheckTimeout)
+	defer cancel()
+
+	if reqCtx == nil {
+		reqCtx = new(kvrpcpb.Context)
+	}
+	type result struct {
+		reader storage.StorageReader
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reader, err := server.storage.Reader(reqCtx)
+		done <- result{reader, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		// 超时后 Reader 仍可能返回，需要关闭迟到的 reader
+		go func() {
+			if res := <-done; res.reader != nil {
+				res.reader.Close()
+			}
+		}()
+		return HealthStatusUnavailable
+	}
+	if res.err != nil {
+		var regionErr *raft_storage.RegionError
+		if errors.As(res.err, &regionErr) && regionErr.RequestErr.GetNotLeader() != nil {
+			return HealthStatusFollower
+		}
+		return HealthStatusUnavailable
+	}
+	res.reader.Close()
+	if _, ok := server.storage.(*raft_storage.RaftStorage); ok {
+		return HealthStatusLeader
+	}
+	return HealthStatusHealthy
+}
+
 // The below functions are Server's gRPC API (implements TinyKvServer).
 
 // Raft commands (tinykv <-> tinykv)
@@ -49,42 +249,74 @@ func (server *Server) Snapshot(stream tinykvpb.TinyKv_SnapshotServer) error {
 
 // Transactional API.
 func (server *Server) KvGet(_ context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb.GetResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	// Your Code Here (4B).
 	return nil, nil
 }
 
 func (server *Server) KvPrewrite(_ context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	// Your Code Here (4B).
 	return nil, nil
 }
 
 func (server *Server) KvCommit(_ context.Context, req *kvrpcpb.CommitRequest) (*kvrpcpb.CommitResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	// Your Code Here (4B).
 	return nil, nil
 }
 
 func (server *Server) KvScan(_ context.Context, req *kvrpcpb.ScanRequest) (*kvrpcpb.ScanResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	// Your Code Here (4C).
 	return nil, nil
 }
 
 func (server *Server) KvCheckTxnStatus(_ context.Context, req *kvrpcpb.CheckTxnStatusRequest) (*kvrpcpb.CheckTxnStatusResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	// Your Code Here (4C).
 	return nil, nil
 }
 
 func (server *Server) KvBatchRollback(_ context.Context, req *kvrpcpb.BatchRollbackRequest) (*kvrpcpb.BatchRollbackResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	// Your Code Here (4C).
 	return nil, nil
 }
 
 func (server *Server) KvResolveLock(_ context.Context, req *kvrpcpb.ResolveLockRequest) (*kvrpcpb.ResolveLockResponse, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	// Your Code Here (4C).
 	return nil, nil
 }
 
 // SQL push down commands.
 func (server *Server) Coprocessor(_ context.Context, req *coppb.Request) (*coppb.Response, error) {
+	if err := server.enter(); err != nil {
+		return nil, err
+	}
+	defer server.wg.Done()
 	resp := new(coppb.Response)
 	reader, err := server.storage.Reader(req.Context)
 	if err != nil {
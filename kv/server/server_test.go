@@ -1,15 +1,22 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pingcap-incubator/tinykv/kv/config"
 	"github.com/pingcap-incubator/tinykv/kv/storage"
+	"github.com/pingcap-incubator/tinykv/kv/storage/raft_storage"
 	"github.com/pingcap-incubator/tinykv/kv/storage/standalone_storage"
 	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/errorpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
 )
 
 func Set(s *standalone_storage.StandAloneStorage, cf string, key []byte, value []byte) error {
@@ -346,3 +353,648 @@ func TestIterWithRawDelete1(t *testing.T) {
 		i++
 	}
 }
+
+func TestScanCFMatchesRawScan1(t *testing.T) {
+	conf := config.NewTestConfig()
+	s := standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	server := NewServer(s)
+	defer cleanUpTestData(conf)
+	defer s.Stop()
+
+	cf := engine_util.CfDefault
+	for i := byte(1); i <= 5; i++ {
+		Set(s, cf, []byte{i}, []byte{233, i})
+	}
+
+	resp, err := server.RawScan(nil, &kvrpcpb.RawScanRequest{StartKey: []byte{2}, Limit: 10, Cf: cf})
+	assert.Nil(t, err)
+
+	reader, err := s.Reader(nil)
+	assert.Nil(t, err)
+	defer reader.Close()
+	var streamed []*kvrpcpb.KvPair
+	err = scanCF(nil, reader, cf, []byte{2}, 10, false, func(pair *kvrpcpb.KvPair) bool {
+		streamed = append(streamed, pair)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Kvs, streamed)
+
+	// the scan stops as soon as the callback returns false
+	visited := 0
+	err = scanCF(nil, reader, cf, []byte{1}, 10, false, func(pair *kvrpcpb.KvPair) bool {
+		visited++
+		return visited < 2
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, visited)
+}
+
+func TestRawBatchGet1(t *testing.T) {
+	conf := config.NewTestConfig()
+	s := standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	server := NewServer(s)
+	defer cleanUpTestData(conf)
+	defer s.Stop()
+
+	cf := engine_util.CfDefault
+	for i := byte(1); i <= 3; i++ {
+		_, err := server.RawPut(nil, &kvrpcpb.RawPutRequest{Key: []byte{i}, Value: []byte{233, i}, Cf: cf})
+		assert.Nil(t, err)
+	}
+	_, err := server.RawDelete(nil, &kvrpcpb.RawDeleteRequest{Key: []byte{2}, Cf: cf})
+	assert.Nil(t, err)
+
+	resp, err := server.RawBatchGet(nil, &RawBatchGetRequest{Cf: cf, Keys: [][]byte{{3}, {2}, {1}, {4}}})
+	assert.Nil(t, err)
+	expected := []*kvrpcpb.KvPair{
+		{Key: []byte{3}, Value: []byte{233, 3}},
+		{Key: []byte{2}},
+		{Key: []byte{1}, Value: []byte{233, 1}},
+		{Key: []byte{4}},
+	}
+	assert.Equal(t, expected, resp.Kvs)
+}
+
+type countingStorage struct {
+	*storage.MemStorage
+	gets   int
+	values int
+}
+
+func (s *countingStorage) Reader(ctx *kvrpcpb.Context) (storage.StorageReader, error) {
+	reader, err := s.MemStorage.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{StorageReader: reader, gets: &s.gets, values: &s.values}, nil
+}
+
+// countingReader counts the point gets and the values read by iterators.
+type countingReader struct {
+	storage.StorageReader
+	gets   *int
+	values *int
+}
+
+func (r *countingReader) GetCF(cf string, key []byte) ([]byte, error) {
+	*r.gets++
+	return r.StorageReader.GetCF(cf, key)
+}
+
+func (r *countingReader) IterCF(cf string) engine_util.DBIterator {
+	return &countingIter{DBIterator: r.StorageReader.IterCF(cf), values: r.values}
+}
+
+type countingIter struct {
+	engine_util.DBIterator
+	values *int
+}
+
+func (it *countingIter) Item() engine_util.DBItem {
+	return &countingItem{DBItem: it.DBIterator.Item(), values: it.values}
+}
+
+type countingItem struct {
+	engine_util.DBItem
+	values *int
+}
+
+func (i *countingItem) Value() ([]byte, error) {
+	*i.values++
+	return i.DBItem.Value()
+}
+
+func (i *countingItem) ValueCopy(dst []byte) ([]byte, error) {
+	*i.values++
+	return i.DBItem.ValueCopy(dst)
+}
+
+func TestRawBatchGetDuplicateKeys1(t *testing.T) {
+	s := &countingStorage{MemStorage: storage.NewMemStorage()}
+	server := NewServer(s)
+
+	cf := engine_util.CfDefault
+	_, err := server.RawPut(nil, &kvrpcpb.RawPutRequest{Key: []byte{1}, Value: []byte{233, 1}, Cf: cf})
+	assert.Nil(t, err)
+
+	resp, err := server.RawBatchGet(nil, &RawBatchGetRequest{Cf: cf, Keys: [][]byte{{1}, {2}, {1}, {2}, {1}}})
+	assert.Nil(t, err)
+	expected := []*kvrpcpb.KvPair{
+		{Key: []byte{1}, Value: []byte{233, 1}},
+		{Key: []byte{2}},
+		{Key: []byte{1}, Value: []byte{233, 1}},
+		{Key: []byte{2}},
+		{Key: []byte{1}, Value: []byte{233, 1}},
+	}
+	assert.Equal(t, expected, resp.Kvs)
+	assert.Equal(t, 2, s.gets)
+}
+
+func TestRawRangeScan1(t *testing.T) {
+	s := storage.NewMemStorage()
+	server := NewServer(s)
+
+	cf := engine_util.CfDefault
+	for i := byte(1); i <= 5; i++ {
+		_, err := server.RawPut(nil, &kvrpcpb.RawPutRequest{Key: []byte{i}, Value: []byte{233, i}, Cf: cf})
+		assert.Nil(t, err)
+	}
+
+	tests := []struct {
+		start, end                   []byte
+		reverse                      bool
+		startExclusive, endInclusive bool
+		limit                        uint32
+		wkeys                        []byte
+	}{
+		{[]byte{2}, []byte{4}, false, false, false, 10, []byte{2, 3}},
+		{[]byte{2}, []byte{4}, false, true, false, 10, []byte{3}},
+		{[]byte{2}, []byte{4}, false, false, true, 10, []byte{2, 3, 4}},
+		{[]byte{2}, []byte{4}, false, true, true, 10, []byte{3, 4}},
+		{[]byte{4}, []byte{2}, true, false, false, 10, []byte{4, 3}},
+		{[]byte{4}, []byte{2}, true, true, false, 10, []byte{3}},
+		{[]byte{4}, []byte{2}, true, false, true, 10, []byte{4, 3, 2}},
+		{[]byte{4}, []byte{2}, true, true, true, 10, []byte{3, 2}},
+		// unbounded sides
+		{nil, nil, false, false, false, 10, []byte{1, 2, 3, 4, 5}},
+		{nil, nil, true, false, false, 10, []byte{5, 4, 3, 2, 1}},
+		{[]byte{3}, nil, true, true, false, 10, []byte{2, 1}},
+		// limit keeps the pairs closest to the start key
+		{[]byte{1}, nil, false, false, false, 2, []byte{1, 2}},
+		{[]byte{5}, nil, true, false, false, 2, []byte{5, 4}},
+		{[]byte{5}, nil, true, false, false, 0, nil},
+	}
+	for i, tt := range tests {
+		resp, err := server.RawRangeScan(nil, &RawRangeScanRequest{
+			RawScanRequest: &kvrpcpb.RawScanRequest{StartKey: tt.start, Limit: tt.limit, Cf: cf},
+			EndKey:         tt.end,
+			Reverse:        tt.reverse,
+			StartExclusive: tt.startExclusive,
+			EndInclusive:   tt.endInclusive,
+		})
+		assert.Nil(t, err, "#%d", i)
+		var keys []byte
+		for _, kv := range resp.Kvs {
+			assert.Equal(t, []byte{233, kv.Key[0]}, kv.Value, "#%d", i)
+			keys = append(keys, kv.Key[0])
+		}
+		assert.Equal(t, tt.wkeys, keys, "#%d", i)
+	}
+}
+
+func TestRawKeyScan1(t *testing.T) {
+	s := &countingStorage{MemStorage: storage.NewMemStorage()}
+	server := NewServer(s)
+
+	cf := engine_util.CfDefault
+	for i := byte(1); i <= 5; i++ {
+		_, err := server.RawPut(nil, &kvrpcpb.RawPutRequest{Key: []byte{i}, Value: []byte{233, i}, Cf: cf})
+		assert.Nil(t, err)
+	}
+
+	req := &kvrpcpb.RawScanRequest{StartKey: []byte{2}, Limit: 3, Cf: cf}
+	resp, err := server.RawKeyScan(nil, &RawKeyScanRequest{RawScanRequest: req, ReturnOnlyKeys: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []*kvrpcpb.KvPair{{Key: []byte{2}}, {Key: []byte{3}}, {Key: []byte{4}}}, resp.Kvs)
+	assert.Equal(t, 0, s.values)
+
+	resp, err = server.RawKeyScan(nil, &RawKeyScanRequest{RawScanRequest: req})
+	assert.Nil(t, err)
+	scanResp, err := server.RawScan(nil, req)
+	assert.Nil(t, err)
+	assert.Equal(t, scanResp.Kvs, resp.Kvs)
+	assert.Equal(t, 6, s.values)
+}
+
+func TestServerMiddleware1(t *testing.T) {
+	s := storage.NewMemStorage()
+	server := NewServer(s)
+
+	var calls []string
+	logging := func(name string) Middleware {
+		return func(ctx context.Context, req interface{}, handler func() (interface{}, error)) (interface{}, error) {
+			calls = append(calls, name+" before")
+			resp, err := handler()
+			calls = append(calls, name+" after")
+			return resp, err
+		}
+	}
+	errDenied := errors.New("denied")
+	server.Use(logging("outer"))
+	server.Use(logging("inner"))
+	server.Use(func(ctx context.Context, req interface{}, handler func() (interface{}, error)) (interface{}, error) {
+		if put, ok := req.(*kvrpcpb.RawPutRequest); ok && put.Cf == engine_util.CfLock {
+			return nil, errDenied
+		}
+		return handler()
+	})
+
+	// call the RPCs the way the gRPC server does once the interceptor is registered
+	intercept := server.UnaryInterceptor()
+	rawPut := func(req *kvrpcpb.RawPutRequest) (interface{}, error) {
+		return intercept(context.Background(), req, &grpc.UnaryServerInfo{FullMethod: "/tinykvpb.TinyKv/RawPut"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return server.RawPut(ctx, req.(*kvrpcpb.RawPutRequest))
+			})
+	}
+
+	cf := engine_util.CfDefault
+	_, err := rawPut(&kvrpcpb.RawPutRequest{Key: []byte{1}, Value: []byte{42}, Cf: cf})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, calls)
+
+	resp, err := server.RawGet(context.Background(), &kvrpcpb.RawGetRequest{Key: []byte{1}, Cf: cf})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{42}, resp.Value)
+
+	putResp, err := rawPut(&kvrpcpb.RawPutRequest{Key: []byte{1}, Value: []byte{42}, Cf: engine_util.CfLock})
+	assert.Equal(t, errDenied, err)
+	assert.Nil(t, putResp)
+	assert.Nil(t, s.Get(engine_util.CfLock, []byte{1}))
+
+	// a middleware answering with another RPC's response fails the RPC instead of sending it
+	server.Use(func(ctx context.Context, req interface{}, handler func() (interface{}, error)) (interface{}, error) {
+		return &kvrpcpb.RawGetResponse{}, nil
+	})
+	putResp, err = rawPut(&kvrpcpb.RawPutRequest{Key: []byte{2}, Value: []byte{42}, Cf: cf})
+	assert.True(t, errors.Is(err, ErrMiddlewareResponse))
+	assert.Nil(t, putResp)
+}
+
+func TestServerClose1(t *testing.T) {
+	conf := config.NewTestConfig()
+	s := standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	server := NewServer(s)
+	defer cleanUpTestData(conf)
+
+	cf := engine_util.CfDefault
+	_, err := server.RawPut(nil, &kvrpcpb.RawPutRequest{Key: []byte{1}, Value: []byte{233, 1}, Cf: cf})
+	assert.Nil(t, err)
+	assert.Nil(t, server.Close())
+
+	// The storage released its lock on DBPath, so it can be opened again.
+	s = standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	defer s.Stop()
+	val, err := Get(s, cf, []byte{1})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{233, 1}, val)
+}
+
+// slowReaderStorage blocks Reader until release is closed and records a Stop
+// that comes while a reader is being handed out.
+type slowReaderStorage struct {
+	*storage.MemStorage
+	entered, release chan struct{}
+	reading          atomic.Bool
+	stoppedEarly     atomic.Bool
+}
+
+func (s *slowReaderStorage) Reader(ctx *kvrpcpb.Context) (storage.StorageReader, error) {
+	s.reading.Store(true)
+	defer s.reading.Store(false)
+	s.entered <- struct{}{}
+	<-s.release
+	return s.MemStorage.Reader(ctx)
+}
+
+func (s *slowReaderStorage) Stop() error {
+	if s.reading.Load() {
+		s.stoppedEarly.Store(true)
+	}
+	return s.MemStorage.Stop()
+}
+
+func TestServerCloseInFlight1(t *testing.T) {
+	s := &slowReaderStorage{MemStorage: storage.NewMemStorage(), entered: make(chan struct{}), release: make(chan struct{})}
+	server := NewServer(s)
+	cf := engine_util.CfDefault
+
+	getDone := make(chan error, 1)
+	go func() {
+		_, err := server.RawGet(nil, &kvrpcpb.RawGetRequest{Key: []byte{1}, Cf: cf})
+		getDone <- err
+	}()
+	<-s.entered
+
+	closeDone := make(chan error, 1)
+	go func() { closeDone <- server.Close() }()
+	// new requests are turned away while Close waits for the RawGet
+	assert.Eventually(t, func() bool {
+		_, err := server.RawPut(nil, &kvrpcpb.RawPutRequest{Key: []byte{2}, Value: []byte{2}, Cf: cf})
+		return errors.Is(err, ErrServerClosed)
+	}, time.Second, time.Millisecond)
+	select {
+	case err := <-closeDone:
+		t.Fatalf("Close returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(s.release)
+	assert.Nil(t, <-getDone)
+	assert.Nil(t, <-closeDone)
+	assert.False(t, s.stoppedEarly.Load(), "storage stopped while a request was reading it")
+	assert.Equal(t, ErrServerClosed, server.Close())
+}
+
+func TestRawVersionScan1(t *testing.T) {
+	conf := config.NewTestConfig()
+	s := standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	server := NewServer(s)
+	defer cleanUpTestData(conf)
+	defer s.Stop()
+
+	cf := engine_util.CfDefault
+	// every put is committed by its own transaction and gets a newer version
+	for _, key := range []byte{1, 2, 3, 4} {
+		Set(s, cf, []byte{key}, []byte{233, key})
+	}
+	versions := make(map[byte]uint64)
+	it, err := Iter(s, cf)
+	assert.Nil(t, err)
+	for it.Seek(nil); it.Valid(); it.Next() {
+		versions[it.Item().Key()[0]] = it.Item().(versionedItem).Version()
+	}
+	it.Close()
+	assert.True(t, versions[1] < versions[2] && versions[2] < versions[3] && versions[3] < versions[4])
+
+	scan := func(min, max uint64, limit uint32) []*kvrpcpb.KvPair {
+		resp, err := server.RawVersionScan(nil, &RawVersionScanRequest{
+			RawScanRequest: &kvrpcpb.RawScanRequest{StartKey: []byte{1}, Limit: limit, Cf: cf},
+			MinVersion:     min,
+			MaxVersion:     max,
+		})
+		assert.Nil(t, err)
+		return resp.Kvs
+	}
+	assert.Equal(t, []*kvrpcpb.KvPair{
+		{Key: []byte{2}, Value: []byte{233, 2}},
+		{Key: []byte{3}, Value: []byte{233, 3}},
+	}, scan(versions[2], versions[3], 10))
+	assert.Equal(t, []*kvrpcpb.KvPair{
+		{Key: []byte{3}, Value: []byte{233, 3}},
+	}, scan(versions[3], 0, 1))
+
+	// rewriting a key moves it out of the old window
+	Set(s, cf, []byte{2}, []byte{42})
+	assert.Equal(t, []*kvrpcpb.KvPair{
+		{Key: []byte{3}, Value: []byte{233, 3}},
+	}, scan(versions[2], versions[3], 10))
+
+	mem := storage.NewMemStorage()
+	assert.Nil(t, mem.Write(nil, []storage.Modify{{Data: storage.Put{Cf: cf, Key: []byte{1}, Value: []byte{233, 1}}}}))
+	_, err = NewServer(mem).RawVersionScan(nil, &RawVersionScanRequest{
+		RawScanRequest: &kvrpcpb.RawScanRequest{Limit: 10, Cf: cf},
+	})
+	assert.Equal(t, ErrVersionUnsupported, err)
+}
+
+func TestRawScanCancel1(t *testing.T) {
+	conf := config.NewTestConfig()
+	s := standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	server := NewServer(s)
+	defer cleanUpTestData(conf)
+	defer s.Stop()
+
+	cf := engine_util.CfDefault
+	for i := byte(1); i <= 5; i++ {
+		Set(s, cf, []byte{i}, []byte{233, i})
+	}
+
+	// cancelling in the middle of a scan stops it at the next pair
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := s.Reader(nil)
+	assert.Nil(t, err)
+	defer reader.Close()
+	var keys [][]byte
+	err = scanCF(ctx, reader, cf, []byte{1}, 10, false, func(pair *kvrpcpb.KvPair) bool {
+		keys = append(keys, pair.Key)
+		if len(keys) == 2 {
+			cancel()
+		}
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, [][]byte{{1}, {2}}, keys)
+
+	_, err = server.RawScan(ctx, &kvrpcpb.RawScanRequest{StartKey: []byte{1}, Limit: 10, Cf: cf})
+	assert.Equal(t, context.Canceled, err)
+	_, err = server.RawBatchGet(ctx, &RawBatchGetRequest{Cf: cf, Keys: [][]byte{{1}}})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRawScanMaxScanLimit1(t *testing.T) {
+	conf := config.NewTestConfig()
+	conf.MaxScanLimit = 2
+	s := standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	server := NewServerWithConfig(s, conf)
+	defer cleanUpTestData(conf)
+	defer s.Stop()
+
+	cf := engine_util.CfDefault
+	for i := byte(1); i <= 3; i++ {
+		Set(s, cf, []byte{i}, []byte{233, i})
+	}
+
+	resp, err := server.RawScan(nil, &kvrpcpb.RawScanRequest{StartKey: []byte{1}, Limit: 2, Cf: cf})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.Error)
+	assert.Len(t, resp.Kvs, 2)
+
+	// every scan reports the limit in the response rather than failing the RPC
+	over := &kvrpcpb.RawScanRequest{StartKey: []byte{1}, Limit: 3, Cf: cf}
+	scans := []func() (*kvrpcpb.RawScanResponse, error){
+		func() (*kvrpcpb.RawScanResponse, error) { return server.RawScan(nil, over) },
+		func() (*kvrpcpb.RawScanResponse, error) {
+			return server.RawVersionScan(nil, &RawVersionScanRequest{RawScanRequest: over})
+		},
+		func() (*kvrpcpb.RawScanResponse, error) {
+			return server.RawRangeScan(nil, &RawRangeScanRequest{RawScanRequest: over, Reverse: true})
+		},
+	}
+	for _, scan := range scans {
+		resp, err = scan()
+		assert.Nil(t, err)
+		assert.Contains(t, resp.Error, ErrScanLimitExceeded.Error())
+		assert.Empty(t, resp.Kvs)
+	}
+}
+
+func TestRawScanOrderAcrossCFs1(t *testing.T) {
+	conf := config.NewTestConfig()
+	s := standalone_storage.NewStandAloneStorage(conf)
+	s.Start()
+	server := NewServer(s)
+	defer cleanUpTestData(conf)
+	defer s.Stop()
+
+	// every CF holds the keys of its own residue class, so the keys of the
+	// CFs interleave and a scan running past its CF would be noticed
+	cfs := []string{engine_util.CfDefault, engine_util.CfLock, engine_util.CfWrite}
+	for i := byte(1); i <= 30; i++ {
+		Set(s, cfs[i%3], []byte{i}, []byte{233, i})
+	}
+
+	for _, cf := range cfs {
+		// forward scans paginated two pairs at a time
+		var keys []byte
+		start := []byte{}
+		for {
+			resp, err := server.RawScan(nil, &kvrpcpb.RawScanRequest{StartKey: start, Limit: 2, Cf: cf})
+			assert.Nil(t, err)
+			if len(resp.Kvs) == 0 {
+				break
+			}
+			for _, kv := range resp.Kvs {
+				keys = append(keys, kv.Key[0])
+			}
+			start = append(resp.Kvs[len(resp.Kvs)-1].Key, 0)
+		}
+		assert.Equal(t, 10, len(keys), cf)
+		for i, key := range keys {
+			assert.Equal(t, cf, cfs[key%3], "%s: key %d", cf, key)
+			if i > 0 {
+				assert.Less(t, keys[i-1], key, cf)
+			}
+		}
+
+		// reverse scans paginated the same way
+		var rkeys []byte
+		rstart, exclusive := []byte(nil), false
+		for {
+			resp, err := server.RawRangeScan(nil, &RawRangeScanRequest{
+				RawScanRequest: &kvrpcpb.RawScanRequest{StartKey: rstart, Limit: 2, Cf: cf},
+				Reverse:        true,
+				StartExclusive: exclusive,
+			})
+			assert.Nil(t, err)
+			if len(resp.Kvs) == 0 {
+				break
+			}
+			for _, kv := range resp.Kvs {
+				assert.Equal(t, []byte{233, kv.Key[0]}, kv.Value, cf)
+				rkeys = append(rkeys, kv.Key[0])
+			}
+			rstart, exclusive = resp.Kvs[len(resp.Kvs)-1].Key, true
+		}
+		assert.Equal(t, 10, len(rkeys), cf)
+		for i := range rkeys {
+			assert.Equal(t, keys[len(keys)-1-i], rkeys[i], cf)
+		}
+	}
+}
+
+// reversedStorage hands out iterators whose keys run backwards, as a broken
+// storage engine would.
+type reversedStorage struct {
+	*storage.MemStorage
+}
+
+func (s *reversedStorage) Reader(ctx *kvrpcpb.Context) (storage.StorageReader, error) {
+	reader, err := s.MemStorage.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &reversedReader{StorageReader: reader}, nil
+}
+
+type reversedReader struct {
+	storage.StorageReader
+}
+
+func (r *reversedReader) IterCF(cf string) engine_util.DBIterator {
+	return &reversedIter{DBIterator: r.StorageReader.IterCF(cf)}
+}
+
+type reversedIter struct {
+	engine_util.DBIterator
+}
+
+func (it *reversedIter) Item() engine_util.DBItem {
+	return &reversedItem{DBItem: it.DBIterator.Item()}
+}
+
+type reversedItem struct {
+	engine_util.DBItem
+}
+
+func (i *reversedItem) KeyCopy(dst []byte) []byte {
+	return []byte{255 - i.DBItem.Key()[0]}
+}
+
+func TestRawScanOutOfOrder1(t *testing.T) {
+	s := &reversedStorage{MemStorage: storage.NewMemStorage()}
+	server := NewServer(s)
+
+	cf := engine_util.CfDefault
+	for i := byte(1); i <= 3; i++ {
+		_, err := server.RawPut(nil, &kvrpcpb.RawPutRequest{Key: []byte{i}, Value: []byte{233, i}, Cf: cf})
+		assert.Nil(t, err)
+	}
+
+	_, err := server.RawScan(nil, &kvrpcpb.RawScanRequest{StartKey: []byte{1}, Limit: 3, Cf: cf})
+	assert.True(t, errors.Is(err, ErrScanOutOfOrder), "%v", err)
+	// a single pair has nothing to be out of order with
+	resp, err := server.RawScan(nil, &kvrpcpb.RawScanRequest{StartKey: []byte{1}, Limit: 1, Cf: cf})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+}
+
+// stubReaderStorage hands out readers through reader instead of the MemStorage.
+type stubReaderStorage struct {
+	*storage.MemStorage
+	reader func() (storage.StorageReader, error)
+}
+
+func (s *stubReaderStorage) Reader(ctx *kvrpcpb.Context) (storage.StorageReader, error) {
+	return s.reader()
+}
+
+func TestHealth1(t *testing.T) {
+	server := NewServer(storage.NewMemStorage())
+	assert.Equal(t, HealthStatusHealthy, server.Health(nil, nil))
+
+	s := &stubReaderStorage{MemStorage: storage.NewMemStorage()}
+	conf := config.NewTestConfig()
+	conf.HealthCheckTimeout = 20 * time.Millisecond
+	server = NewServerWithConfig(s, conf)
+	s.reader = func() (storage.StorageReader, error) {
+		return nil, &raft_storage.RegionError{RequestErr: &errorpb.Error{NotLeader: &errorpb.NotLeader{RegionId: 1}}}
+	}
+	assert.Equal(t, HealthStatusFollower, server.Health(nil, &kvrpcpb.Context{RegionId: 1}))
+
+	s.reader = func() (storage.StorageReader, error) {
+		return nil, errors.New("engine closed")
+	}
+	assert.Equal(t, HealthStatusUnavailable, server.Health(nil, nil))
+
+	// a reader that takes longer than HealthCheckTimeout counts as unavailable
+	release := make(chan struct{})
+	s.reader = func() (storage.StorageReader, error) {
+		<-release
+		return s.MemStorage.Reader(nil)
+	}
+	start := time.Now()
+	status := server.Health(nil, nil)
+	elapsed := time.Since(start)
+	close(release)
+	assert.Equal(t, HealthStatusUnavailable, status)
+	assert.GreaterOrEqual(t, elapsed, conf.HealthCheckTimeout)
+	assert.Less(t, elapsed, config.DefaultHealthCheckTimeout)
+	assert.Equal(t, "UNAVAILABLE", status.String())
+
+	// a closing server is unavailable without asking the storage
+	s.reader = func() (storage.StorageReader, error) {
+		t.Fatal("Reader called on a closed server")
+		return nil, nil
+	}
+	server.Close()
+	assert.Equal(t, HealthStatusUnavailable, server.Health(nil, nil))
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/Connor1996/badger/y"
 	"github.com/petar/GoLLRB/llrb"
 	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
 )
 
@@ -16,6 +17,7 @@ type MemStorage struct {
 	CfDefault *llrb.LLRB
 	CfLock    *llrb.LLRB
 	CfWrite   *llrb.LLRB
+	HardState eraftpb.HardState
 }
 
 func NewMemStorage() *MemStorage {
@@ -34,33 +36,40 @@ func (s *MemStorage) Stop() error {
 	return nil
 }
 
+func (s *MemStorage) SaveHardState(hs eraftpb.HardState) error {
+	s.HardState = hs
+	return nil
+}
+
 func (s *MemStorage) Reader(ctx *kvrpcpb.Context) (StorageReader, error) {
 	return &memReader{s, 0}, nil
 }
 
+func (s *MemStorage) ReaderWithOptions(ctx *kvrpcpb.Context, opts ReadOptions) (StorageReader, error) {
+	reader, err := s.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return FilterCF(reader, opts.Cf), nil
+}
+
 func (s *MemStorage) Write(ctx *kvrpcpb.Context, batch []Modify) error {
 	for _, m := range batch {
-		switch data := m.Data.(type) {
-		case Put:
-			item := memItem{data.Key, data.Value, false}
-			switch data.Cf {
-			case engine_util.CfDefault:
-				s.CfDefault.ReplaceOrInsert(item)
-			case engine_util.CfLock:
-				s.CfLock.ReplaceOrInsert(item)
-			case engine_util.CfWrite:
-				s.CfWrite.ReplaceOrInsert(item)
-			}
-		case Delete:
-			item := memItem{key: data.Key}
-			switch data.Cf {
-			case engine_util.CfDefault:
-				s.CfDefault.Delete(item)
-			case engine_util.CfLock:
-				s.CfLock.Delete(item)
-			case engine_util.CfWrite:
-				s.CfWrite.Delete(item)
-			}
+		var tree *llrb.LLRB
+		switch m.CF() {
+		case engine_util.CfDefault:
+			tree = s.CfDefault
+		case engine_util.CfLock:
+			tree = s.CfLock
+		case engine_util.CfWrite:
+			tree = s.CfWrite
+		default:
+			continue
+		}
+		if m.IsDelete() {
+			tree.Delete(memItem{key: m.Key()})
+		} else {
+			tree.ReplaceOrInsert(memItem{m.Key(), m.Value(), false})
 		}
 	}
 
@@ -172,9 +181,9 @@ func (mr *memReader) IterCF(cf string) engine_util.DBIterator {
 	mr.iterCount += 1
 	min := data.Min()
 	if min == nil {
-		return &memIter{data, memItem{}, mr}
+		return &memIter{data: data, reader: mr}
 	}
-	return &memIter{data, min.(memItem), mr}
+	return &memIter{data: data, item: min.(memItem), reader: mr}
 }
 
 func (r *memReader) Close() {
@@ -187,6 +196,8 @@ type memIter struct {
 	data   *llrb.LLRB
 	item   memItem
 	reader *memReader
+	// seekKey is the key of the last Seek, nil sorts before every key.
+	seekKey []byte
 }
 
 func (it *memIter) Item() engine_util.DBItem {
@@ -211,6 +222,7 @@ func (it *memIter) Next() {
 	})
 }
 func (it *memIter) Seek(key []byte) {
+	it.seekKey = key
 	it.item = memItem{}
 	it.data.AscendGreaterOrEqual(memItem{key: key}, func(item llrb.Item) bool {
 		it.item = item.(memItem)
@@ -219,6 +231,10 @@ func (it *memIter) Seek(key []byte) {
 	})
 }
 
+func (it *memIter) Rewind() {
+	it.Seek(it.seekKey)
+}
+
 func (it *memIter) Close() {
 	it.reader.iterCount -= 1
 }
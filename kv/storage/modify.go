@@ -1,5 +1,7 @@
 package storage
 
+import "fmt"
+
 // Modify is a single modification to TinyKV's underlying storage.
 type Modify struct {
 	Data interface{}
@@ -16,14 +18,22 @@ type Delete struct {
 	Cf  string
 }
 
+// Key returns the key of the modification, it panics if Data is neither a Put
+// nor a Delete.
 func (m *Modify) Key() []byte {
-	switch m.Data.(type) {
+	switch data := m.Data.(type) {
 	case Put:
-		return m.Data.(Put).Key
+		return data.Key
 	case Delete:
-		return m.Data.(Delete).Key
+		return data.Key
 	}
-	return nil
+	panic(fmt.Sprintf("unknown modify type %T", m.Data))
+}
+
+// IsDelete reports whether the modification is a Delete rather than a Put.
+func (m *Modify) IsDelete() bool {
+	_, ok := m.Data.(Delete)
+	return ok
 }
 
 func (m *Modify) Value() []byte {
@@ -34,12 +44,14 @@ func (m *Modify) Value() []byte {
 	return nil
 }
 
-func (m *Modify) Cf() string {
-	switch m.Data.(type) {
+// CF returns the column family of the modification, it panics if Data is
+// neither a Put nor a Delete.
+func (m *Modify) CF() string {
+	switch data := m.Data.(type) {
 	case Put:
-		return m.Data.(Put).Cf
+		return data.Cf
 	case Delete:
-		return m.Data.(Delete).Cf
+		return data.Cf
 	}
-	return ""
+	panic(fmt.Sprintf("unknown modify type %T", m.Data))
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/pingcap-incubator/tinykv/kv/storage"
 	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
 	"github.com/pingcap-incubator/tinykv/kv/util/worker"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/errorpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/raft_cmdpb"
@@ -78,23 +79,20 @@ func NewRaftStorage(conf *config.Config) *RaftStorage {
 func (rs *RaftStorage) Write(ctx *kvrpcpb.Context, batch []storage.Modify) error {
 	var reqs []*raft_cmdpb.Request
 	for _, m := range batch {
-		switch m.Data.(type) {
-		case storage.Put:
-			put := m.Data.(storage.Put)
-			reqs = append(reqs, &raft_cmdpb.Request{
-				CmdType: raft_cmdpb.CmdType_Put,
-				Put: &raft_cmdpb.PutRequest{
-					Cf:    put.Cf,
-					Key:   put.Key,
-					Value: put.Value,
-				}})
-		case storage.Delete:
-			delete := m.Data.(storage.Delete)
+		if m.IsDelete() {
 			reqs = append(reqs, &raft_cmdpb.Request{
 				CmdType: raft_cmdpb.CmdType_Delete,
 				Delete: &raft_cmdpb.DeleteRequest{
-					Cf:  delete.Cf,
-					Key: delete.Key,
+					Cf:  m.CF(),
+					Key: m.Key(),
+				}})
+		} else {
+			reqs = append(reqs, &raft_cmdpb.Request{
+				CmdType: raft_cmdpb.CmdType_Put,
+				Put: &raft_cmdpb.PutRequest{
+					Cf:    m.CF(),
+					Key:   m.Key(),
+					Value: m.Value(),
 				}})
 		}
 	}
@@ -149,6 +147,21 @@ func (rs *RaftStorage) Reader(ctx *kvrpcpb.Context) (storage.StorageReader, erro
 	return NewRegionReader(cb.Txn, *resp.Responses[0].GetSnap().Region), nil
 }
 
+// ReaderWithOptions serves the read from the latest region snapshot restricted to opts.Cf.
+func (rs *RaftStorage) ReaderWithOptions(ctx *kvrpcpb.Context, opts storage.ReadOptions) (storage.StorageReader, error) {
+	reader, err := rs.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return storage.FilterCF(reader, opts.Cf), nil
+}
+
+// SaveHardState is not supported, every region persists its own hard state in the raftstore
+// as part of handling its Ready.
+func (rs *RaftStorage) SaveHardState(hs eraftpb.HardState) error {
+	return errors.New("hard state is persisted per region by the raftstore")
+}
+
 func (rs *RaftStorage) Raft(stream tinykvpb.TinyKv_RaftServer) error {
 	for {
 		msg, err := stream.Recv()
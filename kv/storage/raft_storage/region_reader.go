@@ -43,12 +43,15 @@ func (r *RegionReader) Close() {
 type RegionIterator struct {
 	iter   *engine_util.BadgerIterator
 	region *metapb.Region
+	// seekKey is the key of the last Seek, the region start before any.
+	seekKey []byte
 }
 
 func NewRegionIterator(iter *engine_util.BadgerIterator, region *metapb.Region) *RegionIterator {
 	return &RegionIterator{
-		iter:   iter,
-		region: region,
+		iter:    iter,
+		region:  region,
+		seekKey: region.StartKey,
 	}
 }
 
@@ -82,9 +85,10 @@ func (it *RegionIterator) Seek(key []byte) {
 	if err := util.CheckKeyInRegion(key, it.region); err != nil {
 		panic(err)
 	}
+	it.seekKey = key
 	it.iter.Seek(key)
 }
 
 func (it *RegionIterator) Rewind() {
-	it.iter.Rewind()
+	it.iter.Seek(it.seekKey)
 }
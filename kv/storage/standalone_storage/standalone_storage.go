@@ -1,28 +1,72 @@
 package standalone_storage
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+
 	"github.com/Connor1996/badger"
 	"github.com/pingcap-incubator/tinykv/kv/config"
 	"github.com/pingcap-incubator/tinykv/kv/storage"
 	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // StandAloneStorage is an implementation of `Storage` for a single-node TinyKV instance. It does not
 // communicate with other nodes and all data is stored locally.
 type StandAloneStorage struct {
 	// Your Data Here (1).
-	engines *engine_util.Engines
-	conf    *config.Config
+	engines  *engine_util.Engines
+	conf     *config.Config
+	readOnly bool
+	// ns is the encoded namespace of a view, it is prepended to the CF name of
+	// every key written or read through this storage, see WithPrefix.
+	ns string
+
+	// shared by all the views created by WithPrefix.
+	*stopState
+}
+
+type stopState struct {
+	// mu guards stopped, Stop takes it exclusively so that it waits for
+	// the gets, writes and iterator steps in progress and fails the later
+	// ones, see stopIterator.
+	mu      sync.RWMutex
+	stopped bool
 }
 
+// ErrReadOnly is returned when writing to a StandAloneStorage opened read-only.
+var ErrReadOnly = errors.New("standalone storage is opened read-only")
+
+// ErrStopped is returned when using a StandAloneStorage after Stop.
+var ErrStopped = errors.New("standalone storage is stopped")
+
+// maxListKeys is the most keys ListKeys returns, it is meant for small CFs.
+const maxListKeys = 10000
+
+// ErrTooManyKeys is returned by ListKeys when the CF holds more than maxListKeys keys.
+var ErrTooManyKeys = errors.New("too many keys to list")
+
+// hardStateKey is the raft engine key the raft hard state is saved under.
+var hardStateKey = []byte("hard_state")
+
 type StandAloneStorageReader struct {
-	txn *badger.Txn
+	txn     *badger.Txn
+	storage *StandAloneStorage
 }
 
 // GetCF 从指定的列族（Column Family）中获取给定键的值。
 func (s *StandAloneStorageReader) GetCF(cf string, key []byte) ([]byte, error) {
-	data, err := engine_util.GetCFFromTxn(s.txn, cf, key)
+	s.storage.mu.RLock()
+	defer s.storage.mu.RUnlock()
+	if s.storage.stopped {
+		return nil, ErrStopped
+	}
+	data, err := engine_util.GetCFFromTxn(s.txn, s.storage.cf(cf), key)
 	if err == badger.ErrKeyNotFound {
 		return nil, nil
 	}
@@ -31,11 +75,142 @@ func (s *StandAloneStorageReader) GetCF(cf string, key []byte) ([]byte, error) {
 
 // IterCF 返回一个迭代器，用于遍历指定列族中的所有键值对。
 func (s *StandAloneStorageReader) IterCF(cf string) engine_util.DBIterator {
-	return engine_util.NewCFIterator(cf, s.txn)
+	iter := engine_util.NewCFIterator(s.storage.cf(cf), s.txn)
+	return &stopIterator{DBIterator: iter, state: s.storage.stopState}
+}
+
+// stopIterator 在每一步操作时检查存储是否已经Stop, Stop之后Valid返回false, Err返回ErrStopped,
+// 其余操作不再访问已关闭的引擎。Stop之前取得的Key和Value切片在Stop之后不能再使用。
+type stopIterator struct {
+	engine_util.DBIterator
+	state *stopState
+}
+
+func (it *stopIterator) Err() error {
+	it.state.mu.RLock()
+	defer it.state.mu.RUnlock()
+	if it.state.stopped {
+		return ErrStopped
+	}
+	return nil
+}
+
+func (it *stopIterator) Valid() bool {
+	it.state.mu.RLock()
+	defer it.state.mu.RUnlock()
+	return !it.state.stopped && it.DBIterator.Valid()
+}
+
+func (it *stopIterator) Item() engine_util.DBItem {
+	it.state.mu.RLock()
+	defer it.state.mu.RUnlock()
+	if it.state.stopped {
+		return stopItem{state: it.state}
+	}
+	return stopItem{DBItem: it.DBIterator.Item(), state: it.state}
+}
+
+func (it *stopIterator) Next() {
+	it.state.mu.RLock()
+	defer it.state.mu.RUnlock()
+	if !it.state.stopped {
+		it.DBIterator.Next()
+	}
+}
+
+func (it *stopIterator) Seek(key []byte) {
+	it.state.mu.RLock()
+	defer it.state.mu.RUnlock()
+	if !it.state.stopped {
+		it.DBIterator.Seek(key)
+	}
+}
+
+func (it *stopIterator) Rewind() {
+	it.state.mu.RLock()
+	defer it.state.mu.RUnlock()
+	if !it.state.stopped {
+		it.DBIterator.Rewind()
+	}
+}
+
+// Close 在Stop之后什么也不做, 迭代器持有的资源已经随引擎一起释放。
+func (it *stopIterator) Close() {
+	it.state.mu.RLock()
+	defer it.state.mu.RUnlock()
+	if !it.state.stopped {
+		it.DBIterator.Close()
+	}
+}
+
+// stopItem 是stopIterator返回的item, Stop之后Key返回nil, 读取value返回ErrStopped。
+type stopItem struct {
+	engine_util.DBItem
+	state *stopState
+}
+
+func (i stopItem) Key() []byte {
+	i.state.mu.RLock()
+	defer i.state.mu.RUnlock()
+	if i.state.stopped {
+		return nil
+	}
+	return i.DBItem.Key()
+}
+
+func (i stopItem) KeyCopy(dst []byte) []byte {
+	i.state.mu.RLock()
+	defer i.state.mu.RUnlock()
+	if i.state.stopped {
+		return nil
+	}
+	return i.DBItem.KeyCopy(dst)
+}
+
+func (i stopItem) Value() ([]byte, error) {
+	i.state.mu.RLock()
+	defer i.state.mu.RUnlock()
+	if i.state.stopped {
+		return nil, ErrStopped
+	}
+	return i.DBItem.Value()
+}
+
+// Version 返回写入时的版本, Stop之后返回0。
+func (i stopItem) Version() uint64 {
+	i.state.mu.RLock()
+	defer i.state.mu.RUnlock()
+	if i.state.stopped {
+		return 0
+	}
+	return i.DBItem.(interface{ Version() uint64 }).Version()
+}
+
+func (i stopItem) ValueSize() int {
+	i.state.mu.RLock()
+	defer i.state.mu.RUnlock()
+	if i.state.stopped {
+		return 0
+	}
+	return i.DBItem.ValueSize()
 }
 
+func (i stopItem) ValueCopy(dst []byte) ([]byte, error) {
+	i.state.mu.RLock()
+	defer i.state.mu.RUnlock()
+	if i.state.stopped {
+		return nil, ErrStopped
+	}
+	return i.DBItem.ValueCopy(dst)
+}
+
+// Close 释放事务相关的资源, Stop之后事务已经随引擎一起释放, 什么也不做。
 func (s *StandAloneStorageReader) Close() {
-	s.txn.Discard() //释放事务相关的资源
+	s.storage.mu.RLock()
+	defer s.storage.mu.RUnlock()
+	if !s.storage.stopped {
+		s.txn.Discard()
+	}
 }
 
 func NewStandAloneStorage(conf *config.Config) *StandAloneStorage {
@@ -46,43 +221,188 @@ func NewStandAloneStorage(conf *config.Config) *StandAloneStorage {
 	raftEngine := engine_util.CreateDB(raftPath, true)
 	engines := engine_util.NewEngines(kvEngine, raftEngine, kvPath, raftPath)
 	return &StandAloneStorage{
-		conf:    conf,
-		engines: engines,
+		conf:      conf,
+		engines:   engines,
+		stopState: new(stopState),
 	}
 }
 
+// NewReadOnlyStandAloneStorage 以只读方式打开已有的数据目录, 所有写操作都会返回ErrReadOnly。
+// badger只读打开需要目录的共享锁, 与写者的独占锁冲突, 因此目录必须已经被关闭, 仍被其他存储或进程打开时会返回错误。
+func NewReadOnlyStandAloneStorage(conf *config.Config) (*StandAloneStorage, error) {
+	kvPath := conf.DBPath + "/kv"
+	raftPath := conf.DBPath + "/raft"
+	kvEngine, err := engine_util.OpenDBReadOnly(kvPath)
+	if err != nil {
+		return nil, err
+	}
+	raftEngine, err := engine_util.OpenDBReadOnly(raftPath)
+	if err != nil {
+		kvEngine.Close()
+		return nil, err
+	}
+	return &StandAloneStorage{
+		conf:      conf,
+		engines:   engine_util.NewEngines(kvEngine, raftEngine, kvPath, raftPath),
+		readOnly:  true,
+		stopState: new(stopState),
+	}, nil
+}
+
+// WithPrefix 返回共享同一个badger DB的视图, 视图读写的每个key都放在prefix对应的命名空间中,
+// 前缀不同的视图之间、视图和根存储之间都互不可见, 即使一个前缀是另一个的前缀。在已有前缀的存储上调用时命名空间会嵌套。
+// 视图之间共享引擎, 任一视图Stop后所有视图都会停止。
+func (s *StandAloneStorage) WithPrefix(prefix []byte) *StandAloneStorage {
+	view := *s
+	view.ns = s.ns + nsComponent(prefix)
+	return &view
+}
+
+// nsComponent 将prefix编码为命名空间的一段: 0x00, prefix的长度(uvarint), prefix。
+// 列族名不以0x00开头, 所以解码时读到0x00就是下一段命名空间, 否则就是列族名,
+// 编码因此没有歧义: 根存储的key以列族名开头, 不会落在任何视图的命名空间中, 长度不同的前缀也不会互相包含。
+func nsComponent(prefix []byte) string {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(prefix))
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(prefix)))
+	return string(append(buf[:n], prefix...))
+}
+
+// cf 返回视图中列族cf实际使用的列族名。
+func (s *StandAloneStorage) cf(cf string) string {
+	return s.ns + cf
+}
+
+// prefixed 返回raft引擎中加上视图命名空间后的key。
+func (s *StandAloneStorage) prefixed(key []byte) []byte {
+	return append([]byte(s.ns), key...)
+}
+
+// Start 不需要启动value log GC: 使用的badger版本没有RunValueLogGC, 过期value占用的blob文件
+// 由badger自己的后台协程根据compaction产生的discard统计回收。
 func (s *StandAloneStorage) Start() error {
 	// Your Code Here (1).
 	return nil
 }
 
+// Stop 关闭存储引擎, 重复调用不会出错。
 func (s *StandAloneStorage) Stop() error {
 	// Your Code Here (1).
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
 	return s.engines.Close()
 }
 
+// TruncateCF 删除指定列族中的所有键, 其他列族不受影响。视图只删除自己命名空间中的键。
+// 删除分批提交, 列族再大也不会放进一个事务, 但删除不是原子的
+func (s *StandAloneStorage) TruncateCF(cf string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	return engine_util.TruncateRangeCF(s.engines.Kv, s.cf(cf), nil, nil)
+}
+
+// SaveHardState 将raft的HardState写入raft引擎。
+func (s *StandAloneStorage) SaveHardState(hs eraftpb.HardState) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	return engine_util.PutMeta(s.engines.Raft, s.prefixed(hardStateKey), &hs)
+}
+
 func (s *StandAloneStorage) Reader(ctx *kvrpcpb.Context) (storage.StorageReader, error) {
 	// Your Code Here (1).
-	return &StandAloneStorageReader{
-		txn: s.engines.Kv.NewTransaction(false),
-	}, nil
+	return s.ReaderWithOptions(ctx, storage.ReadOptions{})
+}
+
+// ReaderWithOptions 创建受限于单个列族、并可固定在指定版本上的reader。
+func (s *StandAloneStorage) ReaderWithOptions(ctx *kvrpcpb.Context, opts storage.ReadOptions) (storage.StorageReader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stopped {
+		return nil, ErrStopped
+	}
+	txn := s.engines.Kv.NewTransaction(false)
+	return storage.FilterCF(&StandAloneStorageReader{txn: txn, storage: s}, opts.Cf), nil
+}
+
+// ListKeys 按顺序返回列族中的所有key, 用于调试和测试。key超过maxListKeys时返回ErrTooManyKeys。
+func (s *StandAloneStorage) ListKeys(cf string) ([][]byte, error) {
+	reader, err := s.Reader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	iter := reader.IterCF(cf)
+	defer iter.Close()
+	var keys [][]byte
+	for iter.Seek(nil); iter.Valid(); iter.Next() {
+		if len(keys) == maxListKeys {
+			return nil, ErrTooManyKeys
+		}
+		keys = append(keys, iter.Item().KeyCopy(nil))
+	}
+	return keys, nil
 }
 
+// Write 是WriteContext的兼容版本, 不会因超时或取消而放弃写入。
 func (s *StandAloneStorage) Write(ctx *kvrpcpb.Context, batch []storage.Modify) error {
 	// Your Code Here (1).
+	return s.WriteContext(context.Background(), batch)
+}
+
+// WriteContext 在一个badger事务中写入batch。ctx在提交之前过期时事务被丢弃, 返回codes.DeadlineExceeded
+// 或codes.Canceled的gRPC status, 写入不会生效; 返回nil时写入已经提交。ctx只在写入batch的过程中和提交前检查,
+// 已经开始的Commit不会被打断。
+func (s *StandAloneStorage) WriteContext(ctx context.Context, batch []storage.Modify) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	txn := s.engines.Kv.NewTransaction(true)
+	defer txn.Discard()
 	for _, modify := range batch {
-		switch data := modify.Data.(type) {
-		case storage.Put:
-			err := engine_util.PutCF(s.engines.Kv, data.Cf, data.Key, data.Value)
-			if err != nil {
-				return err
-			}
-		case storage.Delete:
-			err := engine_util.DeleteCF(s.engines.Kv, data.Cf, data.Key)
-			if err != nil {
-				return err
-			}
+		if err := ctx.Err(); err != nil {
+			return ctxStatus(err)
+		}
+		key := engine_util.KeyWithCF(s.cf(modify.CF()), modify.Key())
+		var err error
+		if modify.IsDelete() {
+			err = txn.Delete(key)
+		} else {
+			err = txn.Set(key, modify.Value())
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+	if err := ctx.Err(); err != nil {
+		return ctxStatus(err)
+	}
+	return txn.Commit()
+}
+
+// ctxStatus 将context的错误转换为对应的gRPC status。
+func ctxStatus(err error) error {
+	if err == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Canceled, err.Error())
 }
@@ -0,0 +1,429 @@
+package standalone_storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap-incubator/tinykv/kv/config"
+	"github.com/pingcap-incubator/tinykv/kv/storage"
+	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+	"github.com/pingcap-incubator/tinykv/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestStorage(t *testing.T) (*StandAloneStorage, func()) {
+	dir, err := ioutil.TempDir("", "standalone_storage")
+	require.Nil(t, err)
+	conf := config.NewTestConfig()
+	conf.DBPath = dir
+	s := NewStandAloneStorage(conf)
+	require.Nil(t, s.Start())
+	return s, func() {
+		s.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func put(t *testing.T, s *StandAloneStorage, cf string, key, value []byte) {
+	err := s.Write(nil, []storage.Modify{{Data: storage.Put{Cf: cf, Key: key, Value: value}}})
+	require.Nil(t, err)
+}
+
+func TestReaderWithOptions(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	put(t, s, engine_util.CfDefault, []byte("k"), []byte("v1"))
+	put(t, s, engine_util.CfLock, []byte("k"), []byte("l1"))
+
+	reader, err := s.ReaderWithOptions(nil, storage.ReadOptions{Cf: engine_util.CfDefault})
+	require.Nil(t, err)
+	val, err := reader.GetCF(engine_util.CfDefault, []byte("k"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), val)
+	_, err = reader.GetCF(engine_util.CfLock, []byte("k"))
+	require.NotNil(t, err)
+	iter := reader.IterCF(engine_util.CfLock)
+	iter.Seek([]byte("k"))
+	require.False(t, iter.Valid())
+	require.NotNil(t, engine_util.IterErr(iter))
+	iter.Close()
+	reader.Close()
+
+	reader, err = s.ReaderWithOptions(nil, storage.ReadOptions{})
+	require.Nil(t, err)
+	val, err = reader.GetCF(engine_util.CfDefault, []byte("k"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), val)
+	val, err = reader.GetCF(engine_util.CfLock, []byte("k"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("l1"), val)
+	reader.Close()
+}
+
+func TestTruncateCF(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	for _, cf := range engine_util.CFs {
+		put(t, s, cf, []byte("a"), []byte(cf+"1"))
+		put(t, s, cf, []byte("b"), []byte(cf+"2"))
+	}
+	require.Nil(t, s.TruncateCF(engine_util.CfLock))
+
+	reader, err := s.Reader(nil)
+	require.Nil(t, err)
+	defer reader.Close()
+	iter := reader.IterCF(engine_util.CfLock)
+	iter.Seek(nil)
+	require.False(t, iter.Valid())
+	iter.Close()
+	for _, cf := range []string{engine_util.CfDefault, engine_util.CfWrite} {
+		val, err := reader.GetCF(cf, []byte("a"))
+		require.Nil(t, err)
+		require.Equal(t, []byte(cf+"1"), val)
+		val, err = reader.GetCF(cf, []byte("b"))
+		require.Nil(t, err)
+		require.Equal(t, []byte(cf+"2"), val)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standalone_storage")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := config.NewTestConfig()
+	conf.DBPath = dir
+
+	s := NewStandAloneStorage(conf)
+	require.Nil(t, s.Start())
+	put(t, s, engine_util.CfDefault, []byte("a"), []byte("v1"))
+	put(t, s, engine_util.CfDefault, []byte("b"), []byte("v2"))
+	// 写者仍持有目录时只读打开会失败
+	_, err = NewReadOnlyStandAloneStorage(conf)
+	require.NotNil(t, err)
+	require.Nil(t, s.Stop())
+
+	ro, err := NewReadOnlyStandAloneStorage(conf)
+	require.Nil(t, err)
+	defer ro.Stop()
+
+	reader, err := ro.Reader(nil)
+	require.Nil(t, err)
+	val, err := reader.GetCF(engine_util.CfDefault, []byte("a"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), val)
+	iter := reader.IterCF(engine_util.CfDefault)
+	var keys []string
+	for iter.Seek(nil); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Item().Key()))
+	}
+	iter.Close()
+	reader.Close()
+	require.Equal(t, []string{"a", "b"}, keys)
+
+	err = ro.Write(nil, []storage.Modify{{Data: storage.Put{Cf: engine_util.CfDefault, Key: []byte("c"), Value: []byte("v3")}}})
+	require.Equal(t, ErrReadOnly, err)
+	err = ro.Write(nil, []storage.Modify{{Data: storage.Delete{Cf: engine_util.CfDefault, Key: []byte("a")}}})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, ro.TruncateCF(engine_util.CfDefault))
+}
+
+func TestConcurrentStop(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := []byte{byte(i)}
+			for {
+				err := s.Write(nil, []storage.Modify{{Data: storage.Put{Cf: engine_util.CfDefault, Key: key, Value: key}}})
+				if err == nil {
+					var reader storage.StorageReader
+					reader, err = s.Reader(nil)
+					if err == nil {
+						_, err = reader.GetCF(engine_util.CfDefault, key)
+						reader.Close()
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.Nil(t, s.Stop())
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Equal(t, ErrStopped, err)
+	}
+	require.Nil(t, s.Stop())
+}
+
+func TestIterAfterStop(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+	put(t, s, engine_util.CfDefault, []byte("a"), []byte("v1"))
+	put(t, s, engine_util.CfDefault, []byte("b"), []byte("v2"))
+
+	put(t, s.WithPrefix([]byte("p")), engine_util.CfDefault, []byte("a"), []byte("v1"))
+	reader, err := s.Reader(nil)
+	require.Nil(t, err)
+	iter := reader.IterCF(engine_util.CfDefault)
+	iter.Seek(nil)
+	require.True(t, iter.Valid())
+	item := iter.Item()
+	prefixReader, err := s.WithPrefix([]byte("p")).Reader(nil)
+	require.Nil(t, err)
+	prefixIter := prefixReader.IterCF(engine_util.CfDefault)
+	prefixIter.Seek(nil)
+	require.True(t, prefixIter.Valid())
+	require.Nil(t, engine_util.IterErr(iter))
+
+	require.Nil(t, s.Stop())
+	// 迭代器和已经取得的item都不能再访问已关闭的引擎
+	for _, it := range []engine_util.DBIterator{iter, prefixIter} {
+		require.False(t, it.Valid())
+		require.Equal(t, ErrStopped, engine_util.IterErr(it))
+		it.Next()
+		it.Seek([]byte("b"))
+		it.Rewind()
+		require.False(t, it.Valid())
+		_, err = it.Item().Value()
+		require.Equal(t, ErrStopped, err)
+		it.Close()
+	}
+	require.Nil(t, item.Key())
+	_, err = item.ValueCopy(nil)
+	require.Equal(t, ErrStopped, err)
+	reader.Close()
+	prefixReader.Close()
+}
+
+func TestWriteContext(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	batch := []storage.Modify{
+		{Data: storage.Put{Cf: engine_util.CfDefault, Key: []byte("a"), Value: []byte("1")}},
+		{Data: storage.Put{Cf: engine_util.CfDefault, Key: []byte("b"), Value: []byte("2")}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.WriteContext(ctx, batch)
+	require.Equal(t, codes.Canceled, status.Code(err))
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err = s.WriteContext(ctx, batch)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// the discarded batches wrote nothing
+	reader, err := s.Reader(nil)
+	require.Nil(t, err)
+	val, err := reader.GetCF(engine_util.CfDefault, []byte("a"))
+	require.Nil(t, err)
+	require.Nil(t, val)
+	reader.Close()
+
+	require.Nil(t, s.WriteContext(context.Background(), batch))
+	reader, err = s.Reader(nil)
+	require.Nil(t, err)
+	defer reader.Close()
+	for _, m := range batch {
+		val, err := reader.GetCF(m.CF(), m.Key())
+		require.Nil(t, err)
+		require.Equal(t, m.Value(), val)
+	}
+}
+
+func TestWriteContextCancelRace(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("k%d", i))
+		ctx, cancel := context.WithCancel(context.Background())
+		go cancel()
+		err := s.WriteContext(ctx, []storage.Modify{{Data: storage.Put{Cf: engine_util.CfDefault, Key: key, Value: key}}})
+
+		// a write reported as canceled never lands, a successful one always does
+		reader, rerr := s.Reader(nil)
+		require.Nil(t, rerr)
+		val, rerr := reader.GetCF(engine_util.CfDefault, key)
+		require.Nil(t, rerr)
+		reader.Close()
+		if err != nil {
+			require.Equal(t, codes.Canceled, status.Code(err))
+			require.Nil(t, val)
+		} else {
+			require.Equal(t, key, val)
+		}
+	}
+}
+
+func scanCF(t *testing.T, view *StandAloneStorage, cf string) map[string]string {
+	reader, err := view.Reader(nil)
+	require.Nil(t, err)
+	defer reader.Close()
+	kvs := make(map[string]string)
+	iter := reader.IterCF(cf)
+	defer iter.Close()
+	for iter.Seek(nil); iter.Valid(); iter.Next() {
+		val, err := iter.Item().Value()
+		require.Nil(t, err)
+		kvs[string(iter.Item().Key())] = string(val)
+	}
+	return kvs
+}
+
+func TestPrefixIsolation(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+	r1, r2 := s.WithPrefix([]byte("r1/")), s.WithPrefix([]byte("r2/"))
+
+	put(t, r1, engine_util.CfDefault, []byte("a"), []byte("1a"))
+	put(t, r1, engine_util.CfDefault, []byte("b"), []byte("1b"))
+	put(t, r2, engine_util.CfDefault, []byte("a"), []byte("2a"))
+	put(t, r2, engine_util.CfLock, []byte("c"), []byte("2c"))
+
+	scan := func(view *StandAloneStorage, cf string) map[string]string { return scanCF(t, view, cf) }
+	require.Equal(t, map[string]string{"a": "1a", "b": "1b"}, scan(r1, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"a": "2a"}, scan(r2, engine_util.CfDefault))
+	require.Empty(t, scan(r1, engine_util.CfLock))
+	require.Equal(t, map[string]string{"c": "2c"}, scan(r2, engine_util.CfLock))
+	// the unprefixed storage doesn't see the keys of its views
+	require.Empty(t, scan(s, engine_util.CfDefault))
+
+	reader, err := r2.Reader(nil)
+	require.Nil(t, err)
+	val, err := reader.GetCF(engine_util.CfDefault, []byte("b"))
+	require.Nil(t, err)
+	require.Nil(t, val)
+	reader.Close()
+
+	require.Nil(t, r1.Write(nil, []storage.Modify{{Data: storage.Delete{Cf: engine_util.CfDefault, Key: []byte("a")}}}))
+	require.Nil(t, r2.TruncateCF(engine_util.CfLock))
+	require.Equal(t, map[string]string{"b": "1b"}, scan(r1, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"a": "2a"}, scan(r2, engine_util.CfDefault))
+	require.Empty(t, scan(r2, engine_util.CfLock))
+
+	// the views share the engines
+	require.Nil(t, r1.Stop())
+	_, err = r2.Reader(nil)
+	require.Equal(t, ErrStopped, err)
+}
+
+func TestOverlappingPrefixes(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+	a, ab := s.WithPrefix([]byte("a")), s.WithPrefix([]byte("ab"))
+	nested := a.WithPrefix([]byte("b"))
+
+	// without an encoded namespace all of these would be the key "abc"
+	put(t, s, engine_util.CfDefault, []byte("abc"), []byte("root"))
+	put(t, a, engine_util.CfDefault, []byte("bc"), []byte("a"))
+	put(t, ab, engine_util.CfDefault, []byte("c"), []byte("ab"))
+	put(t, nested, engine_util.CfDefault, []byte("c"), []byte("a/b"))
+
+	require.Equal(t, map[string]string{"abc": "root"}, scanCF(t, s, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"bc": "a"}, scanCF(t, a, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"c": "ab"}, scanCF(t, ab, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"c": "a/b"}, scanCF(t, nested, engine_util.CfDefault))
+
+	require.Nil(t, a.TruncateCF(engine_util.CfDefault))
+	require.Empty(t, scanCF(t, a, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"abc": "root"}, scanCF(t, s, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"c": "ab"}, scanCF(t, ab, engine_util.CfDefault))
+	require.Equal(t, map[string]string{"c": "a/b"}, scanCF(t, nested, engine_util.CfDefault))
+}
+
+func TestListKeys(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	// written out of order, with keys of the same name in the other CFs
+	for _, key := range []string{"c", "a", "b"} {
+		put(t, s, engine_util.CfLock, []byte(key), []byte("lock"))
+	}
+	put(t, s, engine_util.CfDefault, []byte("0"), []byte("default"))
+	put(t, s, engine_util.CfWrite, []byte("d"), []byte("write"))
+
+	keys, err := s.ListKeys(engine_util.CfLock)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, keys)
+
+	keys, err = s.WithPrefix([]byte("p")).ListKeys(engine_util.CfLock)
+	require.Nil(t, err)
+	require.Empty(t, keys)
+}
+
+func TestSaveHardState(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	hs := eraftpb.HardState{Term: 3, Vote: 2, Commit: 5}
+	require.Nil(t, s.SaveHardState(hs))
+
+	var got eraftpb.HardState
+	require.Nil(t, engine_util.GetMeta(s.engines.Raft, s.prefixed(hardStateKey), &got))
+	require.Equal(t, hs, got)
+
+	// 硬状态只写入raft引擎, 不应出现在kv的列族中
+	r, err := s.Reader(nil)
+	require.Nil(t, err)
+	defer r.Close()
+	for _, cf := range engine_util.CFs {
+		val, err := r.GetCF(cf, hardStateKey)
+		require.Nil(t, err)
+		require.Nil(t, val)
+	}
+}
+
+func TestSendReadySavesBeforeSend(t *testing.T) {
+	s, cleanUp := newTestStorage(t)
+	defer cleanUp()
+
+	ms := raft.NewMemoryStorage()
+	require.Nil(t, ms.ApplySnapshot(eraftpb.Snapshot{Metadata: &eraftpb.SnapshotMetadata{
+		Index: 1, Term: 1, ConfState: &eraftpb.ConfState{Nodes: []uint64{1, 2}},
+	}}))
+	rn, err := raft.NewRawNode(&raft.Config{ID: 1, ElectionTick: 10, HeartbeatTick: 1, Storage: ms})
+	require.Nil(t, err)
+	require.Nil(t, rn.Step(eraftpb.Message{
+		MsgType: eraftpb.MessageType_MsgRequestVote, From: 2, To: 1, Term: 2, Index: 1, LogTerm: 1,
+	}))
+
+	rd := rn.Ready()
+	require.Equal(t, uint64(2), rd.HardState.Vote)
+	sent := 0
+	require.Nil(t, storage.SendReady(s, rd, func(m eraftpb.Message) {
+		// 发出投票前, 投票必须已经持久化
+		var hs eraftpb.HardState
+		require.Nil(t, engine_util.GetMeta(s.engines.Raft, s.prefixed(hardStateKey), &hs))
+		require.Equal(t, rd.HardState, hs)
+		sent++
+	}))
+	require.Equal(t, len(rd.Messages), sent)
+	require.NotZero(t, sent)
+
+	// 保存失败时不能发送任何消息
+	s.Stop()
+	err = storage.SendReady(s, rd, func(eraftpb.Message) { t.Fatal("message sent after a failed save") })
+	require.Equal(t, ErrStopped, err)
+}
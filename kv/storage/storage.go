@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"fmt"
+
 	"github.com/pingcap-incubator/tinykv/kv/util/engine_util"
+	"github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 	"github.com/pingcap-incubator/tinykv/proto/pkg/kvrpcpb"
+	"github.com/pingcap-incubator/tinykv/raft"
 )
 
 // Storage represents the internal-facing server part of TinyKV, it handles sending and receiving from other
@@ -12,6 +16,26 @@ type Storage interface {
 	Stop() error
 	Write(ctx *kvrpcpb.Context, batch []Modify) error
 	Reader(ctx *kvrpcpb.Context) (StorageReader, error)
+	// ReaderWithOptions is like Reader, but the returned reader is restricted and pinned as described by opts.
+	ReaderWithOptions(ctx *kvrpcpb.Context, opts ReadOptions) (StorageReader, error)
+	// SaveHardState durably persists the raft term, vote and commit index. A raft node must call it
+	// while handling the Ready that changed them, before sending any of the Ready's messages, see SendReady.
+	SaveHardState(hs eraftpb.HardState) error
+}
+
+// SendReady saves the HardState of rd through s and only then hands rd.Messages to send, so a vote or an
+// append response never leaves the node before the term and vote it depends on are durable. An empty
+// HardState means it didn't change and nothing is saved. No message is sent if saving fails.
+func SendReady(s Storage, rd raft.Ready, send func(eraftpb.Message)) error {
+	if !raft.IsEmptyHardState(rd.HardState) {
+		if err := s.SaveHardState(rd.HardState); err != nil {
+			return err
+		}
+	}
+	for _, m := range rd.Messages {
+		send(m)
+	}
+	return nil
 }
 
 type StorageReader interface {
@@ -20,3 +44,46 @@ type StorageReader interface {
 	IterCF(cf string) engine_util.DBIterator
 	Close()
 }
+
+// ReadOptions customizes the reader created by Storage.ReaderWithOptions.
+//
+// There is no option to pin a reader to a version: the engines are not opened
+// as managed badger DBs, so writes don't commit at timestamps a caller could
+// name. MVCC reads at a start timestamp go through kv/transaction/mvcc, which
+// encodes the timestamps in the keys.
+type ReadOptions struct {
+	// Cf restricts the reader to a single column family, empty means any CF can be read.
+	Cf string
+}
+
+// FilterCF restricts reader to the given column family. Reading any other CF returns an error, iterating it
+// returns an iterator without items whose error engine_util.IterErr reports. An empty cf leaves reader unrestricted.
+func FilterCF(reader StorageReader, cf string) StorageReader {
+	if cf == "" {
+		return reader
+	}
+	return &cfReader{StorageReader: reader, cf: cf}
+}
+
+type cfReader struct {
+	StorageReader
+	cf string
+}
+
+func (r *cfReader) errOtherCF(cf string) error {
+	return fmt.Errorf("storage: reader is restricted to CF %s, got %s", r.cf, cf)
+}
+
+func (r *cfReader) GetCF(cf string, key []byte) ([]byte, error) {
+	if cf != r.cf {
+		return nil, r.errOtherCF(cf)
+	}
+	return r.StorageReader.GetCF(cf, key)
+}
+
+func (r *cfReader) IterCF(cf string) engine_util.DBIterator {
+	if cf != r.cf {
+		return engine_util.NewErrIterator(r.errOtherCF(cf))
+	}
+	return r.StorageReader.IterCF(cf)
+}
@@ -52,7 +52,7 @@ func newBuilder(t *testing.T) testBuilder {
 			// This is a bit of a hack and relies on all the raw tests using keys shorter than 9 bytes, which is the
 			// minimum length for an encoded key.
 			if len(key) > 8 {
-				switch wr.Cf() {
+				switch wr.CF() {
 				case engine_util.CfDefault:
 					key = mvcc.DecodeUserKey(wr.Key())
 				case engine_util.CfWrite:
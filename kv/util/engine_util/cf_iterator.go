@@ -57,6 +57,8 @@ func (i *CFItem) UserMeta() []byte {
 type BadgerIterator struct {
 	iter   *badger.Iterator
 	prefix string
+	// seekKey is the key of the last Seek, Rewind returns to it.
+	seekKey []byte
 }
 
 func NewCFIterator(cf string, txn *badger.Txn) *BadgerIterator {
@@ -88,11 +90,12 @@ func (it *BadgerIterator) Next() {
 }
 
 func (it *BadgerIterator) Seek(key []byte) {
+	it.seekKey = append(it.seekKey[:0], key...)
 	it.iter.Seek(append([]byte(it.prefix), key...))
 }
 
 func (it *BadgerIterator) Rewind() {
-	it.iter.Rewind()
+	it.iter.Seek(append([]byte(it.prefix), it.seekKey...))
 }
 
 type DBIterator interface {
@@ -106,6 +109,10 @@ type DBIterator interface {
 	// Seek would seek to the provided key if present. If absent, it would seek to the next smallest key
 	// greater than provided.
 	Seek([]byte)
+	// Rewind repositions the iterator at the key of the last Seek, or at the first key if Seek was
+	// never called, so the same range can be scanned again without opening a new iterator and read
+	// transaction. It is not free though, Rewind is a seek and costs O(log N) like Seek does.
+	Rewind()
 
 	// Close the iterator
 	Close()
@@ -127,3 +134,31 @@ type DBItem interface {
 	// returned.
 	ValueCopy(dst []byte) ([]byte, error)
 }
+
+// ErrIterator is a DBIterator without items, it stands in for an iterator
+// that can't be used and reports why through Err.
+type ErrIterator struct {
+	err error
+}
+
+func NewErrIterator(err error) *ErrIterator {
+	return &ErrIterator{err: err}
+}
+
+func (it *ErrIterator) Err() error   { return it.err }
+func (it *ErrIterator) Item() DBItem { return nil }
+func (it *ErrIterator) Valid() bool  { return false }
+func (it *ErrIterator) Next()        {}
+func (it *ErrIterator) Seek([]byte)  {}
+func (it *ErrIterator) Rewind()      {}
+func (it *ErrIterator) Close()       {}
+
+// IterErr returns the error that ended the iteration of it early, e.g. the
+// error of an ErrIterator, or nil if it is an iterator that can't fail or
+// didn't fail.
+func IterErr(it DBIterator) error {
+	if e, ok := it.(interface{ Err() error }); ok {
+		return e.Err()
+	}
+	return nil
+}
@@ -2,10 +2,13 @@ package engine_util
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/Connor1996/badger"
+	"github.com/Connor1996/badger/options"
 	"github.com/stretchr/testify/require"
 )
 
@@ -91,3 +94,204 @@ func TestEngineUtil(t *testing.T) {
 	require.False(t, lockIter.Valid())
 	lockIter.Close()
 }
+
+func TestDeleteRangeCF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine_util")
+	require.Nil(t, err)
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := badger.Open(opts)
+	require.Nil(t, err)
+	defer db.Close()
+
+	batch := new(WriteBatch)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		batch.SetCF(CfDefault, []byte(key), []byte(key+"1"))
+		batch.SetCF(CfWrite, []byte(key), []byte(key+"2"))
+	}
+	require.Nil(t, batch.WriteToDB(db))
+
+	require.Nil(t, DeleteRangeCF(db, CfDefault, []byte("b"), []byte("d")))
+	for _, key := range []string{"b", "c"} {
+		_, err = GetCF(db, CfDefault, []byte(key))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+	}
+	for _, key := range []string{"a", "d"} {
+		val, err := GetCF(db, CfDefault, []byte(key))
+		require.Nil(t, err)
+		require.Equal(t, []byte(key+"1"), val)
+	}
+	// Other CFs are left untouched.
+	for _, key := range []string{"a", "b", "c", "d"} {
+		val, err := GetCF(db, CfWrite, []byte(key))
+		require.Nil(t, err)
+		require.Equal(t, []byte(key+"2"), val)
+	}
+
+	// An empty end key deletes to the end of the CF.
+	require.Nil(t, DeleteRangeCF(db, CfWrite, []byte("c"), nil))
+	_, err = GetCF(db, CfWrite, []byte("d"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	_, err = GetCF(db, CfWrite, []byte("b"))
+	require.Nil(t, err)
+}
+
+func TestTruncateRangeCF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine_util")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := badger.Open(opts)
+	require.Nil(t, err)
+	defer db.Close()
+
+	// more keys than one batch holds, and not a multiple of the batch size
+	const batchKeys, n = 16, 100
+	key := func(i int) []byte { return []byte(fmt.Sprintf("k%03d", i)) }
+	batch := new(WriteBatch)
+	for i := 0; i < n; i++ {
+		batch.SetCF(CfLock, key(i), []byte{1})
+		batch.SetCF(CfDefault, key(i), []byte{2})
+	}
+	require.Nil(t, batch.WriteToDB(db))
+
+	require.Nil(t, truncateRangeCF(db, CfLock, key(1), key(n-1), batchKeys))
+	for i := 0; i < n; i++ {
+		_, err := GetCF(db, CfLock, key(i))
+		if i == 0 || i == n-1 {
+			require.Nil(t, err, "key %d outside the range", i)
+		} else {
+			require.Equal(t, badger.ErrKeyNotFound, err, "key %d", i)
+		}
+		val, err := GetCF(db, CfDefault, key(i))
+		require.Nil(t, err)
+		require.Equal(t, []byte{2}, val)
+	}
+
+	require.Nil(t, TruncateRangeCF(db, CfLock, nil, nil))
+	for _, i := range []int{0, n - 1} {
+		_, err := GetCF(db, CfLock, key(i))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+	}
+}
+
+func TestIteratorRewind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine_util")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := badger.Open(opts)
+	require.Nil(t, err)
+	defer db.Close()
+
+	batch := new(WriteBatch)
+	for _, key := range []string{"a", "b", "c"} {
+		batch.SetCF(CfDefault, []byte(key), []byte(key))
+		batch.SetCF(CfLock, []byte(key), []byte(key))
+	}
+	require.Nil(t, batch.WriteToDB(db))
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	it := NewCFIterator(CfLock, txn)
+	defer it.Close()
+	scan := func() (keys []string) {
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, string(it.Item().Key()))
+		}
+		return keys
+	}
+
+	// without a seek Rewind starts at the first key of the CF
+	it.Rewind()
+	require.Equal(t, []string{"a", "b", "c"}, scan())
+
+	seekKey := []byte("b")
+	it.Seek(seekKey)
+	seekKey[0] = 'z'
+	require.Equal(t, []string{"b", "c"}, scan())
+	it.Rewind()
+	require.Equal(t, []string{"b", "c"}, scan())
+}
+
+func TestCollectMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine_util")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	db := CreateDB(dir, false)
+	require.Equal(t, EngineMetrics{}, CollectMetrics(db))
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.Nil(t, PutCF(db, CfDefault, []byte(key), []byte(key+"1")))
+		_, err = GetCF(db, CfDefault, []byte(key))
+		require.Nil(t, err)
+	}
+	metrics := CollectMetrics(db)
+	require.True(t, metrics.WriteAmplification >= 1)
+	// every key is still in the memtable, no table has been probed
+	require.Equal(t, 0.0, metrics.ReadAmplification)
+	require.Equal(t, int64(0), metrics.CompactionCount)
+
+	// a DB reopened at the same path doesn't inherit the counts of the old one
+	engines := NewEngines(db, nil, dir, "")
+	require.Nil(t, engines.Close())
+	db = CreateDB(dir, false)
+	defer db.Close()
+	require.Equal(t, EngineMetrics{}, CollectMetrics(db))
+
+	// a DB not opened by engine_util has no metrics
+	opts := badger.DefaultOptions
+	opts.Dir, opts.ValueDir = dir+"-other", dir+"-other"
+	defer os.RemoveAll(opts.Dir)
+	other, err := badger.Open(opts)
+	require.Nil(t, err)
+	defer other.Close()
+	require.Nil(t, PutCF(other, CfDefault, []byte("a"), []byte("a1")))
+	require.Equal(t, EngineMetrics{}, CollectMetrics(other))
+}
+
+func TestCountCompactions(t *testing.T) {
+	stats := new(dbStats)
+	opts := badger.DefaultOptions
+	countCompactions(&opts, stats)
+	for i := 0; i < 3; i++ {
+		filter := opts.CompactionFilterFactory(1, nil, nil)
+		require.Equal(t, badger.DecisionKeep, filter.Filter([]byte("k"), []byte("v"), nil))
+		require.Nil(t, filter.Guards())
+	}
+	require.Equal(t, int64(3), stats.compactions)
+}
+
+func TestCreateDBWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine_util")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DBOptions{
+		BlockSize:          16 * 1024,
+		Compression:        options.Snappy,
+		BloomFalsePositive: 0.001,
+	}
+	bopts := badgerOptions(dir, opts)
+	require.Equal(t, 16*1024, bopts.TableBuilderOptions.BlockSize)
+	require.Equal(t, options.Snappy, bopts.TableBuilderOptions.Compression)
+	require.Equal(t, 0.001, bopts.TableBuilderOptions.LogicalBloomFPR)
+	// the zero fields keep the badger defaults
+	require.Equal(t, badger.DefaultOptions.NumLevelZeroTables, bopts.NumLevelZeroTables)
+	require.Equal(t, badger.DefaultOptions.ValueLogFileSize, bopts.ValueLogFileSize)
+	require.Equal(t, badger.DefaultOptions.ValueThreshold, bopts.ValueThreshold)
+	require.Equal(t, badger.DefaultOptions.MaxTableSize, bopts.MaxTableSize)
+
+	db := CreateDBWithOptions(dir, opts)
+	defer db.Close()
+
+	require.Nil(t, PutCF(db, CfDefault, []byte("a"), bytes.Repeat([]byte("v"), 1024)))
+	val, err := GetCF(db, CfDefault, []byte("a"))
+	require.Nil(t, err)
+	require.Equal(t, bytes.Repeat([]byte("v"), 1024), val)
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"github.com/Connor1996/badger"
+	"github.com/Connor1996/badger/options"
 	"github.com/pingcap-incubator/tinykv/log"
 )
 
@@ -43,6 +44,7 @@ func (en *Engines) Close() error {
 		if db == nil {
 			continue
 		}
+		openedDBs.Delete(db)
 		if err := db.Close(); err != nil {
 			return err
 		}
@@ -63,21 +65,94 @@ func (en *Engines) Destroy() error {
 	return nil
 }
 
+// DBOptions are the badger options worth tuning for a deployment. A zero field
+// keeps the badger default, so ValueThreshold 0 and options.None can't be
+// selected through DBOptions.
+type DBOptions struct {
+	// NumLevelZeroTables is the number of level 0 tables that triggers a
+	// compaction.
+	NumLevelZeroTables int
+	// ValueLogFileSize is the maximum size of a single value log file.
+	ValueLogFileSize int64
+	// ValueThreshold is the minimum value size that is stored in the value log
+	// rather than in the LSM tree.
+	ValueThreshold int
+	// BlockSize is the size of a block in an SST file.
+	BlockSize int
+	// Compression is the compression applied to SST blocks.
+	Compression options.CompressionType
+	// BloomFalsePositive is the false positive rate of the bloom filters.
+	BloomFalsePositive float64
+}
+
 // CreateDB creates a new Badger DB on disk at path.
 func CreateDB(path string, raft bool) *badger.DB {
-	opts := badger.DefaultOptions
+	opts := badgerOptions(path, DBOptions{})
 	if raft {
 		// Do not need to write blob for raft engine because it will be deleted soon.
 		opts.ValueThreshold = 0
 	}
-	opts.Dir = path
-	opts.ValueDir = opts.Dir
+	return openDB(opts)
+}
+
+// CreateDBWithOptions creates a new Badger DB on disk at path, overriding the
+// badger defaults with the non-zero fields of opts.
+func CreateDBWithOptions(path string, opts DBOptions) *badger.DB {
+	return openDB(badgerOptions(path, opts))
+}
+
+func badgerOptions(path string, opts DBOptions) badger.Options {
+	bopts := badger.DefaultOptions
+	bopts.Dir = path
+	bopts.ValueDir = bopts.Dir
+	if opts.NumLevelZeroTables != 0 {
+		bopts.NumLevelZeroTables = opts.NumLevelZeroTables
+	}
+	if opts.ValueLogFileSize != 0 {
+		bopts.ValueLogFileSize = opts.ValueLogFileSize
+	}
+	if opts.ValueThreshold != 0 {
+		bopts.ValueThreshold = opts.ValueThreshold
+	}
+	if opts.BlockSize != 0 {
+		bopts.TableBuilderOptions.BlockSize = opts.BlockSize
+	}
+	if opts.Compression != options.None {
+		bopts.TableBuilderOptions.Compression = opts.Compression
+	}
+	if opts.BloomFalsePositive != 0 {
+		bopts.TableBuilderOptions.LogicalBloomFPR = opts.BloomFalsePositive
+	}
+	return bopts
+}
+
+func openDB(opts badger.Options) *badger.DB {
 	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
 		log.Fatal(err)
 	}
+	stats := &dbStats{
+		path:      opts.Dir,
+		maxLevels: opts.TableBuilderOptions.MaxLevels,
+		base:      badgerCounters(opts.Dir, opts.TableBuilderOptions.MaxLevels),
+	}
+	countCompactions(&opts, stats)
 	db, err := badger.Open(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	openedDBs.Store(db, stats)
 	return db
 }
+
+// OpenDBReadOnly opens an existing, closed Badger DB at path in read-only mode.
+// The read-only open takes a shared lock on the directory, which conflicts with
+// the exclusive lock held by a writer, so it fails while the DB is open anywhere
+// else. Badger also refuses the open if the DB was not closed cleanly and its
+// value log needs to be replayed.
+func OpenDBReadOnly(path string) (*badger.DB, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = opts.Dir
+	opts.ReadOnly = true
+	return badger.Open(opts)
+}
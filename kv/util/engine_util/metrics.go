@@ -0,0 +1,107 @@
+package engine_util
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Connor1996/badger"
+	"github.com/Connor1996/badger/y"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// EngineMetrics summarizes how much work badger did for the reads and writes
+// it served since the DB was opened, it is meant for tuning options such as
+// ValueLogFileSize and NumLevelZeroTables.
+type EngineMetrics struct {
+	// ReadAmplification is the average number of LSM tables probed per get.
+	ReadAmplification float64
+	// WriteAmplification is the number of bytes written to the value log and
+	// by compactions per byte written to the value log.
+	WriteAmplification float64
+	// BlockCacheHitRate is the hit ratio of the block cache, it stays zero
+	// while badger opens the cache with its metrics disabled.
+	BlockCacheHitRate float64
+	// CompactionCount is the number of compactions run.
+	CompactionCount int64
+}
+
+// dbStats is what openDB records about a DB for CollectMetrics.
+type dbStats struct {
+	// path is the Dir option of the DB, badger labels its counters with it
+	// but doesn't expose it.
+	path      string
+	maxLevels int
+	// base holds the badger counters of path when the DB was opened, badger
+	// never resets them, so a DB reopened at the same path would otherwise
+	// carry on the counts of the previous one.
+	base        map[string]float64
+	compactions int64
+}
+
+// openedDBs maps every DB opened by openDB to its *dbStats.
+var openedDBs sync.Map
+
+// countCompactions makes badger report every compaction of the DB to stats.
+// Badger asks the factory for a filter once per compaction, the filter keeps
+// every entry so the compaction output is unchanged.
+func countCompactions(opts *badger.Options, stats *dbStats) {
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) badger.CompactionFilter {
+		atomic.AddInt64(&stats.compactions, 1)
+		return keepAllFilter{}
+	}
+}
+
+type keepAllFilter struct{}
+
+func (keepAllFilter) Filter(key, val, userMeta []byte) badger.Decision { return badger.DecisionKeep }
+
+func (keepAllFilter) Guards() []badger.Guard { return nil }
+
+// CollectMetrics returns the EngineMetrics of db since it was opened by
+// CreateDB or CreateDBWithOptions. A DB opened any other way is unknown to
+// engine_util and gets zero metrics.
+func CollectMetrics(db *badger.DB) EngineMetrics {
+	v, ok := openedDBs.Load(db)
+	if !ok {
+		return EngineMetrics{}
+	}
+	stats := v.(*dbStats)
+	counters := badgerCounters(stats.path, stats.maxLevels)
+	delta := func(name string) float64 { return counters[name] - stats.base[name] }
+
+	metrics := EngineMetrics{CompactionCount: atomic.LoadInt64(&stats.compactions)}
+	if gets := delta("num_gets"); gets > 0 {
+		metrics.ReadAmplification = delta("num_lsm_gets") / gets
+	}
+	if written := delta("num_bytes_written"); written > 0 {
+		metrics.WriteAmplification = (written + delta("num_compaction_bytes_write")) / written
+	}
+	if cache := db.CacheMetrics(); cache != nil && cache.Hits+cache.Misses > 0 {
+		metrics.BlockCacheHitRate = float64(cache.Hits) / float64(cache.Hits+cache.Misses)
+	}
+	return metrics
+}
+
+// badgerCounters reads the badger counters of the DB at path, summing the
+// per level ones over the levels.
+func badgerCounters(path string, maxLevels int) map[string]float64 {
+	counters := map[string]float64{
+		"num_gets":          counterValue(y.NumGets.WithLabelValues(path)),
+		"num_bytes_written": counterValue(y.NumVLogBytesWritten.WithLabelValues(path)),
+	}
+	for level := 0; level < maxLevels; level++ {
+		label := fmt.Sprintf("L%d", level)
+		counters["num_lsm_gets"] += counterValue(y.NumLSMGets.WithLabelValues(path, label))
+		counters["num_compaction_bytes_write"] += counterValue(y.NumCompactionBytesWrite.WithLabelValues(path, label))
+	}
+	return counters
+}
+
+func counterValue(c interface{ Write(*dto.Metric) error }) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
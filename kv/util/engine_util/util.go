@@ -5,6 +5,7 @@ import (
 
 	"github.com/Connor1996/badger"
 	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/errors"
 )
 
 func KeyWithCF(cf string, key []byte) []byte {
@@ -89,6 +90,67 @@ func DeleteRange(db *badger.DB, startKey, endKey []byte) error {
 	return batch.WriteToDB(db)
 }
 
+// DeleteRangeCF deletes all keys of the given CF in [startKey, endKey) with a
+// single write batch, so the whole range is removed atomically. An empty
+// endKey means there is no upper bound.
+func DeleteRangeCF(db *badger.DB, cf string, startKey, endKey []byte) error {
+	batch := new(WriteBatch)
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	deleteRangeCF(txn, batch, cf, startKey, endKey)
+
+	return batch.WriteToDB(db)
+}
+
+// truncateBatchKeys is the number of deletes TruncateRangeCF commits per
+// transaction.
+const truncateBatchKeys = 4096
+
+// TruncateRangeCF deletes all keys of the given CF in [startKey, endKey) like
+// DeleteRangeCF, but commits the deletes in transactions of truncateBatchKeys
+// keys, so a range of any size can be removed without building one huge
+// transaction. The deletion is not atomic, if it fails part of the range may
+// already be gone. An empty endKey means there is no upper bound.
+func TruncateRangeCF(db *badger.DB, cf string, startKey, endKey []byte) error {
+	return truncateRangeCF(db, cf, startKey, endKey, truncateBatchKeys)
+}
+
+func truncateRangeCF(db *badger.DB, cf string, startKey, endKey []byte, batchKeys int) error {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	it := NewCFIterator(cf, txn)
+	defer it.Close()
+	batch := new(WriteBatch)
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		key := it.Item().KeyCopy(nil)
+		if ExceedEndKey(key, endKey) {
+			break
+		}
+		batch.DeleteCF(cf, key)
+		if batch.Len() >= batchKeys {
+			if err := writeSplitting(db, batch.entries); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return writeSplitting(db, batch.entries)
+}
+
+// writeSplitting writes entries in one transaction, or in two halves, each
+// split again as needed, if badger finds the transaction too big.
+func writeSplitting(db *badger.DB, entries []*badger.Entry) error {
+	err := (&WriteBatch{entries: entries}).WriteToDB(db)
+	if errors.Cause(err) != badger.ErrTxnTooBig || len(entries) < 2 {
+		return err
+	}
+	half := len(entries) / 2
+	if err := writeSplitting(db, entries[:half]); err != nil {
+		return err
+	}
+	return writeSplitting(db, entries[half:])
+}
+
 func deleteRangeCF(txn *badger.Txn, batch *WriteBatch, cf string, startKey, endKey []byte) {
 	it := NewCFIterator(cf, txn)
 	for it.Seek(startKey); it.Valid(); it.Next() {
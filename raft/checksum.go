@@ -0,0 +1,54 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// ErrEntryChecksumMismatch is wrapped by the error RawNode.Ready panics with
+// when a committed entry doesn't match the checksum computed when it was
+// proposed, i.e. it was corrupted in storage or in transit.
+var ErrEntryChecksumMismatch = errors.New("raft: entry checksum mismatch")
+
+const checksumSize = crc32.Size
+
+// appendChecksum returns data followed by its CRC32.
+func appendChecksum(data []byte) []byte {
+	sum := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(data))
+	return append(data[:len(data):len(data)], sum...)
+}
+
+// verifyEntry checks the checksum of ent and returns it with the checksum
+// stripped. Entries without data carry a checksum too, so an entry whose data
+// was lost is caught as well, and it is stripped back to nil data.
+func verifyEntry(ent pb.Entry) (pb.Entry, error) {
+	n := len(ent.Data) - checksumSize
+	if n < 0 || crc32.ChecksumIEEE(ent.Data[:n]) != binary.BigEndian.Uint32(ent.Data[n:]) {
+		return pb.Entry{}, fmt.Errorf("entry %d at term %d: %w", ent.Index, ent.Term, ErrEntryChecksumMismatch)
+	}
+	if n == 0 {
+		ent.Data = nil
+	} else {
+		ent.Data = ent.Data[:n]
+	}
+	return ent, nil
+}
+
+// verifyEntries checks the checksum of every entry and returns the entries
+// with their checksums stripped, the entries in the log are left untouched.
+func verifyEntries(ents []pb.Entry) ([]pb.Entry, error) {
+	verified := make([]pb.Entry, 0, len(ents))
+	for _, ent := range ents {
+		ent, err := verifyEntry(ent)
+		if err != nil {
+			return nil, err
+		}
+		verified = append(verified, ent)
+	}
+	return verified, nil
+}
@@ -15,6 +15,10 @@
 package raft
 
 import (
+	"fmt"
+	"math"
+	"sort"
+
 	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 )
 
@@ -52,38 +56,38 @@ type RaftLog struct {
 	pendingSnapshot *pb.Snapshot
 
 	// Your Data Here (2A).
-	// firstIndex = dummyIndex + 1
+	// dummyIndex is the index of the last compacted entry and dummyTerm its
+	// term, entries[0] is the entry at dummyIndex+1. No entry is stored for
+	// dummyIndex itself, Term answers it from dummyTerm.
 	dummyIndex uint64
+	dummyTerm  uint64
 }
 
 // newLog returns log using the given storage. It recovers the log
 // to the state that it just commits and applies the latest snapshot.
 func newLog(storage Storage) *RaftLog {
 	// Your Code Here (2A).
-	hardState, _, _ := storage.InitialState()
-
 	firstIndex, _ := storage.FirstIndex()
 	lastIndex, _ := storage.LastIndex()
-	entries, _ := storage.Entries(firstIndex, lastIndex+1)
+	// 内存中保存所有未压缩的日志, 因此不限制大小
+	entries, _ := storage.Entries(firstIndex, lastIndex+1, math.MaxUint64)
+	// 一次分配好全部日志, 并为之后的append多留一个位置
+	entries = append(make([]pb.Entry, 0, lastIndex-firstIndex+2), entries...)
+
+	// storage始终能回答firstIndex-1的term, 即最近一次snapshot的term
+	dummyTerm, _ := storage.Term(firstIndex - 1)
 
 	r := &RaftLog{
 		storage:         storage,
-		committed:       0,
-		applied:         0,
-		stabled:         0,
-		dummyIndex:      0,
-		entries:         make([]pb.Entry, 0),
+		committed:       firstIndex - 1,
+		applied:         firstIndex - 1,
+		stabled:         lastIndex,
+		entries:         entries,
 		pendingSnapshot: new(pb.Snapshot),
+		dummyIndex:      firstIndex - 1,
+		dummyTerm:       dummyTerm,
 	}
 
-	// 添加一个dummy entry
-	r.entries = append(r.entries, pb.Entry{Index: r.dummyIndex, Term: 0, Data: []byte("init")})
-	r.entries = append(r.entries, entries...)
-	r.committed = hardState.Commit
-	r.applied = firstIndex - 1
-	r.stabled = lastIndex
-	r.dummyIndex = firstIndex - 1
-
 	return r
 }
 
@@ -94,12 +98,45 @@ func (l *RaftLog) maybeCompact() {
 	// Your Code Here (2C).
 }
 
+// compactTo discards the entries up to index, which is covered by a snapshot
+// with the given term. The snapshot term is kept as dummyTerm
+// so Term(index) is still answered. If the log does not contain the
+// snapshot's entry, all entries are discarded.
+func (l *RaftLog) compactTo(index, term uint64) {
+	if index <= l.dummyIndex {
+		return
+	}
+	if t, err := l.Term(index); err == nil && t == term {
+		// 复制剩余的日志, 释放被压缩部分占用的内存
+		l.entries = append([]pb.Entry{}, l.entries[index-l.dummyIndex:]...)
+	} else {
+		l.entries = []pb.Entry{}
+	}
+	l.dummyIndex = index
+	l.dummyTerm = term
+	l.committed = max(l.committed, index)
+	if index > l.applied {
+		l.appliedTo(index)
+	}
+	l.stabled = max(l.stabled, index)
+}
+
+// appliedTo advances applied to i. Applied never moves backwards and never
+// passes committed, an uncommitted entry reported as applied could be lost
+// from a snapshot taken at that index.
+func (l *RaftLog) appliedTo(i uint64) {
+	if i < l.applied || i > l.committed {
+		panic(fmt.Sprintf("applied(%d) is out of range [prevApplied(%d), committed(%d)]", i, l.applied, l.committed))
+	}
+	l.applied = i
+}
+
 // allEntries return all the entries not compacted.
 // note, exclude any dummy entries from the return value.
 // note, this is one of the test stub functions you need to implement.
 func (l *RaftLog) allEntries() []pb.Entry {
 	// Your Code Here (2A).
-	return l.entries[1:]
+	return l.entries
 }
 
 // unstableEntries return all the unstable entries
@@ -109,27 +146,170 @@ func (l *RaftLog) unstableEntries() []pb.Entry {
 	// for i := l.stabled + 1; i <= l.LastIndex(); i++ {
 	// 	entries = append(entries, l.entries[i-firstIndex])
 	// }
+	// stabled只能落在[dummyIndex, LastIndex]内, 否则已持久化的日志会被当作
+	// unstable再次返回, 或者未持久化的日志被跳过
+	if l.stabled < l.dummyIndex || l.stabled > l.LastIndex() {
+		panic(fmt.Sprintf("stabled %d out of range [%d, %d]", l.stabled, l.dummyIndex, l.LastIndex()))
+	}
 	unstable := make([]pb.Entry, 0)
-	unstable = append(unstable, l.entries[l.stabled+1:]...)
+	unstable = append(unstable, l.entries[l.stabled-l.dummyIndex:]...)
 	return unstable
 }
 
+// stableTo marks the entries up to index i as persisted. The entry must still
+// be of term t, an entry that was truncated and replaced after it was handed
+// to the application is not persisted yet.
+func (l *RaftLog) stableTo(i, t uint64) {
+	if i <= l.stabled {
+		return
+	}
+	if term, err := l.Term(i); err == nil && term == t {
+		l.stabled = i
+	}
+}
+
 // nextEnts returns all the committed but not applied entries
 func (l *RaftLog) nextEnts() (ents []pb.Entry) {
 	// Your Code Here (2A).
 	ents = make([]pb.Entry, 0)
-	ents = append(ents, l.entries[l.applied+1:l.committed+1]...)
+	// committed may run ahead of the local log, e.g. when it comes from a
+	// hard state whose entries are not restored yet
+	hi := min(l.committed, l.LastIndex())
+	lo := max(l.applied, l.dummyIndex)
+	if lo >= hi {
+		return ents
+	}
+	ents = append(ents, l.slice(lo+1, hi+1)...)
 	return ents
 }
 
+// hasNextEnts reports whether nextEnts would return any entry.
+func (l *RaftLog) hasNextEnts() bool {
+	return min(l.committed, l.LastIndex()) > max(l.applied, l.dummyIndex)
+}
+
+// slice returns the entries in [lo, hi), which must be within
+// [firstIndex, LastIndex+1]. The returned entries share the log's memory.
+func (l *RaftLog) slice(lo, hi uint64) []pb.Entry {
+	if lo < l.firstIndex() || hi > l.LastIndex()+1 || lo > hi {
+		panic(fmt.Sprintf("slice [%d, %d) out of range [%d, %d]", lo, hi, l.firstIndex(), l.LastIndex()+1))
+	}
+	return l.entries[lo-l.firstIndex() : hi-l.firstIndex()]
+}
+
+// scanEntries calls visitor with the entries in [lo, hi) in order until it
+// returns false. Unlike slice, a range outside the log is an error rather than
+// a panic: ErrCompacted if lo is below firstIndex, ErrUnavailable otherwise.
+func (l *RaftLog) scanEntries(lo, hi uint64, visitor func(pb.Entry) bool) error {
+	if lo < l.firstIndex() {
+		return ErrCompacted
+	}
+	if hi > l.LastIndex()+1 || lo > hi {
+		return ErrUnavailable
+	}
+	for _, ent := range l.entries[lo-l.firstIndex() : hi-l.firstIndex()] {
+		if !visitor(ent) {
+			break
+		}
+	}
+	return nil
+}
+
+// truncate removes the entries from index i on, i must be beyond committed.
+// If they were already persisted stabled is moved back, so the entries that
+// replace them are handed to the application again.
+func (l *RaftLog) truncate(i uint64) {
+	if i <= l.committed || i < l.firstIndex() {
+		panic(fmt.Sprintf("truncate at %d, committed %d, firstIndex %d", i, l.committed, l.firstIndex()))
+	}
+	if i > l.LastIndex() {
+		return
+	}
+	l.entries = l.entries[:i-l.firstIndex()]
+	l.stabled = min(l.stabled, i-1)
+}
+
+// appendEntry assigns the given term and the indexes following LastIndex to
+// ents and appends them to the log. The new entries stay unstable until the
+// application persists them and stabled moves past them. It returns the new
+// last index.
+func (l *RaftLog) appendEntry(term uint64, ents ...*pb.Entry) uint64 {
+	for _, ent := range ents {
+		ent.Term = term
+		ent.Index = l.LastIndex() + 1
+		l.entries = append(l.entries, *ent)
+	}
+	return l.LastIndex()
+}
+
 // LastIndex return the last index of the log entries
 func (l *RaftLog) LastIndex() uint64 {
 	// Your Code Here (2A).
-	return l.dummyIndex + uint64(len(l.allEntries()))
+	return l.dummyIndex + uint64(len(l.entries))
+}
+
+// lastTerm returns the term of the last entry, which is the snapshot term when
+// the log is empty after compaction.
+func (l *RaftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.dummyTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// firstIndex return the first index of the log entries
+func (l *RaftLog) firstIndex() uint64 {
+	return l.dummyIndex + 1
 }
 
 // Term return the term of the entry in the given index
 func (l *RaftLog) Term(i uint64) (uint64, error) {
 	// Your Code Here (2A).
-	return l.entries[i-l.dummyIndex].Term, nil
+	if i < l.dummyIndex {
+		return 0, ErrCompacted
+	}
+	if i > l.LastIndex() {
+		return 0, ErrUnavailable
+	}
+	if i == l.dummyIndex {
+		return l.dummyTerm, nil
+	}
+	return l.entries[i-l.firstIndex()].Term, nil
+}
+
+// MustTerm is like Term but panics if the index is out of range, it should
+// only be used where a missing entry indicates a programming error.
+func (l *RaftLog) MustTerm(i uint64) uint64 {
+	term, err := l.Term(i)
+	if err != nil {
+		panic(fmt.Sprintf("RaftLog.Term(%d) out of range [%d, %d]: %v", i, l.firstIndex(), l.LastIndex(), err))
+	}
+	return term
+}
+
+// maybeCommit advances committed to maxIndex if it is beyond committed and the
+// entry at maxIndex is of the given term. A leader may only commit entries of
+// its own term directly, older entries get committed along with them (§5.4.2).
+func (l *RaftLog) maybeCommit(maxIndex, term uint64) bool {
+	if maxIndex <= l.committed {
+		return false
+	}
+	if t, err := l.Term(maxIndex); err != nil || t != term {
+		return false
+	}
+	l.committed = maxIndex
+	return true
+}
+
+// entriesInTerm returns the index range [first, last] of the entries that
+// belong to the given term, ok is false if no such entry is in the log. The
+// terms of the entries never decrease, so both ends are found by binary search.
+func (l *RaftLog) entriesInTerm(term uint64) (first, last uint64, ok bool) {
+	ents := l.allEntries()
+	lo := sort.Search(len(ents), func(i int) bool { return ents[i].Term >= term })
+	hi := sort.Search(len(ents), func(i int) bool { return ents[i].Term > term })
+	if lo == hi {
+		return 0, 0, false
+	}
+	return ents[lo].Index, ents[hi-1].Index, true
 }
@@ -16,6 +16,7 @@ package raft
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"math/rand/v2"
 
@@ -48,6 +49,45 @@ func (st StateType) String() string {
 // so that the proposer can be notified and fail fast.
 var ErrProposalDropped = errors.New("raft proposal dropped")
 
+// ErrTooManyUncommittedEntries is returned together with ErrProposalDropped
+// when the data of the leader's uncommitted entries exceeds
+// Config.MaxUncommittedEntrySize, the proposal can be retried once the
+// followers catch up.
+var ErrTooManyUncommittedEntries = errors.New("raft: too many uncommitted entries")
+
+// ErrDropped is returned by Step, wrapped with the message type, when a
+// message is deliberately ignored, e.g. one the node's current state does not
+// handle. It is informational, the message needs no further action.
+var ErrDropped = errors.New("raft: message dropped")
+
+// ErrInvalidEntry is returned when a proposal carries no entry or a malformed
+// one, the returned error wraps it with the reason.
+var ErrInvalidEntry = errors.New("raft: invalid entry")
+
+// ErrDuplicateReadCtx is returned by ReadIndex when a read only request with
+// the same ctx is still pending, the ctx must be unique among pending reads.
+var ErrDuplicateReadCtx = errors.New("raft: duplicate read index ctx")
+
+// ErrNotLeader is returned when a proposal is made on a node that is not the
+// leader, LeaderHint is the leader the node knows of, None if it knows none,
+// so the caller can redirect the proposal. Proposals are never forwarded to the
+// leader, so it also counts as ErrProposalDropped for errors.Is.
+type ErrNotLeader struct {
+	LeaderHint uint64
+}
+
+func (e ErrNotLeader) Error() string {
+	if e.LeaderHint == None {
+		return "raft: not leader, leader unknown"
+	}
+	return fmt.Sprintf("raft: not leader, leader is %d", e.LeaderHint)
+}
+
+// Is makes errors.Is(err, ErrProposalDropped) hold for an ErrNotLeader.
+func (e ErrNotLeader) Is(target error) bool {
+	return target == ErrProposalDropped
+}
+
 // Config contains the parameters to start a raft.
 type Config struct {
 	// ID is the identity of the local raft. ID cannot be 0.
@@ -81,6 +121,58 @@ type Config struct {
 	// Applied. If Applied is unset when restarting, raft might return previous
 	// applied entries. This is a very application dependent configuration.
 	Applied uint64
+
+	// CheckQuorum makes the leader fail proposals with ErrProposalDropped
+	// when it has not heard from a quorum of the cluster within the last
+	// election timeout, instead of appending entries that cannot commit.
+	CheckQuorum bool
+
+	// ReplicationHook, if set, is called with the append messages built for
+	// a peer right before they are queued for sending. It may modify the
+	// messages in place, e.g. to attach metadata, or record metrics. The hook
+	// is called synchronously in the raft goroutine and must not block or
+	// call back into raft.
+	ReplicationHook func(id uint64, pr *Progress, msgs []pb.Message)
+
+	// PreferLowerID breaks ties between equal election timeouts in favour of
+	// the lower node id, each node waits one more tick per lower id in the
+	// group. It makes contested elections deterministic for tests and is off
+	// by default.
+	PreferLowerID bool
+
+	// MaxFollowerLag makes the leader drop proposals with ErrProposalDropped
+	// that would leave the slowest peer's Match more than this many entries
+	// behind the last index, so a lagging follower can't grow the leader's
+	// log without bound. 0 disables the check.
+	MaxFollowerLag uint64
+
+	// EntryChecksum makes the leader append a CRC32 to the data of every
+	// entry it appends, empty ones included, it is verified and stripped when
+	// the entry is handed out for applying, see RawNode.Ready.
+	// Every node of the group must use the same setting.
+	EntryChecksum bool
+
+	// MaxPendingMessages is a soft cap on the outgoing messages waiting to be
+	// sent, a warning is logged when the queue grows past it, which usually
+	// means the transport doesn't drain Ready. 0 disables the warning.
+	MaxPendingMessages int
+
+	// MaxEntrySize limits the size of the data of a proposed entry, larger
+	// proposals are rejected with ErrInvalidEntry. 0 means no limit.
+	MaxEntrySize uint64
+
+	// MaxUncommittedEntrySize makes the leader drop proposals while the data
+	// of its uncommitted entries adds up to more than this many bytes, so slow
+	// followers push back on the clients instead of the leader running out of
+	// memory. The error wraps both ErrProposalDropped and
+	// ErrTooManyUncommittedEntries. 0 means no limit.
+	MaxUncommittedEntrySize uint64
+
+	// MaxEntriesPerMsg limits the number of entries the leader sends in one
+	// append message, a follower that is further behind receives the backlog
+	// in batches, the next one is sent once the previous one is acknowledged.
+	// Useful when entries are small but numerous. 0 means no limit.
+	MaxEntriesPerMsg uint64
 }
 
 func (c *Config) validate() error {
@@ -100,15 +192,102 @@ func (c *Config) validate() error {
 		return errors.New("storage cannot be nil")
 	}
 
+	for _, id := range c.peers {
+		if id == None {
+			return errors.New("cannot use none as peer id")
+		}
+	}
+
 	return nil
 }
 
+// ProgressStateType is the replication state of a peer in the view of the
+// leader.
+type ProgressStateType uint64
+
+const (
+	// ProgressStateProbe means the leader does not know how far the peer's log
+	// matches its own, e.g. the peer has just become reachable again.
+	ProgressStateProbe ProgressStateType = iota
+	// ProgressStateReplicate means the peer is accepting appends.
+	ProgressStateReplicate
+	// ProgressStateSnapshot means a snapshot is in flight to the peer, no
+	// appends are sent until the peer acknowledges it.
+	ProgressStateSnapshot
+)
+
+var prstmap = [...]string{
+	"ProgressStateProbe",
+	"ProgressStateReplicate",
+	"ProgressStateSnapshot",
+}
+
+func (st ProgressStateType) String() string {
+	return prstmap[uint64(st)]
+}
+
 // Progress represents a follower’s progress in the view of the leader. Leader maintains
 // progresses of all followers, and sends entries to the follower based on its progress.
 type Progress struct {
 	Match, Next uint64
+
+	// State is Replicate once the peer accepts an append and falls back to
+	// Probe when the peer is reported unreachable or a snapshot to it ends.
+	// It is Snapshot from the time a snapshot is sent to the peer.
+	State ProgressStateType
+
+	// PendingSnapshot is the index of the snapshot in flight to the peer,
+	// it is cleared once the peer acknowledges an append.
+	PendingSnapshot uint64
+
+	// retryBackoff is the number of ticks to wait before resending a snapshot
+	// that is not acknowledged, it doubles after every retry up to
+	// maxRetryBackoff times the heartbeat interval. retryElapsed is the number
+	// of ticks since the last attempt.
+	retryBackoff int
+	retryElapsed int
+	// snapshotElapsed is the number of ticks since the pending snapshot was
+	// first sent. After snapshotTimeout heartbeat intervals the leader gives
+	// up on it and probes the peer again.
+	snapshotElapsed int
+
+	// RecentActive is true if the leader has received a response from the
+	// peer since the start of the current election timeout.
+	RecentActive bool
+
+	// Committed is the committed index the peer reported in its latest
+	// append response, it lags behind the leader's by a round trip.
+	Committed uint64
+
+	// RejectStreak is the number of consecutive appends the peer has rejected,
+	// it is reset once the peer accepts an append. A peer whose streak keeps
+	// rising is diverging from the leader or on a flaky link.
+	RejectStreak int
+}
+
+// String returns the replication position of the peer, e.g.
+// "Progress{Match:5 Next:6 State:ProgressStateReplicate}".
+func (pr Progress) String() string {
+	return fmt.Sprintf("Progress{Match:%d Next:%d State:%s}", pr.Match, pr.Next, pr.State)
+}
+
+// abortSnapshot forgets the snapshot in flight to the peer and moves it back
+// to probe, a new snapshot is sent if the peer still needs one.
+func (pr *Progress) abortSnapshot() {
+	pr.PendingSnapshot = 0
+	pr.retryBackoff = 0
+	pr.retryElapsed = 0
+	pr.snapshotElapsed = 0
+	pr.State = ProgressStateProbe
 }
 
+// maxRetryBackoff caps the snapshot retry interval, in heartbeat intervals.
+const maxRetryBackoff = 16
+
+// snapshotTimeout is how long a snapshot may stay unacknowledged before the
+// peer goes back to probe, in heartbeat intervals.
+const snapshotTimeout = 2 * maxRetryBackoff
+
 type Raft struct {
 	id uint64
 
@@ -162,6 +341,64 @@ type Raft struct {
 	// (Used in 3A conf change)
 	PendingConfIndex uint64
 
+	// checkQuorum is set from Config.CheckQuorum. quorumLost is set by the
+	// leader when it did not hear from a quorum during the last election
+	// timeout, and cleared as soon as a quorum responds again.
+	checkQuorum bool
+	quorumLost  bool
+
+	// readOnly holds the read only requests waiting for heartbeat acks, and
+	// readStates the confirmed ones not yet handed to the application.
+	readOnly   *readOnly
+	readStates []ReadState
+
+	// replicationHook is set from Config.ReplicationHook.
+	replicationHook func(id uint64, pr *Progress, msgs []pb.Message)
+
+	// preferLowerID is set from Config.PreferLowerID.
+	preferLowerID bool
+
+	// maxFollowerLag is set from Config.MaxFollowerLag.
+	maxFollowerLag uint64
+
+	// entryChecksum is set from Config.EntryChecksum.
+	entryChecksum bool
+
+	// maxPendingMessages is set from Config.MaxPendingMessages, msgsOverCap
+	// records that the warning was logged so it is logged once per overflow.
+	maxPendingMessages int
+	msgsOverCap        bool
+
+	// maxEntrySize is set from Config.MaxEntrySize.
+	maxEntrySize uint64
+
+	// maxUncommittedSize is set from Config.MaxUncommittedEntrySize.
+	maxUncommittedSize uint64
+
+	// maxEntriesPerMsg is set from Config.MaxEntriesPerMsg.
+	maxEntriesPerMsg uint64
+
+	// randomTimeout returns the random part of a candidate's election
+	// timeout, in [0, n). It is rand.IntN, tests replace it to drive exact
+	// timeouts.
+	randomTimeout func(n int) int
+
+	// proposalCtx is the context of the proposal being stepped, set by
+	// RawNode.ProposeWithContext. entryCtxs maps the index of every entry
+	// proposed with a context to it, until the entry is applied.
+	proposalCtx []byte
+	entryCtxs   map[uint64]entryCtx
+
+	// applyc is signalled when the committed index advances past applied,
+	// see RawNode.ApplyNotify. notifiedCommit is the committed index of the
+	// last signal.
+	applyc         chan struct{}
+	notifiedCommit uint64
+
+	// confChanges holds the most recently applied conf changes, oldest
+	// first, bounded by maxConfChangeHistory.
+	confChanges []ConfChangeRecord
+
 	voteCount   int
 	rejectCount int
 }
@@ -172,17 +409,23 @@ func newRaft(c *Config) *Raft {
 		panic(err.Error())
 	}
 	// Your Code Here (2A).
-	hardState, _, _ := c.Storage.InitialState()
+	hardState, confState, _ := c.Storage.InitialState()
+	// 重启的节点不需要再传入peers, 成员从storage保存的ConfState恢复
+	peers := c.peers
+	if len(peers) == 0 {
+		peers = confState.Nodes
+	}
 	r := new(Raft)
 	r.id = c.ID
 	r.RaftLog = newLog(c.Storage)
-	r.Term = hardState.Term
-	r.Vote = hardState.Vote
+	if !IsEmptyHardState(hardState) {
+		r.loadState(hardState)
+	}
 	r.State = StateFollower
 	r.Prs = make(map[uint64]*Progress)
 	r.votes = make(map[uint64]bool)
-	for _, id := range c.peers {
-		r.Prs[id] = &Progress{0, 0}
+	for _, id := range peers {
+		r.Prs[id] = &Progress{Match: 0, Next: 0}
 		r.votes[id] = false
 	}
 	r.msgs = make([]pb.Message, 0)
@@ -194,9 +437,24 @@ func newRaft(c *Config) *Raft {
 	r.electionElapsed = 0
 	r.leadTransferee = None
 	r.PendingConfIndex = 0
-
-	for _, v := range c.peers {
-		r.Prs[v] = &Progress{0, 1}
+	r.checkQuorum = c.CheckQuorum
+	r.replicationHook = c.ReplicationHook
+	r.preferLowerID = c.PreferLowerID
+	r.maxFollowerLag = c.MaxFollowerLag
+	r.entryChecksum = c.EntryChecksum
+	r.maxPendingMessages = c.MaxPendingMessages
+	r.maxEntrySize = c.MaxEntrySize
+	r.maxUncommittedSize = c.MaxUncommittedEntrySize
+	r.maxEntriesPerMsg = c.MaxEntriesPerMsg
+	r.randomTimeout = rand.IntN
+	r.readOnly = newReadOnly()
+
+	for _, v := range peers {
+		r.Prs[v] = &Progress{Match: 0, Next: 1}
+	}
+	r.electionTimeout += r.tieBreak()
+	if c.Applied > 0 {
+		r.RaftLog.appliedTo(c.Applied)
 	}
 	return r
 }
@@ -206,12 +464,34 @@ func newRaft(c *Config) *Raft {
 func (r *Raft) sendAppend(to uint64) bool {
 	// Your Code Here (2A).
 	pr := r.Prs[to]
+	// follower应用snapshot之前append都是无用的, 等待snapshot被确认
+	if pr.State == ProgressStateSnapshot {
+		return false
+	}
+	// prevLogIndex的term或者要发送的日志已被压缩, 改为发送snapshot
+	if pr.Next < r.RaftLog.firstIndex() {
+		return r.trySendSnapshot(to)
+	}
 	entry := make([]*pb.Entry, 0)
-	for i := pr.Next; i <= r.RaftLog.LastIndex(); i++ {
-		entry = append(entry, &r.RaftLog.entries[i])
+	if last := r.RaftLog.LastIndex(); pr.Next <= last {
+		hi := last + 1
+		// 限制每条消息的entry数量, 剩余的日志在follower确认后继续发送
+		if r.maxEntriesPerMsg != 0 && hi-pr.Next > r.maxEntriesPerMsg {
+			hi = pr.Next + r.maxEntriesPerMsg
+		}
+		// 消息中保存entry的副本, 发送前日志被截断覆盖也不会改变消息内容
+		ents := make([]pb.Entry, 0, hi-pr.Next)
+		err := r.RaftLog.scanEntries(pr.Next, hi, func(ent pb.Entry) bool {
+			ents = append(ents, ent)
+			entry = append(entry, &ents[len(ents)-1])
+			return true
+		})
+		if err != nil {
+			return r.trySendSnapshot(to)
+		}
 	}
 	// logTerm代表论文中的prevLogTerm
-	logTerm := r.RaftLog.entries[pr.Match].Term
+	logTerm := r.RaftLog.MustTerm(pr.Next - 1)
 	// index代表论文中的prevLogIndex
 	msg := pb.Message{
 		MsgType: pb.MessageType_MsgAppend,
@@ -221,7 +501,13 @@ func (r *Raft) sendAppend(to uint64) bool {
 		Commit:  r.RaftLog.committed,
 		Entries: entry,
 		LogTerm: logTerm,
-		Index:   pr.Match,
+		Index:   pr.Next - 1,
+	}
+	if r.replicationHook != nil {
+		// 只在设置了hook时才分配切片, 避免热路径上的额外分配
+		msgs := []pb.Message{msg}
+		r.replicationHook(to, pr, msgs)
+		msg = msgs[0]
 	}
 	// 更新leader
 	r.msgs = append(r.msgs, msg)
@@ -231,8 +517,46 @@ func (r *Raft) sendAppend(to uint64) bool {
 	return true
 }
 
-// sendHeartbeat sends a heartbeat RPC to the given peer.
-func (r *Raft) sendHeartbeat(to uint64) {
+// trySendSnapshot sends the latest snapshot to the given peer in place of the
+// entries it needs, which are compacted. A snapshot that is still
+// unacknowledged is only resent after its retry backoff has elapsed, and every
+// resend doubles the backoff. Returns false if nothing was sent, including when
+// the storage has no snapshot available yet.
+func (r *Raft) trySendSnapshot(to uint64) bool {
+	pr := r.Prs[to]
+	if pr.PendingSnapshot != 0 && pr.retryElapsed < pr.retryBackoff {
+		return false
+	}
+	snapshot, err := r.RaftLog.storage.Snapshot()
+	if err != nil {
+		// snapshot暂不可用, 没有真正发送, 不增加退避, 等待下次重试
+		return false
+	}
+	r.msgs = append(r.msgs, pb.Message{
+		MsgType:  pb.MessageType_MsgSnapshot,
+		From:     r.id,
+		To:       to,
+		Term:     r.Term,
+		Snapshot: &snapshot,
+	})
+	if pr.PendingSnapshot != 0 {
+		pr.retryBackoff *= 2
+		if limit := maxRetryBackoff * r.heartbeatTimeout; pr.retryBackoff > limit {
+			pr.retryBackoff = limit
+		}
+	} else {
+		pr.retryBackoff = r.heartbeatTimeout
+		pr.snapshotElapsed = 0
+	}
+	pr.PendingSnapshot = snapshot.Metadata.Index
+	pr.State = ProgressStateSnapshot
+	pr.retryElapsed = 0
+	return true
+}
+
+// sendHeartbeat sends a heartbeat RPC to the given peer, a non-nil ctx
+// is carried in the only entry of the message and echoed back by the peer.
+func (r *Raft) sendHeartbeat(to uint64, ctx []byte) {
 	// Your Code Here (2A).
 	msg := pb.Message{
 		MsgType: pb.MessageType_MsgHeartbeat,
@@ -240,36 +564,78 @@ func (r *Raft) sendHeartbeat(to uint64) {
 		To:      to,
 		Term:    r.Term,
 	}
+	if ctx != nil {
+		msg.Entries = []*pb.Entry{{Data: ctx}}
+	}
 	r.msgs = append(r.msgs, msg)
 }
 
+// bcastHeartbeat sends a heartbeat to all peers, carrying the latest pending
+// read only request so that it and every request before it are confirmed.
+func (r *Raft) bcastHeartbeat() {
+	r.bcastHeartbeatWithCtx(r.readOnly.lastPendingRequestCtx())
+}
+
+func (r *Raft) bcastHeartbeatWithCtx(ctx []byte) {
+	for id := range r.Prs {
+		if id == r.id {
+			continue
+		}
+		r.sendHeartbeat(id, ctx)
+	}
+}
+
 // tick advances the internal logical clock by a single tick.
 func (r *Raft) tick() {
 	// Your Code Here (2A).
+	defer r.checkPendingMessages()
+	defer r.notifyApply()
 	switch r.State {
 	case StateFollower:
 		r.electionElapsed++
 		if r.electionElapsed >= r.electionTimeout {
-			r.becomeCandidate()
-			r.RequestVote()
+			r.campaign()
 		}
 	case StateCandidate:
 		r.electionElapsed++
 		if r.electionElapsed >= r.electionTimeout {
 			// 超时, 重新选举
-			r.becomeCandidate()
-			r.RequestVote()
+			r.campaign()
 		}
 	case StateLeader:
+		r.electionElapsed++
+		if r.electionElapsed >= r.electionTimeout {
+			r.electionElapsed = 0
+			// 转移目标在一个选举超时内没有当选, 放弃转移, 恢复接收proposal
+			r.abortLeaderTransfer()
+			// 每个选举周期检查一次是否还能联系到多数节点
+			r.quorumLost = !r.quorumActive()
+			for id, pr := range r.Prs {
+				if id != r.id {
+					pr.RecentActive = false
+				}
+			}
+		}
+		// 重试未被确认的snapshot
+		for id, pr := range r.Prs {
+			if id == r.id || pr.PendingSnapshot == 0 {
+				continue
+			}
+			pr.snapshotElapsed++
+			if pr.snapshotElapsed >= snapshotTimeout*r.heartbeatTimeout {
+				// 长时间没有确认, 放弃这个snapshot, 之后按probe重新探测
+				pr.abortSnapshot()
+				continue
+			}
+			pr.retryElapsed++
+			if pr.retryElapsed >= pr.retryBackoff {
+				r.trySendSnapshot(id)
+			}
+		}
 		r.heartbeatElapsed++
 		if r.heartbeatElapsed >= r.heartbeatTimeout {
 			r.heartbeatElapsed = 0
-			for id := range r.Prs {
-				if id == r.id {
-					continue
-				}
-				r.sendHeartbeat(id)
-			}
+			r.bcastHeartbeat()
 		}
 	}
 }
@@ -278,11 +644,22 @@ func (r *Raft) tick() {
 func (r *Raft) becomeFollower(term uint64, lead uint64) {
 	// Your Code Here (2A).
 	r.State = StateFollower
+	// 同一任期内只能投一次票, 任期不变时保留已投的票
+	if term != r.Term {
+		r.Vote = None
+	}
 	r.Term = term
 	r.Lead = lead
-	r.Vote = None
 
 	r.electionElapsed = 0
+	r.abortLeaderTransfer()
+	// 不再是leader, 等待确认的只读请求全部丢弃
+	r.readOnly = newReadOnly()
+}
+
+// abortLeaderTransfer stops an in-progress leader transfer.
+func (r *Raft) abortLeaderTransfer() {
+	r.leadTransferee = None
 }
 
 // becomeCandidate transform this peer's state to candidate
@@ -296,10 +673,25 @@ func (r *Raft) becomeCandidate() {
 	r.voteCount = 1
 	r.rejectCount = 0
 
-	r.electionTimeout = r.baseTimeout + rand.IntN(r.baseTimeout)
+	r.electionTimeout = r.baseTimeout + r.randomTimeout(r.baseTimeout) + r.tieBreak()
 	// Send RequestVote RPCs to all other servers
 }
 
+// tieBreak 返回PreferLowerID开启时额外等待的tick数, 即组内id比自己小的节点数,
+// 这样超时相同时id最小的节点总是最先发起选举
+func (r *Raft) tieBreak() int {
+	if !r.preferLowerID {
+		return 0
+	}
+	rank := 0
+	for id := range r.Prs {
+		if id < r.id {
+			rank++
+		}
+	}
+	return rank
+}
+
 // becomeLeader transform this peer's state to leader
 func (r *Raft) becomeLeader() {
 	// Your Code Here (2A).
@@ -307,14 +699,23 @@ func (r *Raft) becomeLeader() {
 	r.State = StateLeader
 	r.Lead = r.id
 	r.heartbeatElapsed = 0
-
-	noop := pb.Entry{
-		Term:  r.Term,
-		Index: r.RaftLog.LastIndex() + 1,
-		Data:  nil,
+	r.electionElapsed = 0
+	r.quorumLost = false
+
+	// 之前任期确认的Match在本任期不再可信, follower的日志可能已被其他leader覆盖
+	last := r.RaftLog.LastIndex()
+	for id, pr := range r.Prs {
+		if id != r.id {
+			pr.Match = 0
+			pr.Next = max(min(pr.Next, last+1), 1)
+		}
 	}
+	r.appendEntry(&pb.Entry{Data: nil})
 
-	r.RaftLog.entries = append(r.RaftLog.entries, noop)
+	// 只有一个节点时noop无需等待其他节点, 直接commit
+	if len(r.Prs) == 1 {
+		r.RaftLog.committed = r.RaftLog.LastIndex()
+	}
 
 	for id := range r.Prs {
 		if id == r.id {
@@ -326,9 +727,24 @@ func (r *Raft) becomeLeader() {
 	// r.Step(pb.Message{MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{&noop}})
 }
 
+// appendEntry 以当前term追加新的entry, 开启entryChecksum时给每个entry加上checksum,
+// 包括没有数据的entry。checksum加在entry的副本上, 调用者的entry不会被修改
+func (r *Raft) appendEntry(ents ...*pb.Entry) uint64 {
+	if r.entryChecksum {
+		summed := make([]*pb.Entry, 0, len(ents))
+		for _, ent := range ents {
+			ent := *ent
+			ent.Data = appendChecksum(ent.Data)
+			summed = append(summed, &ent)
+		}
+		ents = summed
+	}
+	return r.RaftLog.appendEntry(r.Term, ents...)
+}
+
 // updateCommit 更新commitIndex
 // reference: https://github.com/RinChanNOWWW/tinykv-impl/blob/master/raft/raft.go#L791
-func (r *Raft) updateCommit() {
+func (r *Raft) updateCommit() bool {
 	commitUpdate := false
 	for i := r.RaftLog.committed + 1; i <= r.RaftLog.LastIndex(); i++ {
 		matchCount := 0
@@ -338,10 +754,7 @@ func (r *Raft) updateCommit() {
 			}
 		}
 
-		// leader only commit on it's current term (5.4.2)
-		term, _ := r.RaftLog.Term(i)
-		if matchCount > len(r.Prs)/2 && term == r.Term && r.RaftLog.committed != i {
-			r.RaftLog.committed = i
+		if matchCount > len(r.Prs)/2 && r.RaftLog.maybeCommit(i, r.Term) {
 			commitUpdate = true
 		}
 	}
@@ -349,18 +762,68 @@ func (r *Raft) updateCommit() {
 	// The tests assume that once the leader advances its commit index,
 	// it will broadcast the commit index by MessageType_MsgAppend messages.
 	// https://github.com/talent-plan/tinykv/pull/302
+	// 已经有全部已提交日志、并且报告过的committed不落后的节点无需再通知
 	if commitUpdate {
-		for id := range r.Prs {
-			if id == r.id {
+		for id, pr := range r.Prs {
+			if id == r.id || !r.lagsCommit(pr) {
 				continue
 			}
 			r.sendAppend(id)
 		}
 	}
+	return commitUpdate
+}
+
+// lagsCommit reports whether pr is missing committed entries or hasn't been
+// told the current commit index yet.
+func (r *Raft) lagsCommit(pr *Progress) bool {
+	committed := r.RaftLog.committed
+	return pr.Match < committed || pr.Committed < committed
+}
+
+// quorumActive reports whether the leader itself and the peers it heard from
+// during the current election timeout form a quorum.
+func (r *Raft) quorumActive() bool {
+	active := 0
+	for id, pr := range r.Prs {
+		if id == r.id || pr.RecentActive {
+			active++
+		}
+	}
+	return active > len(r.Prs)/2
+}
+
+// ApplyLag returns the number of committed entries that have not been applied
+// to the state machine yet.
+func (r *Raft) ApplyLag() uint64 {
+	if r.RaftLog.committed <= r.RaftLog.applied {
+		return 0
+	}
+	return r.RaftLog.committed - r.RaftLog.applied
+}
+
+// StepDown makes the leader give up its leadership at the current term without
+// a transfer target, no peer needs to be up to date. It stays a follower with no
+// leader and keeps its vote, so it can't win this term again. It sends nothing:
+// the followers stop hearing heartbeats and elect a new leader once their
+// election timeout passes. It does nothing if r is not the leader.
+func (r *Raft) StepDown() {
+	if r.State == StateLeader {
+		r.becomeFollower(r.Term, None)
+	}
+}
+
+// campaign 在选举超时后发起选举, tick无法返回错误, 只能记录日志
+func (r *Raft) campaign() {
+	r.becomeCandidate()
+	if err := r.RequestVote(); err != nil {
+		log.Printf("%d failed to campaign at term %d: %v", r.id, r.Term, err)
+	}
 }
 
 // RequestVote 请求所有其他节点投票
-func (r *Raft) RequestVote() {
+func (r *Raft) RequestVote() error {
+	logTerm := r.RaftLog.lastTerm()
 	for id := range r.Prs {
 		if id == r.id {
 			continue
@@ -368,7 +831,6 @@ func (r *Raft) RequestVote() {
 		// 初始化投票记录
 		r.votes[id] = false
 
-		logTerm, _ := r.RaftLog.Term(r.RaftLog.LastIndex())
 		msg := pb.Message{
 			MsgType: pb.MessageType_MsgRequestVote,
 			From:    r.id,
@@ -383,20 +845,28 @@ func (r *Raft) RequestVote() {
 	if len(r.Prs) == 1 {
 		r.becomeLeader()
 	}
+	return nil
 }
 
-// HandleMsgPropose 处理Propose消息
-func (r *Raft) HandleMsgPropose(m pb.Message) {
-	if len(m.Entries) == 0 {
-		// TODO:处理空消息
-		log.Println("entries is empty")
+// HandleMsgPropose 处理Propose消息, 依赖RawNode的单goroutine模型, entry按顺序
+// 获得LastIndex之后连续的index。m.Term非0时表示proposer认为的leader term,
+// 与当前term不一致说明leader已经变更, proposal被拒绝
+func (r *Raft) HandleMsgPropose(m pb.Message) error {
+	if m.Term != None && m.Term != r.Term {
+		return fmt.Errorf("%w: proposed for term %d, leader is at term %d", ErrProposalDropped, m.Term, r.Term)
 	}
-
 	for _, entry := range m.Entries {
-		entry.Term = r.Term
-		entry.Index = r.RaftLog.LastIndex() + 1
-
-		r.RaftLog.entries = append(r.RaftLog.entries, *entry)
+		if entry.EntryType == pb.EntryType_EntryConfChange && r.hasPendingConf() {
+			// 同一时间只允许一个未应用的配置变更, 多余的变更替换为空日志
+			*entry = pb.Entry{EntryType: pb.EntryType_EntryNormal}
+		}
+		r.appendEntry(entry)
+		if r.proposalCtx != nil {
+			if r.entryCtxs == nil {
+				r.entryCtxs = make(map[uint64]entryCtx)
+			}
+			r.entryCtxs[entry.Index] = entryCtx{term: entry.Term, ctx: r.proposalCtx}
+		}
 	}
 
 	// 如果只有一个节点, 则直接commit
@@ -410,10 +880,81 @@ func (r *Raft) HandleMsgPropose(m pb.Message) {
 		}
 		r.sendAppend(id)
 	}
+	return nil
+}
+
+// entryCtx 记录带context提交的entry的term, index相同但term不同说明entry已被新leader覆盖
+type entryCtx struct {
+	term uint64
+	ctx  []byte
+}
+
+// checkEntries 在追加到日志前检查proposal中的entry, 拒绝空的proposal、超过
+// maxEntrySize的entry以及无法解析的配置变更
+func (r *Raft) checkEntries(ents []*pb.Entry) error {
+	if len(ents) == 0 {
+		return fmt.Errorf("%w: proposal has no entries", ErrInvalidEntry)
+	}
+	for i, ent := range ents {
+		if ent == nil {
+			return fmt.Errorf("%w: entry %d is nil", ErrInvalidEntry, i)
+		}
+		if r.maxEntrySize != 0 && uint64(len(ent.Data)) > r.maxEntrySize {
+			return fmt.Errorf("%w: entry %d has %d bytes of data, more than %d", ErrInvalidEntry, i, len(ent.Data), r.maxEntrySize)
+		}
+		if ent.EntryType == pb.EntryType_EntryConfChange {
+			var cc pb.ConfChange
+			if err := cc.Unmarshal(ent.Data); err != nil {
+				return fmt.Errorf("%w: entry %d is not a valid conf change: %v", ErrInvalidEntry, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// followerLagging 判断最慢的节点是否落后超过maxFollowerLag, 是则暂停接收新的proposal
+func (r *Raft) followerLagging() bool {
+	if r.maxFollowerLag == 0 {
+		return false
+	}
+	last := r.RaftLog.LastIndex()
+	for id, pr := range r.Prs {
+		if id != r.id && last-min(pr.Match, last) >= r.maxFollowerLag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUncommittedSize 统计(committed, lastIndex]中entry数据的总字节数,
+// 超过maxUncommittedSize时拒绝新的proposal
+func (r *Raft) checkUncommittedSize() error {
+	if r.maxUncommittedSize == 0 {
+		return nil
+	}
+	size := uint64(0)
+	for _, ent := range r.RaftLog.slice(r.RaftLog.committed+1, r.RaftLog.LastIndex()+1) {
+		size += uint64(len(ent.Data))
+	}
+	if size > r.maxUncommittedSize {
+		return fmt.Errorf("%w: %w: %d bytes uncommitted, limit %d", ErrProposalDropped, ErrTooManyUncommittedEntries, size, r.maxUncommittedSize)
+	}
+	return nil
+}
+
+// hasPendingConf reports whether a conf change entry is in the log but not
+// applied yet, i.e. in (applied, lastIndex].
+func (r *Raft) hasPendingConf() bool {
+	for _, ent := range r.RaftLog.allEntries() {
+		if ent.Index > r.RaftLog.applied && ent.EntryType == pb.EntryType_EntryConfChange {
+			return true
+		}
+	}
+	return false
 }
 
 // HandleRequestVote 处理投票请求
-func (r *Raft) HandleRequestVote(m pb.Message) {
+func (r *Raft) HandleRequestVote(m pb.Message) error {
 	msg := pb.Message{
 		MsgType: pb.MessageType_MsgRequestVoteResponse,
 		From:    r.id,
@@ -424,18 +965,27 @@ func (r *Raft) HandleRequestVote(m pb.Message) {
 	// 1. Reply false if term < currentTerm (§5.1)
 	if m.Term < r.Term {
 		r.msgs = append(r.msgs, msg)
-		return
+		return nil
+	}
+	// 任期更大时无论是否投票都先转为follower, 但只有投出选票才重置选举计时,
+	// 否则日志落后的candidate会不断推迟其他节点的选举
+	if m.Term > r.Term {
+		elapsed := r.electionElapsed
+		r.becomeFollower(m.Term, None)
+		r.electionElapsed = elapsed
+		msg.Term = r.Term
 	}
 	// the voter denies its vote if its own log is more up-to-date than that of the candidate.
-	if m.LogTerm < r.RaftLog.entries[r.RaftLog.LastIndex()].Term {
+	lastTerm := r.RaftLog.lastTerm()
+	if m.LogTerm < lastTerm {
 		// 如果两个日志的最后条目属于不同的任期，那么拥有较大任期的日志被认为是更新的。
 		r.msgs = append(r.msgs, msg)
-		return
+		return nil
 	}
-	if m.LogTerm == r.RaftLog.entries[r.RaftLog.LastIndex()].Term && m.Index < r.RaftLog.LastIndex() {
+	if m.LogTerm == lastTerm && m.Index < r.RaftLog.LastIndex() {
 		// 如果两个日志的最后条目属于相同的任期，那么日志更长的那个被认为是更新的。
 		r.msgs = append(r.msgs, msg)
-		return
+		return nil
 	}
 
 	// 2. If votedFor is null or candidateId, and candidate’s log is at
@@ -443,19 +993,22 @@ func (r *Raft) HandleRequestVote(m pb.Message) {
 	if r.Vote == None || r.Vote == m.From {
 		msg.Reject = false
 	}
-	if m.Term > r.Term {
-		r.becomeFollower(m.Term, m.From)
-		msg.Reject = false
-	}
 	if !msg.Reject {
 		r.Vote = m.From
 		r.votes[m.From] = true
+		// 投出选票后重置选举计时, 避免立刻超时与刚支持的candidate竞争
+		r.electionElapsed = 0
 	}
 	r.msgs = append(r.msgs, msg)
+	return nil
 }
 
 // HandleVoteResponse 处理投票响应
 func (r *Raft) HandleVoteResponse(m pb.Message) {
+	// 已被移除或者未知的节点的投票不计入
+	if r.Prs[m.From] == nil {
+		return
+	}
 	if m.Term > r.Term {
 		r.becomeFollower(m.Term, m.From)
 		r.Vote = None
@@ -482,104 +1035,356 @@ func (r *Raft) HandleVoteResponse(m pb.Message) {
 	}
 }
 
+// reportUnreachable 传输层发送消息给to失败, 不再确定其日志的位置, 退回Probe
+func (r *Raft) reportUnreachable(to uint64) {
+	pr := r.Prs[to]
+	if r.State != StateLeader || pr == nil {
+		return
+	}
+	if pr.State == ProgressStateReplicate {
+		pr.State = ProgressStateProbe
+		pr.Next = pr.Match + 1
+	}
+}
+
+// reportSnapshot 传输层发送snapshot给to结束, 失败时清除PendingSnapshot以便下次
+// 立即重发, 成功时等待to的append响应确认snapshot已应用
+func (r *Raft) reportSnapshot(to uint64, status SnapshotStatus) {
+	pr := r.Prs[to]
+	if r.State != StateLeader || pr == nil {
+		return
+	}
+	if status == SnapshotFailure {
+		pr.abortSnapshot()
+		return
+	}
+	pr.State = ProgressStateProbe
+}
+
 // HandleAppendResponse 处理AppendEntries响应
 func (r *Raft) HandleAppendResponse(m pb.Message) {
-	if m.Reject {
-		// TODO
+	// removeNode之后仍可能收到被移除节点迟到的响应, 它已经没有Progress
+	if r.Prs[m.From] == nil {
+		return
+	}
+	// 之前任期的响应回复的是旧leader发出的append, 其Index与当前的日志无关,
+	// 用它更新Progress会让Match/Next出错
+	if m.Term < r.Term {
+		return
+	}
+	if m.Reject && m.LogTerm != 0 {
+		// follower在m.LogTerm上冲突, leader有这个term的日志时从其中最后一条开始探测,
+		// 否则跳过follower这个term的全部日志
+		if _, last, ok := r.RaftLog.entriesInTerm(m.LogTerm); ok {
+			m.Index = last
+		}
 	}
-	// 更新pr, m.Index是follower.RaftLog.LastIndex()
 	pr := r.Prs[m.From]
-	pr.Match = m.Index
-	pr.Next = m.Index + 1
-	r.Prs[m.From] = pr
+	// 响应可能乱序到达, follower的committed不会后退
+	pr.Committed = max(pr.Committed, m.Commit)
+	if m.Reject {
+		// 拒绝时m.Index只是follower给出的探测位置, 没有经过验证, 只能用来回退Next,
+		// 不能更新Match, 否则updateCommit会把未复制的日志算进多数派
+		pr.Next = max(min(pr.Next-1, m.Index+1), pr.Match+1)
+		pr.RejectStreak++
+	} else {
+		// 接受时m.Index是follower与leader一致的最后一条日志
+		pr.Match = max(pr.Match, m.Index)
+		pr.Next = pr.Match + 1
+		pr.State = ProgressStateReplicate
+		pr.RejectStreak = 0
+		pr.PendingSnapshot = 0
+		pr.retryBackoff = 0
+		pr.retryElapsed = 0
+	}
+
+	// 每条消息的entry数量受限时follower可能还没收到全部日志, 继续发送下一批,
+	// commit推进时updateCommit已经向落后的节点发送过append
+	if m.From == r.leadTransferee && !m.Reject && pr.Match == r.RaftLog.LastIndex() {
+		r.sendTimeoutNow(m.From)
+	}
+	broadcast := r.updateCommit()
+	if r.maxEntriesPerMsg != 0 && !m.Reject && pr.Next <= r.RaftLog.LastIndex() && !(broadcast && r.lagsCommit(pr)) {
+		r.sendAppend(m.From)
+	}
+}
+
+// loadState restores the term, vote and commit index persisted in hs. Neither
+// the commit index nor the term may go backwards, and the commit index must be
+// covered by the log, otherwise the storage is corrupted and loadState panics.
+func (r *Raft) loadState(hs pb.HardState) {
+	if hs.Commit < r.RaftLog.committed || hs.Commit > r.RaftLog.LastIndex() {
+		panic(fmt.Sprintf("%d hardState.Commit %d is out of range [%d, %d]", r.id, hs.Commit, r.RaftLog.committed, r.RaftLog.LastIndex()))
+	}
+	if hs.Term < r.Term {
+		panic(fmt.Sprintf("%d hardState.Term %d is behind the current term %d", r.id, hs.Term, r.Term))
+	}
+	r.RaftLog.committed = hs.Commit
+	r.Term = hs.Term
+	r.Vote = hs.Vote
+}
+
+// softState returns the volatile state reported in Ready.
+func (r *Raft) softState() SoftState {
+	return SoftState{Lead: r.Lead, RaftState: r.State}
+}
+
+// hardState returns the state that must be persisted before messages are sent.
+func (r *Raft) hardState() pb.HardState {
+	return pb.HardState{Term: r.Term, Vote: r.Vote, Commit: r.RaftLog.committed}
+}
 
-	r.updateCommit()
+// readMessages takes the outgoing messages, leaving r.msgs empty. The returned
+// slice is no longer shared with r, so messages generated afterwards are never
+// lost or seen twice by the caller.
+func (r *Raft) readMessages() []pb.Message {
+	msgs := r.msgs
+	r.msgs = make([]pb.Message, 0)
+	return msgs
+}
+
+// checkPendingMessages 待发送的消息超过maxPendingMessages时打印一次警告,
+// 队列回落到上限以下后重新计数
+func (r *Raft) checkPendingMessages() {
+	if r.maxPendingMessages == 0 {
+		return
+	}
+	over := len(r.msgs) > r.maxPendingMessages
+	if over && !r.msgsOverCap {
+		log.Printf("%d has %d pending messages, more than %d; is the transport draining Ready?", r.id, len(r.msgs), r.maxPendingMessages)
+	}
+	r.msgsOverCap = over
+}
+
+// notifyApply 在committed前进并超过applied时向applyc发送信号, applyc已有
+// 未取走的信号时不阻塞, 多次前进合并为一个信号
+func (r *Raft) notifyApply() {
+	if r.applyc == nil {
+		return
+	}
+	committed := r.RaftLog.committed
+	if committed <= r.RaftLog.applied || committed <= r.notifiedCommit {
+		return
+	}
+	r.notifiedCommit = committed
+	select {
+	case r.applyc <- struct{}{}:
+	default:
+	}
 }
 
 // Step the entrance of handle message, see `MessageType`
 // on `eraftpb.proto` for what msgs should be handled
+//
+// Errors of a sub-handler are wrapped with the message type, messages the
+// node deliberately ignores fail with a wrapped ErrDropped. The errors of a
+// proposal are returned as is, so the proposer can compare them.
 func (r *Raft) Step(m pb.Message) error {
+	defer r.checkPendingMessages()
+	defer r.notifyApply()
+	err := r.step(m)
+	if err == nil || m.MsgType == pb.MessageType_MsgPropose {
+		return err
+	}
+	return fmt.Errorf("raft: handling %s: %w", m.MsgType, err)
+}
+
+func (r *Raft) step(m pb.Message) error {
+	// 节点不会通过网络响应自己, 来自自己的响应只能是误投递的消息, 处理它们会
+	// 重复计票或者把自己当作follower更新Progress, 自己的一票只在becomeCandidate中计入。
+	// 来自自己的请求照常处理, 产生的响应会在这里被丢弃
+	if m.From == r.id && IsResponseMsg(m.MsgType) {
+		return r.dropped(m)
+	}
 	switch r.State {
 	case StateFollower:
 		switch m.MsgType {
 		case pb.MessageType_MsgHup:
 			r.becomeCandidate()
-			r.RequestVote()
+			return r.RequestVote()
 		case pb.MessageType_MsgRequestVoteResponse:
 			r.HandleVoteResponse(m)
 		case pb.MessageType_MsgAppend:
-			r.handleAppendEntries(m)
+			return r.handleAppendEntries(m)
+		case pb.MessageType_MsgSnapshot:
+			return r.handleSnapshot(m)
 		case pb.MessageType_MsgRequestVote:
-			r.HandleRequestVote(m)
+			return r.HandleRequestVote(m)
 		case pb.MessageType_MsgHeartbeat:
 			r.handleHeartbeat(m)
+		case pb.MessageType_MsgTransferLeader:
+			return r.forwardTransferLeader(m)
+		case pb.MessageType_MsgTimeoutNow:
+			return r.handleTimeoutNow(m)
+		case pb.MessageType_MsgPropose:
+			return ErrNotLeader{LeaderHint: r.Lead}
+		default:
+			return r.dropped(m)
 		}
 		return nil
 	case StateCandidate:
 		switch m.MsgType {
+		case pb.MessageType_MsgPropose:
+			return ErrNotLeader{LeaderHint: None}
 		case pb.MessageType_MsgHup:
 			r.becomeCandidate()
-			r.RequestVote()
+			return r.RequestVote()
 		case pb.MessageType_MsgRequestVoteResponse:
 			r.HandleVoteResponse(m)
 		case pb.MessageType_MsgAppend:
+			return r.handleAppendEntries(m)
+		case pb.MessageType_MsgSnapshot:
+			return r.handleSnapshot(m)
+		case pb.MessageType_MsgRequestVote:
+			return r.HandleRequestVote(m)
+		case pb.MessageType_MsgHeartbeat:
 			if m.Term >= r.Term {
 				r.becomeFollower(m.Term, m.From)
 			}
-			r.handleAppendEntries(m)
-		case pb.MessageType_MsgRequestVote:
-			r.HandleRequestVote(m)
-		case pb.MessageType_MsgHeartbeat:
 			r.handleHeartbeat(m)
+		default:
+			return r.dropped(m)
 		}
 		return nil
 	case StateLeader:
+		if pr := r.Prs[m.From]; pr != nil && m.From != r.id && IsResponseMsg(m.MsgType) {
+			pr.RecentActive = true
+			if r.quorumLost {
+				r.quorumLost = !r.quorumActive()
+			}
+		}
 		switch m.MsgType {
 		case pb.MessageType_MsgPropose:
-			r.HandleMsgPropose(m)
+			if r.checkQuorum && r.quorumLost {
+				return ErrProposalDropped
+			}
+			if r.followerLagging() {
+				return ErrProposalDropped
+			}
+			if err := r.checkUncommittedSize(); err != nil {
+				return err
+			}
+			if err := r.checkEntries(m.Entries); err != nil {
+				return err
+			}
+			// 转移期间新的日志会让转移目标一直追不上
+			if r.leadTransferee != None {
+				return ErrProposalDropped
+			}
+			return r.HandleMsgPropose(m)
 		case pb.MessageType_MsgRequestVoteResponse:
 			r.HandleVoteResponse(m)
 		case pb.MessageType_MsgAppend:
-			if m.Term > r.Term {
-				r.becomeFollower(m.Term, m.From)
-			}
-			r.handleAppendEntries(m)
+			return r.handleAppendEntries(m)
 		case pb.MessageType_MsgRequestVote:
-			r.HandleRequestVote(m)
+			// 转移目标发起的选举同样要比较日志(§5.4.1), 任期更大时becomeFollower会结束转移
+			return r.HandleRequestVote(m)
 		case pb.MessageType_MsgHeartbeat:
 			r.handleHeartbeat(m)
 		case pb.MessageType_MsgBeat:
-			for id := range r.Prs {
-				if id == r.id {
-					continue
-				}
-				r.sendHeartbeat(id)
-			}
+			r.bcastHeartbeat()
 		case pb.MessageType_MsgAppendResponse:
 			r.HandleAppendResponse(m)
+		case pb.MessageType_MsgHeartbeatResponse:
+			r.handleHeartbeatResponse(m)
+		case pb.MessageType_MsgTransferLeader:
+			return r.handleTransferLeader(m)
+		default:
+			return r.dropped(m)
 		}
 	}
 	return nil
 }
 
+// dropped 返回节点当前状态不处理的消息对应的错误
+func (r *Raft) dropped(m pb.Message) error {
+	return fmt.Errorf("%w: %s %d ignores it at term %d", ErrDropped, r.State, r.id, r.Term)
+}
+
+// forwardTransferLeader 将follower收到的MsgTransferLeader转发给leader,
+// 这样客户端无需知道当前的leader也能发起leader转移
+func (r *Raft) forwardTransferLeader(m pb.Message) error {
+	if r.Lead == None {
+		return fmt.Errorf("%w: %d has no leader at term %d", ErrDropped, r.id, r.Term)
+	}
+	// m.From是转移目标, 转发时保持不变
+	m.To = r.Lead
+	r.msgs = append(r.msgs, m)
+	return nil
+}
+
+// handleTransferLeader 开始把leader转移给m.From: 目标的日志已经是最新时立即
+// 发送MsgTimeoutNow, 否则先补齐日志, 在HandleAppendResponse中追上后再发送。
+// 转移给自己会取消正在进行的转移, 转移在一个选举超时内没有完成也会被取消
+func (r *Raft) handleTransferLeader(m pb.Message) error {
+	transferee := m.From
+	if transferee == r.id {
+		r.abortLeaderTransfer()
+		return nil
+	}
+	pr := r.Prs[transferee]
+	if pr == nil {
+		return fmt.Errorf("%w: transferee %d is not a member", ErrDropped, transferee)
+	}
+	if r.leadTransferee == transferee {
+		return nil
+	}
+	r.leadTransferee = transferee
+	r.electionElapsed = 0
+	if pr.Match == r.RaftLog.LastIndex() {
+		r.sendTimeoutNow(transferee)
+	} else {
+		r.sendAppend(transferee)
+	}
+	return nil
+}
+
+// sendTimeoutNow 让转移目标立即发起选举
+func (r *Raft) sendTimeoutNow(to uint64) {
+	r.msgs = append(r.msgs, pb.Message{
+		MsgType: pb.MessageType_MsgTimeoutNow,
+		From:    r.id,
+		To:      to,
+		Term:    r.Term,
+	})
+}
+
+// handleTimeoutNow 收到leader转移的MsgTimeoutNow后立即发起选举,
+// 已被移除的节点不在Prs中, 不能参与选举, 直接丢弃该消息
+func (r *Raft) handleTimeoutNow(m pb.Message) error {
+	if _, ok := r.Prs[r.id]; !ok {
+		return fmt.Errorf("%w: %d is not a voter at term %d", ErrDropped, r.id, r.Term)
+	}
+	r.becomeCandidate()
+	return r.RequestVote()
+}
+
 // handleAppendEntries handle AppendEntries RPC request
-func (r *Raft) handleAppendEntries(m pb.Message) {
+func (r *Raft) handleAppendEntries(m pb.Message) error {
 	// Your Code Here (2A).
-	// msg.index是用来帮助Leader更新follower的pr的
+	// msg.index是用来帮助Leader更新follower的pr的, msg.Commit带上自己的committed,
+	// 让leader知道follower的提交进度
 	msg := &pb.Message{
 		MsgType: pb.MessageType_MsgAppendResponse,
 		From:    r.id,
 		To:      m.From,
 		Term:    m.Term,
 		Reject:  false,
+		Commit:  r.RaftLog.committed,
 	}
 	if r.Term > m.Term {
 		msg.Reject = true
 		msg.Term = r.Term
 		r.msgs = append(r.msgs, *msg)
-		return
+		return nil
+	}
+	// 先转为follower再修改日志, 否则过期的leader或candidate会在保持自身状态的同时接受别人的日志
+	if r.State != StateFollower || m.Term != r.Term {
+		r.becomeFollower(m.Term, m.From)
+	} else {
+		r.Lead = m.From
+		r.electionElapsed = 0
 	}
-	r.Term = m.Term
 
 	// TODO
 	// if len(m.Entries) == 0 {
@@ -591,21 +1396,37 @@ func (r *Raft) handleAppendEntries(m pb.Message) {
 		msg.Reject = true
 		msg.Index = r.RaftLog.LastIndex()
 		r.msgs = append(r.msgs, *msg)
-		return
+		return nil
 	}
-	if m.LogTerm != r.RaftLog.entries[m.Index].Term {
+	if term, err := r.RaftLog.Term(m.Index); err != nil || m.LogTerm != term {
 		msg.Reject = true
 		msg.Index = m.Index - 1
+		// 带上冲突的term并跳过本地这个term的全部日志, leader据此一次回退一个term而不是一条日志
+		if first, _, ok := r.RaftLog.entriesInTerm(term); err == nil && ok && first <= m.Index {
+			msg.LogTerm = term
+			msg.Index = first - 1
+		}
 		r.msgs = append(r.msgs, *msg)
-		return
+		return nil
 	}
 
 	// 检查冲突
 	for i, j := m.Index+1, 0; i <= r.RaftLog.LastIndex() && j < len(m.Entries); i, j = i+1, j+1 {
-		if r.RaftLog.entries[i].Term != m.Entries[j].Term {
-			r.RaftLog.entries = r.RaftLog.entries[:i]
-			// 如果冲突的日志在已提交的日志之前, 则
-			r.RaftLog.stabled = min(r.RaftLog.stabled, i-1)
+		term, err := r.RaftLog.Term(i)
+		if err != nil {
+			return err
+		}
+		if term != m.Entries[j].Term {
+			// 已提交的日志不可能冲突, 出现冲突说明leader有bug, 拒绝而不是截断
+			if i <= r.RaftLog.committed {
+				log.Printf("%d rejects append from %d conflicting at committed index %d (committed %d)",
+					r.id, m.From, i, r.RaftLog.committed)
+				msg.Reject = true
+				msg.Index = r.RaftLog.committed
+				r.msgs = append(r.msgs, *msg)
+				return nil
+			}
+			r.RaftLog.truncate(i)
 			break
 		}
 	}
@@ -615,15 +1436,15 @@ func (r *Raft) handleAppendEntries(m pb.Message) {
 	for i := begin; i < uint64(len(m.Entries)); i++ {
 		r.RaftLog.entries = append(r.RaftLog.entries, *m.Entries[i])
 	}
-	msg.Index = r.RaftLog.LastIndex()
-	r.msgs = append(r.msgs, *msg)
-
 	// 更新commitIndex
 	if m.Commit > r.RaftLog.committed {
 		// log.Println("m.commit", m.Commit, "r.RaftLog.LastIndex()", r.RaftLog.LastIndex())
 		r.RaftLog.committed = min(m.Commit, r.RaftLog.LastIndex())
 	}
-
+	msg.Index = r.RaftLog.LastIndex()
+	msg.Commit = r.RaftLog.committed
+	r.msgs = append(r.msgs, *msg)
+	return nil
 }
 
 // handleHeartbeat handle Heartbeat RPC request
@@ -634,6 +1455,9 @@ func (r *Raft) handleHeartbeat(m pb.Message) {
 		From:    r.id,
 		To:      m.From,
 		Term:    r.Term,
+		Commit:  r.RaftLog.committed,
+		// 原样返回leader附带的只读请求ctx
+		Entries: m.Entries,
 	}
 	if m.Term < r.Term {
 		msg.Reject = true
@@ -643,20 +1467,187 @@ func (r *Raft) handleHeartbeat(m pb.Message) {
 		msg.Reject = false
 		msg.Term = r.Term
 	}
+	if !msg.Reject {
+		// 收到当前leader的心跳, 重置选举计时
+		r.Lead = m.From
+		r.electionElapsed = 0
+	}
 	r.msgs = append(r.msgs, msg)
 }
 
+// handleHeartbeatResponse handle Heartbeat RPC response, a follower whose
+// commit index falls behind is sent the missing entries.
+func (r *Raft) handleHeartbeatResponse(m pb.Message) {
+	// 不是成员的节点既不需要append, 也不能确认只读请求
+	if r.Prs[m.From] == nil {
+		return
+	}
+	if m.Term > r.Term {
+		r.becomeFollower(m.Term, None)
+		return
+	}
+	if m.Commit < r.RaftLog.committed {
+		r.sendAppend(m.From)
+	}
+	if len(m.Entries) == 0 {
+		return
+	}
+	ctx := m.Entries[0].Data
+	if r.readOnly.recvAck(m.From, ctx, r.Prs) <= len(r.Prs)/2 {
+		return
+	}
+	for _, rs := range r.readOnly.advance(ctx) {
+		r.readStates = append(r.readStates, ReadState{Index: rs.index, RequestCtx: rs.ctx})
+	}
+}
+
+// readIndex records a read only request identified by ctx, it becomes a
+// ReadState with the current commit index once a quorum acknowledges the
+// leader's next heartbeat.
+func (r *Raft) readIndex(ctx []byte) error {
+	if r.State != StateLeader {
+		return ErrProposalDropped
+	}
+	// leader在当前任期提交过日志后才能确定自己的commit index是最新的
+	if r.RaftLog.MustTerm(r.RaftLog.committed) != r.Term {
+		return ErrProposalDropped
+	}
+	if len(r.Prs) == 1 {
+		r.readStates = append(r.readStates, ReadState{Index: r.RaftLog.committed, RequestCtx: ctx})
+		return nil
+	}
+	return r.readOnly.addRequest(r.RaftLog.committed, ctx, r.id)
+}
+
 // handleSnapshot handle Snapshot RPC request
-func (r *Raft) handleSnapshot(m pb.Message) {
+func (r *Raft) handleSnapshot(m pb.Message) error {
 	// Your Code Here (2C).
+	resp := pb.Message{
+		MsgType: pb.MessageType_MsgAppendResponse,
+		From:    r.id,
+		To:      m.From,
+		Term:    r.Term,
+		Commit:  r.RaftLog.committed,
+	}
+	if r.Term > m.Term {
+		resp.Reject = true
+		r.msgs = append(r.msgs, resp)
+		return nil
+	}
+	if r.State != StateFollower || m.Term != r.Term {
+		r.becomeFollower(m.Term, m.From)
+	} else {
+		r.Lead = m.From
+		r.electionElapsed = 0
+	}
+	// 回复必须带上更新后的任期, 否则leader会把它当作过期消息丢掉
+	resp.Term = r.Term
+	// snapshot在发送途中, follower已经通过append提交了它之后的日志, 应用它会丢掉
+	// 这些日志。忽略它并回复committed, leader据此直接把Match推进到committed
+	if m.Snapshot.GetMetadata().GetIndex() <= r.RaftLog.committed {
+		resp.Index = r.RaftLog.committed
+		r.msgs = append(r.msgs, resp)
+		return nil
+	}
+	meta := m.Snapshot.Metadata
+	r.RaftLog.compactTo(meta.Index, meta.Term)
+	r.RaftLog.pendingSnapshot = m.Snapshot
+	// 成员以snapshot中的ConfState为准
+	r.Prs = make(map[uint64]*Progress)
+	for _, id := range meta.ConfState.GetNodes() {
+		r.Prs[id] = &Progress{Next: r.RaftLog.LastIndex() + 1}
+	}
+	resp.Index = r.RaftLog.LastIndex()
+	resp.Commit = r.RaftLog.committed
+	r.msgs = append(r.msgs, resp)
+	return nil
 }
 
 // addNode add a new node to raft group
 func (r *Raft) addNode(id uint64) {
 	// Your Code Here (3A).
+	if _, ok := r.Prs[id]; !ok {
+		r.Prs[id] = &Progress{Match: 0, Next: r.RaftLog.LastIndex() + 1}
+	}
 }
 
 // removeNode remove a node from raft group
 func (r *Raft) removeNode(id uint64) {
 	// Your Code Here (3A).
+	if _, ok := r.Prs[id]; !ok {
+		return
+	}
+	delete(r.Prs, id)
+	delete(r.votes, id)
+	// 节点减少后法定人数变小, 可能有新的日志可以提交
+	if r.State == StateLeader && len(r.Prs) > 0 {
+		r.updateCommit()
+	}
+}
+
+// maxConfChangeHistory is the number of applied conf changes kept by Raft.
+const maxConfChangeHistory = 16
+
+// ConfChangeRecord describes a conf change applied to the raft group.
+type ConfChangeRecord struct {
+	// Index is the log index of the conf change entry, or 0 if the entry is
+	// no longer in the log.
+	Index      uint64
+	ChangeType pb.ConfChangeType
+	NodeId     uint64
+}
+
+// recordConfChange appends cc to the conf change history, dropping the
+// oldest record once the history is full.
+func (r *Raft) recordConfChange(index uint64, cc pb.ConfChange) {
+	r.confChanges = append(r.confChanges, ConfChangeRecord{
+		Index:      index,
+		ChangeType: cc.ChangeType,
+		NodeId:     cc.NodeId,
+	})
+	if n := len(r.confChanges); n > maxConfChangeHistory {
+		r.confChanges = append(r.confChanges[:0], r.confChanges[n-maxConfChangeHistory:]...)
+	}
+}
+
+// confChangeIndex returns the index of the committed conf change entry that
+// carries cc and follows the last recorded one. Conf changes are applied in
+// log order, so this is the entry being applied. Returns 0 if it can't be
+// found, e.g. because the log was compacted past it.
+func (r *Raft) confChangeIndex(cc pb.ConfChange) uint64 {
+	lo := r.RaftLog.firstIndex()
+	if n := len(r.confChanges); n > 0 {
+		lo = max(lo, r.confChanges[n-1].Index+1)
+	}
+	hi := r.RaftLog.committed + 1
+	if lo >= hi {
+		return 0
+	}
+	var index uint64
+	r.RaftLog.scanEntries(lo, hi, func(ent pb.Entry) bool {
+		if ent.EntryType != pb.EntryType_EntryConfChange {
+			return true
+		}
+		if r.entryChecksum {
+			var err error
+			if ent, err = verifyEntry(ent); err != nil {
+				return true
+			}
+		}
+		var logged pb.ConfChange
+		if logged.Unmarshal(ent.Data) == nil && logged.ChangeType == cc.ChangeType && logged.NodeId == cc.NodeId {
+			index = ent.Index
+			return false
+		}
+		return true
+	})
+	return index
+}
+
+// ConfChangeHistory returns the most recently applied conf changes in the
+// order they were applied.
+func (r *Raft) ConfChangeHistory() []ConfChangeRecord {
+	history := make([]ConfChangeRecord, len(r.confChanges))
+	copy(history, r.confChanges)
+	return history
 }
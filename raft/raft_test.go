@@ -16,9 +16,13 @@ package raft
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
@@ -48,13 +52,6 @@ type stateMachine interface {
 	readMessages() []pb.Message
 }
 
-func (r *Raft) readMessages() []pb.Message {
-	msgs := r.msgs
-	r.msgs = make([]pb.Message, 0)
-
-	return msgs
-}
-
 func TestProgressLeader2AB(t *testing.T) {
 	r := newTestRaft(1, []uint64{1, 2}, 5, 1, NewMemoryStorage())
 	r.becomeCandidate()
@@ -282,7 +279,7 @@ func TestLogReplication2AB(t *testing.T) {
 			sm := x.(*Raft)
 
 			if sm.RaftLog.committed != tt.wcommitted {
-				t.Errorf("#%d.%d: committed = %d, want %d", i, j, sm.RaftLog.committed, tt.wcommitted)
+				t.Errorf("#%d.%d: committed = %d, want %d\n%s", i, j, sm.RaftLog.committed, tt.wcommitted, tt.progressTable())
 			}
 
 			ents := []pb.Entry{}
@@ -490,6 +487,35 @@ func TestSingleNodeCandidate2AA(t *testing.T) {
 	}
 }
 
+// TestSingleNodeBootstrap2AA tests that a brand-new single node cluster
+// starts from empty storage with only the dummy entry in its log, and
+// elects itself leader within the election timeout.
+func TestSingleNodeBootstrap2AA(t *testing.T) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	if li := r.RaftLog.LastIndex(); li != 0 {
+		t.Fatalf("lastIndex = %d, want 0", li)
+	}
+	if n := len(r.RaftLog.allEntries()); n != 0 {
+		t.Fatalf("len(entries) = %d, want 0", n)
+	}
+	if term := mustTerm(r.RaftLog.Term(0)); term != 0 {
+		t.Fatalf("term of dummy entry = %d, want 0", term)
+	}
+
+	for i := 0; i < r.electionTimeout && r.State != StateLeader; i++ {
+		r.tick()
+	}
+	if r.State != StateLeader {
+		t.Fatalf("state = %s, want %s", r.State, StateLeader)
+	}
+	if r.Term != 1 {
+		t.Errorf("term = %d, want 1", r.Term)
+	}
+	if r.RaftLog.committed != 1 {
+		t.Errorf("committed = %d, want 1", r.RaftLog.committed)
+	}
+}
+
 func TestOldMessages2AB(t *testing.T) {
 	tt := newNetwork(nil, nil, nil)
 	// make 0 leader @ term 3
@@ -1093,6 +1119,55 @@ func TestRestoreFromSnapMsg2C(t *testing.T) {
 	}
 }
 
+// TestStaleSnapshotIgnored2C tests that a follower ignores a snapshot that
+// arrives after appends carried it past the snapshot's index, keeps its log,
+// and answers with its committed index so the leader can catch up its
+// progress of the follower.
+func TestStaleSnapshotIgnored2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	ents := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}, {Index: 4, Term: 1}, {Index: 5, Term: 1}}
+	storage.Append(ents)
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 5})
+	sm := newTestRaft(2, []uint64{1, 2}, 10, 1, storage)
+	sm.becomeFollower(1, 1)
+
+	s := pb.Snapshot{
+		Metadata: &pb.SnapshotMetadata{
+			Index:     3,
+			Term:      1,
+			ConfState: &pb.ConfState{Nodes: []uint64{1, 2}},
+		},
+	}
+	if err := sm.Step(pb.Message{MsgType: pb.MessageType_MsgSnapshot, From: 1, To: 2, Term: 1, Snapshot: &s}); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	if g := sm.RaftLog.allEntries(); !reflect.DeepEqual(g, ents) {
+		t.Errorf("entries = %+v, want %+v", g, ents)
+	}
+	if sm.RaftLog.committed != 5 {
+		t.Errorf("committed = %d, want 5", sm.RaftLog.committed)
+	}
+	wmsgs := []pb.Message{{MsgType: pb.MessageType_MsgAppendResponse, From: 2, To: 1, Term: 1, Index: 5, Commit: 5}}
+	msgs := sm.readMessages()
+	if !reflect.DeepEqual(msgs, wmsgs) {
+		t.Fatalf("msgs = %+v, want %+v", msgs, wmsgs)
+	}
+
+	// the leader that sent the snapshot moves the follower straight to its
+	// committed index
+	lead := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	lead.becomeCandidate()
+	lead.becomeLeader()
+	lead.RaftLog.appendEntry(1, &pb.Entry{}, &pb.Entry{}, &pb.Entry{}, &pb.Entry{})
+	lead.Prs[2].State = ProgressStateSnapshot
+	lead.Prs[2].PendingSnapshot = 3
+	lead.Step(msgs[0])
+	if pr := lead.Prs[2]; pr.Match != 5 || pr.State != ProgressStateReplicate || pr.PendingSnapshot != 0 {
+		t.Errorf("progress = %+v, want Match 5 replicating", pr)
+	}
+}
+
 func TestRestoreFromSnapWithOverlapingPeersMsg2C(t *testing.T) {
 	s := pb.Snapshot{
 		Metadata: &pb.SnapshotMetadata{
@@ -1449,6 +1524,43 @@ func TestLeaderTransferSecondTransferToAnotherNode3A(t *testing.T) {
 	checkLeaderTransferState(t, lead, StateFollower, 2)
 }
 
+// TestLeaderTransferForwardedByThirdNode3A tests that a transfer request for
+// node 2 that reaches follower 3 is forwarded to the leader and hands the
+// leadership to node 2, and that the transfer times out when the transferee
+// can't be reached.
+func TestLeaderTransferForwardedByThirdNode3A(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+
+	nt.send(pb.Message{From: 2, To: 3, MsgType: pb.MessageType_MsgTransferLeader})
+	lead := nt.peers[1].(*Raft)
+	checkLeaderTransferState(t, lead, StateFollower, 2)
+	if r := nt.peers[2].(*Raft); r.State != StateLeader {
+		t.Fatalf("node 2 state = %s, want leader", r.State)
+	}
+
+	// a transfer to an unreachable node blocks proposals until it times out
+	nt.isolate(3)
+	nt.send(pb.Message{From: 3, To: 2, MsgType: pb.MessageType_MsgTransferLeader})
+	r := nt.peers[2].(*Raft)
+	if r.leadTransferee != 3 {
+		t.Fatalf("leadTransferee = %d, want 3", r.leadTransferee)
+	}
+	if err := r.Step(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}}); !errors.Is(err, ErrProposalDropped) {
+		t.Errorf("propose during transfer: err = %v, want %v", err, ErrProposalDropped)
+	}
+	for i := 0; i < r.electionTimeout; i++ {
+		r.tick()
+	}
+	if r.leadTransferee != None {
+		t.Errorf("leadTransferee = %d after an election timeout, want %d", r.leadTransferee, None)
+	}
+	if err := r.Step(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}}); err != nil {
+		t.Errorf("propose after transfer timeout: err = %v, want nil", err)
+	}
+}
+
 func checkLeaderTransferState(t *testing.T, r *Raft, state StateType, lead uint64) {
 	if r.State != state || r.Lead != lead {
 		t.Fatalf("after transferring, node has state %v lead %v, want state %v lead %v", r.State, r.Lead, state, lead)
@@ -1470,6 +1582,31 @@ func TestTransferNonMember3A(t *testing.T) {
 	}
 }
 
+// TestTimeoutNowIgnoredByRemovedNode verifies that a node campaigns on
+// MessageType_MsgTimeoutNow only while it is still a voter of the group.
+func TestTimeoutNowIgnoredByRemovedNode3A(t *testing.T) {
+	tests := []struct {
+		remove bool
+		wstate StateType
+	}{
+		{false, StateCandidate},
+		{true, StateFollower},
+	}
+	for i, tt := range tests {
+		r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		if tt.remove {
+			r.removeNode(1)
+		}
+		r.Step(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgTimeoutNow, Term: r.Term})
+		if r.State != tt.wstate {
+			t.Errorf("#%d: state = %s, want %s", i, r.State, tt.wstate)
+		}
+		if msgs := r.readMessages(); tt.remove && len(msgs) != 0 {
+			t.Errorf("#%d: msgs = %+v, want none", i, msgs)
+		}
+	}
+}
+
 // TestSplitVote verifies that after split vote, cluster can complete
 // election in next round.
 func TestSplitVote2AA(t *testing.T) {
@@ -1543,155 +1680,2230 @@ func TestSplitVote2AA(t *testing.T) {
 	}
 }
 
-func entsWithConfig(configFunc func(*Config), id uint64, terms ...uint64) *Raft {
-	storage := NewMemoryStorage()
-	for i, term := range terms {
-		storage.Append([]pb.Entry{{Index: uint64(i + 1), Term: term}})
+// TestGrantVoteResetElectionElapsed2AA verifies that a follower granting its
+// vote restarts its election clock instead of campaigning against the
+// candidate it just supported, while a rejected request leaves it untouched.
+func TestGrantVoteResetElectionElapsed2AA(t *testing.T) {
+	tests := []struct {
+		vote    uint64
+		wreject bool
+	}{
+		{None, false},
+		// retransmitted request from the candidate already voted for
+		{2, false},
+		{3, true},
 	}
-	cfg := newTestConfig(id, []uint64{}, 5, 1, storage)
-	if configFunc != nil {
-		configFunc(cfg)
+	for i, tt := range tests {
+		r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		r.becomeFollower(1, None)
+		r.Vote = tt.vote
+		for j := 0; j < r.electionTimeout-1; j++ {
+			r.tick()
+		}
+
+		r.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgRequestVote})
+		msgs := r.readMessages()
+		if len(msgs) != 1 || msgs[0].Reject != tt.wreject {
+			t.Fatalf("#%d: msgs = %+v, want a single response with reject %v", i, msgs, tt.wreject)
+		}
+		welapsed := 0
+		if tt.wreject {
+			welapsed = r.electionTimeout - 1
+		}
+		if r.electionElapsed != welapsed {
+			t.Errorf("#%d: electionElapsed = %d, want %d", i, r.electionElapsed, welapsed)
+		}
+
+		if !tt.wreject {
+			r.tick()
+			if r.State != StateFollower {
+				t.Errorf("#%d: state = %s, want %s", i, r.State, StateFollower)
+			}
+		}
 	}
-	sm := newRaft(cfg)
-	sm.Term = terms[len(terms)-1]
-	return sm
 }
 
-// votedWithConfig creates a raft state machine with Vote and Term set
-// to the given value but no log entries (indicating that it voted in
-// the given term but has not received any logs).
-func votedWithConfig(configFunc func(*Config), id, vote, term uint64) *Raft {
+// TestSnapshotRetryBackoff2C verifies that the leader resends an
+// unacknowledged snapshot with a growing interval, and stops backing off once
+// the peer acknowledges it.
+func TestSnapshotRetryBackoff2C(t *testing.T) {
 	storage := NewMemoryStorage()
-	storage.SetHardState(pb.HardState{Vote: vote, Term: term})
-	cfg := newTestConfig(id, []uint64{}, 5, 1, storage)
-	if configFunc != nil {
-		configFunc(cfg)
-	}
-	sm := newRaft(cfg)
-	sm.Term = term
-	return sm
-}
+	storage.ApplySnapshot(pb.Snapshot{
+		Metadata: &pb.SnapshotMetadata{
+			Index:     10,
+			Term:      1,
+			ConfState: &pb.ConfState{Nodes: []uint64{1, 2}},
+		},
+	})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 10})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
 
-type network struct {
-	peers   map[uint64]stateMachine
-	storage map[uint64]*MemoryStorage
-	dropm   map[connem]float64
-	ignorem map[pb.MessageType]bool
+	var attempts []int
+	for tick := 0; tick < 100; tick++ {
+		for _, m := range r.readMessages() {
+			if m.MsgType == pb.MessageType_MsgSnapshot {
+				attempts = append(attempts, tick)
+			}
+		}
+		r.tick()
+	}
+	if len(attempts) < 4 {
+		t.Fatalf("snapshot attempts = %v, want at least 4", attempts)
+	}
+	for i := 2; i < len(attempts); i++ {
+		prev, cur := attempts[i-1]-attempts[i-2], attempts[i]-attempts[i-1]
+		if cur < prev {
+			t.Errorf("attempt interval shrinks from %d to %d: %v", prev, cur, attempts)
+		}
+	}
+	if first, last := attempts[1]-attempts[0], attempts[len(attempts)-1]-attempts[len(attempts)-2]; last <= first {
+		t.Errorf("attempt interval doesn't grow: %v", attempts)
+	}
 
-	// msgHook is called for each message sent. It may inspect the
-	// message and return true to send it or false to drop it.
-	msgHook func(pb.Message) bool
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 10})
+	if pr := r.Prs[2]; pr.PendingSnapshot != 0 || pr.retryBackoff != 0 {
+		t.Errorf("progress = %+v, want snapshot acknowledged", pr)
+	}
 }
 
-// newNetwork initializes a network from peers.
-// A nil node will be replaced with a new *stateMachine.
-// A *stateMachine will get its k, id.
-// When using stateMachine, the address list is always [1, n].
-func newNetwork(peers ...stateMachine) *network {
-	return newNetworkWithConfig(nil, peers...)
+// TestNoAppendInSnapshotState2C verifies that the leader sends no appends to
+// a peer while a snapshot is in flight to it, and resumes once the peer
+// acknowledges the snapshot.
+func TestNoAppendInSnapshotState2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{
+		Metadata: &pb.SnapshotMetadata{
+			Index:     10,
+			Term:      1,
+			ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}},
+		},
+	})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 10})
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	if st := r.Prs[2].State; st != ProgressStateSnapshot {
+		t.Fatalf("state = %s, want %s", st, ProgressStateSnapshot)
+	}
+
+	// peer 3 applies its snapshot, peer 2 is still receiving it and only
+	// rejects an earlier append, which tells the leader where its log ends
+	// without acknowledging the snapshot
+	r.Step(pb.Message{From: 3, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 10})
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 10, Reject: true})
+	if st := r.Prs[2].State; st != ProgressStateSnapshot {
+		t.Fatalf("state = %s, want %s", st, ProgressStateSnapshot)
+	}
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	if r.sendAppend(2) {
+		t.Errorf("sendAppend to a peer in snapshot state = true, want false")
+	}
+	var to3 int
+	for _, m := range r.readMessages() {
+		if m.MsgType != pb.MessageType_MsgAppend {
+			continue
+		}
+		if m.To == 2 {
+			t.Errorf("unexpected append to peer in snapshot state: %+v", m)
+		}
+		to3++
+	}
+	if to3 == 0 {
+		t.Errorf("no append sent to peer 3")
+	}
+
+	// once peer 2 acknowledges the snapshot the appends go out again
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 10})
+	if st := r.Prs[2].State; st != ProgressStateReplicate {
+		t.Fatalf("state = %s, want %s", st, ProgressStateReplicate)
+	}
+	r.readMessages()
+	if !r.sendAppend(2) {
+		t.Errorf("sendAppend after the snapshot is acknowledged = false, want true")
+	}
 }
 
-// newNetworkWithConfig is like newNetwork but calls the given func to
-// modify the configuration of any state machines it creates.
-func newNetworkWithConfig(configFunc func(*Config), peers ...stateMachine) *network {
-	size := len(peers)
-	peerAddrs := idsBySize(size)
+func TestRaftLogScanEntries2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1, ConfState: &pb.ConfState{}}})
+	storage.Append([]pb.Entry{{Index: 4, Term: 1}, {Index: 5, Term: 2}, {Index: 6, Term: 2}})
+	l := newLog(storage)
 
-	npeers := make(map[uint64]stateMachine, size)
-	nstorage := make(map[uint64]*MemoryStorage, size)
+	tests := []struct {
+		lo, hi uint64
+		stop   uint64 // the visitor returns false at this index
 
-	for j, p := range peers {
-		id := peerAddrs[j]
-		switch v := p.(type) {
-		case nil:
-			nstorage[id] = NewMemoryStorage()
-			cfg := newTestConfig(id, peerAddrs, 10, 1, nstorage[id])
-			if configFunc != nil {
-				configFunc(cfg)
-			}
-			sm := newRaft(cfg)
-			npeers[id] = sm
-		case *Raft:
-			v.id = id
-			npeers[id] = v
-		case *blackHole:
-			npeers[id] = v
-		default:
-			panic(fmt.Sprintf("unexpected state machine type: %T", p))
-		}
+		windexes []uint64
+		werr     error
+	}{
+		{4, 7, 0, []uint64{4, 5, 6}, nil},
+		{5, 6, 0, []uint64{5}, nil},
+		{6, 6, 0, nil, nil},
+		{4, 7, 5, []uint64{4, 5}, nil},
+		{3, 7, 0, nil, ErrCompacted},
+		{4, 8, 0, nil, ErrUnavailable},
+		{6, 5, 0, nil, ErrUnavailable},
 	}
-	return &network{
-		peers:   npeers,
-		storage: nstorage,
-		dropm:   make(map[connem]float64),
-		ignorem: make(map[pb.MessageType]bool),
+	for i, tt := range tests {
+		var indexes []uint64
+		err := l.scanEntries(tt.lo, tt.hi, func(ent pb.Entry) bool {
+			indexes = append(indexes, ent.Index)
+			return ent.Index != tt.stop
+		})
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if !reflect.DeepEqual(indexes, tt.windexes) {
+			t.Errorf("#%d: indexes = %v, want %v", i, indexes, tt.windexes)
+		}
 	}
 }
 
-func (nw *network) send(msgs ...pb.Message) {
-	for len(msgs) > 0 {
-		m := msgs[0]
-		p := nw.peers[m.To]
-		p.Step(m)
-		msgs = append(msgs[1:], nw.filter(p.readMessages())...)
+// TestSendAppendCopiesEntries2AB tests that an append message keeps the
+// entries it was built with when the leader's log changes before it is sent.
+func TestSendAppendCopiesEntries2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	msgs := r.readMessages()
+	if len(msgs) != 1 || len(msgs[0].Entries) != 2 {
+		t.Fatalf("msgs = %+v, want one append with two entries", msgs)
+	}
+
+	r.RaftLog.entries[1].Term = 7
+	if got := msgs[0].Entries[1].Term; got != 1 {
+		t.Errorf("term of the sent entry = %d, want 1", got)
 	}
 }
 
-func (nw *network) drop(from, to uint64, perc float64) {
-	nw.dropm[connem{from, to}] = perc
+func TestRaftLogLastTerm2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	if l := newLog(storage); l.lastTerm() != 0 {
+		t.Errorf("lastTerm of an empty log = %d, want 0", l.lastTerm())
+	}
+
+	// nothing left but the snapshot
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 2, ConfState: &pb.ConfState{}}})
+	l := newLog(storage)
+	if len(l.entries) != 0 || l.lastTerm() != 2 {
+		t.Errorf("len(entries), lastTerm = %d, %d, want 0, 2", len(l.entries), l.lastTerm())
+	}
+	l.appendEntry(3, &pb.Entry{})
+	if l.lastTerm() != 3 {
+		t.Errorf("lastTerm = %d, want 3", l.lastTerm())
+	}
+	l.compactTo(4, 3)
+	if len(l.entries) != 0 || l.lastTerm() != 3 {
+		t.Errorf("after compaction: len(entries), lastTerm = %d, %d, want 0, 3", len(l.entries), l.lastTerm())
+	}
+
+	// a candidate whose log was compacted away campaigns with the snapshot's term
+	storage = NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 2, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	msgs := r.readMessages()
+	if len(msgs) != 1 || msgs[0].Index != 3 || msgs[0].LogTerm != 2 {
+		t.Errorf("msgs = %+v, want a vote request at index 3 term 2", msgs)
+	}
 }
 
-func (nw *network) cut(one, other uint64) {
-	nw.drop(one, other, 2.0) // always drop
-	nw.drop(other, one, 2.0) // always drop
+func TestRaftLogMustTerm2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1, ConfState: &pb.ConfState{}}})
+	storage.Append([]pb.Entry{{Index: 4, Term: 2}, {Index: 5, Term: 3}})
+	l := newLog(storage)
+
+	if term := l.MustTerm(5); term != 3 {
+		t.Errorf("MustTerm(5) = %d, want 3", term)
+	}
+	for _, i := range []uint64{2, 6} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("MustTerm(%d) should panic", i)
+				}
+			}()
+			l.MustTerm(i)
+		}()
+	}
 }
 
-func (nw *network) isolate(id uint64) {
-	for i := 0; i < len(nw.peers); i++ {
-		nid := uint64(i) + 1
-		if nid != id {
-			nw.drop(id, nid, 1.0) // always drop
-			nw.drop(nid, id, 1.0) // always drop
+func TestRaftLogNextEnts2AB(t *testing.T) {
+	ents := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}, {Index: 4, Term: 1}, {Index: 5, Term: 1}}
+	tests := []struct {
+		applied, committed uint64
+		wents              []pb.Entry
+	}{
+		{5, 5, []pb.Entry{}},
+		{0, 5, ents},
+		{3, 3, []pb.Entry{}},
+		// committed beyond the last index is capped at LastIndex
+		{3, 8, ents[3:]},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		storage.Append(ents)
+		l := newLog(storage)
+		l.applied = tt.applied
+		l.committed = tt.committed
+
+		if g := l.nextEnts(); !reflect.DeepEqual(g, tt.wents) {
+			t.Errorf("#%d: nextEnts = %+v, want %+v", i, g, tt.wents)
 		}
 	}
 }
 
-func (nw *network) ignore(t pb.MessageType) {
-	nw.ignorem[t] = true
-}
+func TestRaftLogAppendEntry2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1, ConfState: &pb.ConfState{}}})
+	storage.Append([]pb.Entry{{Index: 4, Term: 2}})
+	l := newLog(storage)
 
-func (nw *network) recover() {
-	nw.dropm = make(map[connem]float64)
-	nw.ignorem = make(map[pb.MessageType]bool)
+	if last := l.appendEntry(3, &pb.Entry{Data: []byte("a")}, &pb.Entry{Data: []byte("b")}); last != 6 {
+		t.Errorf("lastIndex = %d, want 6", last)
+	}
+	wents := []pb.Entry{{Index: 4, Term: 2}, {Index: 5, Term: 3, Data: []byte("a")}, {Index: 6, Term: 3, Data: []byte("b")}}
+	if g := l.allEntries(); !reflect.DeepEqual(g, wents) {
+		t.Errorf("entries = %+v, want %+v", g, wents)
+	}
+	if l.stabled != 4 {
+		t.Errorf("stabled = %d, want 4", l.stabled)
+	}
 }
 
-func (nw *network) filter(msgs []pb.Message) []pb.Message {
-	mm := []pb.Message{}
-	for _, m := range msgs {
-		if nw.ignorem[m.MsgType] {
-			continue
+func TestRaftLogCompactTo2C(t *testing.T) {
+	ents := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 2}, {Index: 4, Term: 3}}
+	tests := []struct {
+		index, term uint64
+		wents       []pb.Entry
+	}{
+		{3, 2, ents[3:]},
+		{4, 3, []pb.Entry{}},
+		// the snapshot does not match the log, the whole log is discarded
+		{3, 3, []pb.Entry{}},
+		{6, 4, []pb.Entry{}},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		storage.Append(ents)
+		l := newLog(storage)
+		l.compactTo(tt.index, tt.term)
+
+		if g := l.allEntries(); !reflect.DeepEqual(g, tt.wents) {
+			t.Errorf("#%d: entries = %+v, want %+v", i, g, tt.wents)
 		}
-		switch m.MsgType {
-		case pb.MessageType_MsgHup:
-			// hups never go over the network, so don't drop them but panic
-			panic("unexpected MessageType_MsgHup")
-		default:
-			perc := nw.dropm[connem{m.From, m.To}]
-			if n := rand.Float64(); n < perc {
-				continue
-			}
+		if term, err := l.Term(tt.index); err != nil || term != tt.term {
+			t.Errorf("#%d: Term(%d) = %d, %v, want %d", i, tt.index, term, err, tt.term)
 		}
-		if nw.msgHook != nil {
-			if !nw.msgHook(m) {
-				continue
-			}
+		if _, err := l.Term(tt.index - 1); err != ErrCompacted {
+			t.Errorf("#%d: Term(%d) err = %v, want %v", i, tt.index-1, err, ErrCompacted)
+		}
+		if l.applied < tt.index || l.committed < tt.index {
+			t.Errorf("#%d: applied, committed = %d, %d, want at least %d", i, l.applied, l.committed, tt.index)
 		}
-		mm = append(mm, m)
 	}
-	return mm
 }
 
-type connem struct {
+func TestApplyLag2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	r := newTestRaft(1, []uint64{1}, 10, 1, s)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	for i := 0; i < 2; i++ {
+		r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	}
+	// the noop entry and the two proposals are committed but not applied
+	if lag := r.ApplyLag(); lag != 3 {
+		t.Errorf("ApplyLag() = %d, want 3", lag)
+	}
+
+	nextEnts(r, s)
+	if lag := r.ApplyLag(); lag != 0 {
+		t.Errorf("ApplyLag() = %d, want 0", lag)
+	}
+}
+
+// TestHeartbeatResponseCatchUp2AB verifies that the leader sends the missing
+// entries to a follower whose heartbeat response reports a stale commit index,
+// and steps down on a response with a higher term.
+func TestHeartbeatResponseCatchUp2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+	r.readMessages()
+
+	// up-to-date follower, nothing to send
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgHeartbeatResponse, Commit: 1})
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Fatalf("msgs = %+v, want none", msgs)
+	}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgHeartbeatResponse, Commit: 0})
+	msgs := r.readMessages()
+	if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgAppend || msgs[0].To != 2 {
+		t.Fatalf("msgs = %+v, want an append to 2", msgs)
+	}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term + 1, MsgType: pb.MessageType_MsgHeartbeatResponse})
+	if r.State != StateFollower {
+		t.Errorf("state = %s, want %s", r.State, StateFollower)
+	}
+}
+
+func TestConfigValidate2AA(t *testing.T) {
+	tests := []struct {
+		configFunc func(*Config)
+		wok        bool
+	}{
+		{func(c *Config) {}, true},
+		{func(c *Config) { c.ID = None }, false},
+		{func(c *Config) { c.HeartbeatTick = 0 }, false},
+		{func(c *Config) { c.ElectionTick = c.HeartbeatTick }, false},
+		{func(c *Config) { c.ElectionTick = c.HeartbeatTick - 1 }, false},
+		{func(c *Config) { c.ElectionTick = c.HeartbeatTick + 1 }, true},
+		{func(c *Config) { c.Storage = nil }, false},
+		{func(c *Config) { c.peers = nil }, true},
+		{func(c *Config) { c.peers = []uint64{1, None} }, false},
+	}
+	for i, tt := range tests {
+		c := newTestConfig(1, []uint64{1, 2, 3}, 10, 2, NewMemoryStorage())
+		tt.configFunc(c)
+		if err := c.validate(); (err == nil) != tt.wok {
+			t.Errorf("#%d: validate() = %v, want ok %v", i, err, tt.wok)
+		}
+	}
+}
+
+// TestAppendConflictWithinCommitted2AB verifies that an append which conflicts
+// with a committed entry is rejected and leaves the log untouched.
+func TestAppendConflictWithinCommitted2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeFollower(2, 2)
+	r.RaftLog.committed = 2
+
+	r.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppend, Index: 0, LogTerm: 0,
+		Entries: []*pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}}})
+
+	msgs := r.readMessages()
+	if len(msgs) != 1 || !msgs[0].Reject {
+		t.Fatalf("msgs = %+v, want a single rejection", msgs)
+	}
+	wents := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	if g := r.RaftLog.allEntries(); !reflect.DeepEqual(g, wents) {
+		t.Errorf("entries = %+v, want %+v", g, wents)
+	}
+	if r.RaftLog.stabled != 3 {
+		t.Errorf("stabled = %d, want 3", r.RaftLog.stabled)
+	}
+
+	// a conflict beyond the committed index still truncates the log
+	r.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppend, Index: 2, LogTerm: 1,
+		Entries: []*pb.Entry{{Index: 3, Term: 2}}})
+	wents = []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}}
+	if g := r.RaftLog.allEntries(); !reflect.DeepEqual(g, wents) {
+		t.Errorf("entries = %+v, want %+v", g, wents)
+	}
+	if r.RaftLog.stabled != 2 {
+		t.Errorf("stabled = %d, want 2", r.RaftLog.stabled)
+	}
+}
+
+func TestProposalDroppedWithoutQuorum2AB(t *testing.T) {
+	tests := []struct {
+		checkQuorum bool
+		wdropped    bool
+	}{
+		{false, false},
+		{true, true},
+	}
+	for i, tt := range tests {
+		nt := newNetworkWithConfig(func(c *Config) { c.CheckQuorum = tt.checkQuorum }, nil, nil, nil)
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+		leader := nt.peers[1].(*Raft)
+		if leader.State != StateLeader {
+			t.Fatalf("#%d: state = %s, want %s", i, leader.State, StateLeader)
+		}
+
+		// the leader can no longer reach either follower, the responses it got
+		// during the election still count for the first election timeout
+		nt.isolate(1)
+		for j := 0; j < 2*leader.electionTimeout; j++ {
+			leader.tick()
+		}
+		leader.readMessages()
+
+		lastIndex := leader.RaftLog.LastIndex()
+		err := leader.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+		if tt.wdropped {
+			if err != ErrProposalDropped {
+				t.Errorf("#%d: err = %v, want %v", i, err, ErrProposalDropped)
+			}
+			if g := leader.RaftLog.LastIndex(); g != lastIndex {
+				t.Errorf("#%d: lastIndex = %d, want %d", i, g, lastIndex)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+		leader.readMessages()
+
+		// proposals are accepted again once a quorum responds
+		nt.recover()
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+		if err := leader.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}}); err != nil {
+			t.Errorf("#%d: err after recover = %v, want nil", i, err)
+		}
+	}
+}
+
+func TestAbortLeaderTransfer3A(t *testing.T) {
+	tests := []struct {
+		m        pb.Message
+		wreject  bool
+		wvote    uint64
+		wmsgType pb.MessageType
+	}{
+		// the transferee campaigns with an up-to-date log, its vote is granted
+		{pb.Message{From: 2, To: 1, Term: 2, LogTerm: 1, Index: 1, MsgType: pb.MessageType_MsgRequestVote}, false, 2, pb.MessageType_MsgRequestVoteResponse},
+		// the transferee campaigns with a stale log, the transfer ends but the vote is rejected
+		{pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgRequestVote}, true, None, pb.MessageType_MsgRequestVoteResponse},
+		// another node campaigns with a stale log, the vote is rejected
+		{pb.Message{From: 3, To: 1, Term: 2, MsgType: pb.MessageType_MsgRequestVote}, true, None, pb.MessageType_MsgRequestVoteResponse},
+		// the transferee won and appends as the new leader
+		{pb.Message{From: 2, To: 1, Term: 2, LogTerm: 1, Index: 1, MsgType: pb.MessageType_MsgAppend}, false, None, pb.MessageType_MsgAppendResponse},
+	}
+	for i, tt := range tests {
+		r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		r.becomeCandidate()
+		r.becomeLeader()
+		r.readMessages()
+		r.leadTransferee = 2
+
+		r.Step(tt.m)
+		if r.State != StateFollower {
+			t.Errorf("#%d: state = %s, want %s", i, r.State, StateFollower)
+		}
+		if r.leadTransferee != None {
+			t.Errorf("#%d: leadTransferee = %d, want %d", i, r.leadTransferee, None)
+		}
+		if r.Vote != tt.wvote {
+			t.Errorf("#%d: vote = %d, want %d", i, r.Vote, tt.wvote)
+		}
+		msgs := r.readMessages()
+		if len(msgs) != 1 {
+			t.Fatalf("#%d: len(msgs) = %d, want 1", i, len(msgs))
+		}
+		if msgs[0].MsgType != tt.wmsgType || msgs[0].Reject != tt.wreject {
+			t.Errorf("#%d: msg = %+v, want type %s reject %v", i, msgs[0], tt.wmsgType, tt.wreject)
+		}
+	}
+}
+
+func TestReadIndexBatchedHeartbeat2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	leader := nt.peers[1].(*Raft)
+	follower := nt.peers[2].(*Raft)
+
+	if err := follower.readIndex([]byte("ctx0")); err != ErrProposalDropped {
+		t.Errorf("follower readIndex err = %v, want %v", err, ErrProposalDropped)
+	}
+
+	ctxs := [][]byte{[]byte("ctx1"), []byte("ctx2"), []byte("ctx3")}
+	for _, ctx := range ctxs {
+		if err := leader.readIndex(ctx); err != nil {
+			t.Fatalf("readIndex(%s) err = %v", ctx, err)
+		}
+	}
+	// the reads wait for the next heartbeat round instead of sending their own
+	if msgs := leader.readMessages(); len(msgs) != 0 {
+		t.Fatalf("len(msgs) = %d, want 0", len(msgs))
+	}
+
+	leader.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	msgs := leader.readMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.MsgType != pb.MessageType_MsgHeartbeat || len(m.Entries) != 1 || string(m.Entries[0].Data) != "ctx3" {
+			t.Errorf("msg = %+v, want heartbeat carrying ctx3", m)
+		}
+	}
+	nt.send(msgs...)
+
+	wstates := make([]ReadState, 0, len(ctxs))
+	for _, ctx := range ctxs {
+		wstates = append(wstates, ReadState{Index: leader.RaftLog.committed, RequestCtx: ctx})
+	}
+	if !reflect.DeepEqual(leader.readStates, wstates) {
+		t.Errorf("readStates = %+v, want %+v", leader.readStates, wstates)
+	}
+	if ctx := leader.readOnly.lastPendingRequestCtx(); ctx != nil {
+		t.Errorf("pending ctx = %s, want none", ctx)
+	}
+}
+
+func TestReadIndexDuplicateCtx2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	leader := nt.peers[1].(*Raft)
+
+	if err := leader.readIndex([]byte("ctx")); err != nil {
+		t.Fatalf("readIndex err = %v", err)
+	}
+	if err := leader.readIndex([]byte("ctx")); err != ErrDuplicateReadCtx {
+		t.Errorf("duplicate readIndex err = %v, want %v", err, ErrDuplicateReadCtx)
+	}
+	leader.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	nt.send(leader.readMessages()...)
+	if len(leader.readStates) != 1 {
+		t.Fatalf("len(readStates) = %d, want 1", len(leader.readStates))
+	}
+	// the ctx can be reused once its read is settled
+	if err := leader.readIndex([]byte("ctx")); err != nil {
+		t.Errorf("readIndex after settled err = %v", err)
+	}
+}
+
+func TestReadIndexIgnoresNonMemberAck2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3, 4, 5}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}})
+	for _, id := range []uint64{2, 3} {
+		r.Step(pb.Message{From: id, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: r.RaftLog.LastIndex()})
+	}
+	r.readMessages()
+	if err := r.readIndex([]byte("ctx")); err != nil {
+		t.Fatalf("readIndex err = %v", err)
+	}
+
+	ack := func(from uint64) {
+		r.Step(pb.Message{From: from, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgHeartbeatResponse,
+			Commit: r.RaftLog.committed, Entries: []*pb.Entry{{Data: []byte("ctx")}}})
+	}
+	// 6 is not a member, its ack must not complete the quorum of 3
+	ack(6)
+	ack(2)
+	if len(r.readStates) != 0 {
+		t.Fatalf("readStates = %+v, want none", r.readStates)
+	}
+	// an ack from a member that has since been removed doesn't count either
+	r.removeNode(2)
+	ack(3)
+	if len(r.readStates) != 0 {
+		t.Fatalf("readStates = %+v after removal, want none", r.readStates)
+	}
+	ack(4)
+	if len(r.readStates) != 1 {
+		t.Errorf("len(readStates) = %d, want 1", len(r.readStates))
+	}
+}
+
+func TestProposePendingConf3A(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	if r.hasPendingConf() {
+		t.Fatalf("hasPendingConf = true, want false")
+	}
+
+	proposeConf := func() {
+		r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{EntryType: pb.EntryType_EntryConfChange}}})
+	}
+	proposeConf()
+	if !r.hasPendingConf() {
+		t.Fatalf("hasPendingConf = false, want true")
+	}
+	// the second conf change is ignored while the first one is pending
+	proposeConf()
+	ents := r.RaftLog.allEntries()
+	if ents[1].EntryType != pb.EntryType_EntryConfChange || ents[2].EntryType != pb.EntryType_EntryNormal {
+		t.Errorf("entry types = %v, %v, want %v, %v", ents[1].EntryType, ents[2].EntryType, pb.EntryType_EntryConfChange, pb.EntryType_EntryNormal)
+	}
+
+	// once applied, a new conf change can be proposed
+	r.RaftLog.applied = r.RaftLog.LastIndex()
+	if r.hasPendingConf() {
+		t.Fatalf("hasPendingConf = true after apply, want false")
+	}
+	proposeConf()
+	if g := r.RaftLog.allEntries()[3].EntryType; g != pb.EntryType_EntryConfChange {
+		t.Errorf("entry type = %v, want %v", g, pb.EntryType_EntryConfChange)
+	}
+}
+
+func TestCampaignAfterNetworkHeal2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgHup})
+	rafts := []*Raft{nt.peers[1].(*Raft), nt.peers[2].(*Raft), nt.peers[3].(*Raft)}
+	tick := func(rs ...*Raft) {
+		for _, r := range rs {
+			r.tick()
+			nt.send(nt.filter(r.readMessages())...)
+		}
+	}
+	leader := func() *Raft {
+		var lead *Raft
+		for _, r := range rafts {
+			if r.State == StateLeader {
+				if lead != nil && lead.Term == r.Term {
+					return nil
+				}
+				if lead == nil || r.Term > lead.Term {
+					lead = r
+				}
+			}
+		}
+		return lead
+	}
+
+	// node 1 keeps campaigning on its own while 2 and 3 keep a leader
+	nt.isolate(1)
+	for i := 0; i < 100; i++ {
+		tick(rafts...)
+	}
+	lead := leader()
+	if lead == nil || lead.id == 1 {
+		t.Fatalf("no leader among nodes 2 and 3")
+	}
+	for i := 0; i < 50; i++ {
+		nt.send(pb.Message{From: lead.id, To: lead.id, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	}
+	if rafts[0].Term <= lead.Term {
+		t.Fatalf("isolated term = %d, want greater than %d", rafts[0].Term, lead.Term)
+	}
+
+	nt.recover()
+	electionTimeout := 2 * rafts[0].baseTimeout
+	for i := 0; i < 2*electionTimeout; i++ {
+		tick(rafts...)
+		if lead = leader(); lead != nil && lead.id != 1 && lead.Term >= rafts[0].Term {
+			break
+		}
+	}
+	if lead == nil || lead.id == 1 || lead.Term < rafts[0].Term {
+		t.Fatalf("no stable leader elected within %d ticks", 2*electionTimeout)
+	}
+
+	// let heartbeats bring node 1 up to date
+	for i := 0; i < electionTimeout; i++ {
+		tick(rafts...)
+	}
+	wents := lead.RaftLog.allEntries()
+	for _, r := range rafts {
+		if r.Lead != lead.id {
+			t.Errorf("node %d lead = %d, want %d", r.id, r.Lead, lead.id)
+		}
+		if r.RaftLog.committed != lead.RaftLog.committed {
+			t.Errorf("node %d committed = %d, want %d", r.id, r.RaftLog.committed, lead.RaftLog.committed)
+		}
+		if g := r.RaftLog.allEntries(); !reflect.DeepEqual(g, wents) {
+			t.Errorf("node %d log differs from the leader's:\n%s", r.id, diffu(ltoa(r.RaftLog), ltoa(lead.RaftLog)))
+		}
+	}
+}
+
+func TestSingleNodeCommitNoop2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	if r.RaftLog.committed != r.RaftLog.LastIndex() {
+		t.Errorf("committed = %d, want %d", r.RaftLog.committed, r.RaftLog.LastIndex())
+	}
+	if ents := r.RaftLog.nextEnts(); len(ents) != 1 || ents[0].Data != nil {
+		t.Errorf("nextEnts = %+v, want the noop entry", ents)
+	}
+}
+
+func TestFollowerForwardTransferLeader3A(t *testing.T) {
+	r := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeFollower(1, None)
+
+	// no leader is known, the message is dropped
+	r.Step(pb.Message{From: 3, To: 2, MsgType: pb.MessageType_MsgTransferLeader})
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Fatalf("msgs = %+v, want none", msgs)
+	}
+
+	r.becomeFollower(1, 1)
+	r.Step(pb.Message{From: 3, To: 2, MsgType: pb.MessageType_MsgTransferLeader})
+	msgs := r.readMessages()
+	wmsgs := []pb.Message{{From: 3, To: 1, MsgType: pb.MessageType_MsgTransferLeader}}
+	if !reflect.DeepEqual(msgs, wmsgs) {
+		t.Errorf("msgs = %+v, want %+v", msgs, wmsgs)
+	}
+}
+
+func TestReplicationHook2AB(t *testing.T) {
+	sent := make(map[uint64]int)
+	c := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	c.ReplicationHook = func(id uint64, pr *Progress, msgs []pb.Message) {
+		for _, m := range msgs {
+			sent[id] += len(m.Entries)
+		}
+	}
+	r := newRaft(c)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("foo")}}})
+
+	// the noop entry and then the noop with the proposal
+	wsent := map[uint64]int{2: 3, 3: 3}
+	if !reflect.DeepEqual(sent, wsent) {
+		t.Errorf("sent = %v, want %v", sent, wsent)
+	}
+	if msgs := r.readMessages(); len(msgs) != 4 {
+		t.Errorf("len(msgs) = %d, want 4", len(msgs))
+	}
+}
+
+func TestRaftLogEntriesInTerm2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 2, Term: 1, ConfState: &pb.ConfState{}}})
+	storage.Append([]pb.Entry{{Index: 3, Term: 1}, {Index: 4, Term: 2}, {Index: 5, Term: 2}, {Index: 6, Term: 2}, {Index: 7, Term: 4}, {Index: 8, Term: 5}})
+	l := newLog(storage)
+
+	tests := []struct {
+		term          uint64
+		wfirst, wlast uint64
+		wok           bool
+	}{
+		// the entries of term 1 before the snapshot are compacted
+		{1, 3, 3, true},
+		{2, 4, 6, true},
+		{3, 0, 0, false},
+		{4, 7, 7, true},
+		{5, 8, 8, true},
+		{6, 0, 0, false},
+	}
+	for i, tt := range tests {
+		first, last, ok := l.entriesInTerm(tt.term)
+		if first != tt.wfirst || last != tt.wlast || ok != tt.wok {
+			t.Errorf("#%d: entriesInTerm(%d) = (%d, %d, %v), want (%d, %d, %v)", i, tt.term, first, last, ok, tt.wfirst, tt.wlast, tt.wok)
+		}
+	}
+}
+
+func TestRaftLogMaybeCommit2AB(t *testing.T) {
+	ents := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 3}}
+	tests := []struct {
+		maxIndex, term uint64
+		wcommit        bool
+		wcommitted     uint64
+	}{
+		{3, 3, true, 3},
+		// the entry is from another term
+		{3, 2, false, 1},
+		{2, 3, false, 1},
+		// not beyond committed
+		{1, 1, false, 1},
+		// out of range
+		{4, 3, false, 1},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		storage.Append(ents)
+		l := newLog(storage)
+		l.committed = 1
+
+		if g := l.maybeCommit(tt.maxIndex, tt.term); g != tt.wcommit {
+			t.Errorf("#%d: maybeCommit = %v, want %v", i, g, tt.wcommit)
+		}
+		if l.committed != tt.wcommitted {
+			t.Errorf("#%d: committed = %d, want %d", i, l.committed, tt.wcommitted)
+		}
+	}
+}
+
+// TestPreferLowerID verifies that when every node starts its election timer at
+// the same time, PreferLowerID makes the lowest id win the first election
+// instead of splitting the vote.
+func TestPreferLowerID2AA(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		nt := newNetworkWithConfig(func(c *Config) { c.PreferLowerID = true }, nil, nil, nil)
+		for tick := 0; tick < 3*10; tick++ {
+			// every node ticks before any message is delivered
+			var msgs []pb.Message
+			for id := uint64(1); id <= 3; id++ {
+				r := nt.peers[id].(*Raft)
+				r.tick()
+				msgs = append(msgs, r.readMessages()...)
+			}
+			nt.send(nt.filter(msgs)...)
+		}
+		for id := uint64(1); id <= 3; id++ {
+			r := nt.peers[id].(*Raft)
+			if r.Lead != 1 || r.Term != 1 {
+				t.Errorf("#%d: node %d lead = %d at term %d, want 1 at term 1", i, id, r.Lead, r.Term)
+			}
+		}
+	}
+}
+
+func BenchmarkProposal(b *testing.B) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	data := []byte("somedata")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: data}}})
+		last := r.RaftLog.LastIndex()
+		for _, id := range []uint64{2, 3} {
+			r.Step(pb.Message{From: id, To: 1, MsgType: pb.MessageType_MsgAppendResponse, Term: r.Term, Index: last})
+		}
+		r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+		r.readMessages()
+	}
+}
+
+// BenchmarkNewLog compares loading a long log into a preallocated slice, as
+// newLog does, against growing the slice one entry at a time.
+func BenchmarkNewLog(b *testing.B) {
+	storage := NewMemoryStorage()
+	ents := make([]pb.Entry, 100000)
+	for i := range ents {
+		ents[i] = pb.Entry{Index: uint64(i + 1), Term: 1}
+	}
+	storage.Append(ents)
+
+	b.Run("prealloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			newLog(storage)
+		}
+	})
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stored, _ := storage.Entries(1, uint64(len(ents))+1, math.MaxUint64)
+			entries := make([]pb.Entry, 0)
+			for _, ent := range stored {
+				entries = append(entries, ent)
+			}
+		}
+	})
+}
+
+func TestRaftLogUnstableEntries2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1, ConfState: &pb.ConfState{}}})
+	storage.Append([]pb.Entry{{Index: 4, Term: 1}, {Index: 5, Term: 1}})
+	l := newLog(storage)
+	l.appendEntry(2, &pb.Entry{}, &pb.Entry{}, &pb.Entry{})
+	l.committed = 6
+
+	checkUnstable := func(wents []pb.Entry) {
+		t.Helper()
+		ents := l.unstableEntries()
+		if !reflect.DeepEqual(ents, wents) {
+			t.Fatalf("unstable = %+v, want %+v", ents, wents)
+		}
+		for _, e := range ents {
+			if e.Index <= l.stabled {
+				t.Fatalf("persisted entry %d (stabled %d) returned as unstable", e.Index, l.stabled)
+			}
+		}
+	}
+	checkUnstable([]pb.Entry{{Index: 6, Term: 2}, {Index: 7, Term: 2}, {Index: 8, Term: 2}})
+
+	l.stableTo(6, 2)
+	checkUnstable([]pb.Entry{{Index: 7, Term: 2}, {Index: 8, Term: 2}})
+
+	// a stale term or an index behind stabled does not move stabled
+	l.stableTo(7, 1)
+	l.stableTo(5, 1)
+	if l.stabled != 6 {
+		t.Errorf("stabled = %d, want 6", l.stabled)
+	}
+
+	l.stableTo(8, 2)
+	checkUnstable([]pb.Entry{})
+}
+
+type unavailableSnapshotStorage struct {
+	*MemoryStorage
+	unavailable bool
+}
+
+func (s *unavailableSnapshotStorage) Snapshot() (pb.Snapshot, error) {
+	if s.unavailable {
+		return pb.Snapshot{}, ErrSnapshotTemporarilyUnavailable
+	}
+	return s.MemoryStorage.Snapshot()
+}
+
+// TestSendAppendFallsBackToSnapshot verifies that sendAppend sends a snapshot
+// once the entries the peer needs are compacted, and sends nothing while the
+// snapshot is unavailable.
+func TestSendAppendFallsBackToSnapshot2C(t *testing.T) {
+	storage := &unavailableSnapshotStorage{MemoryStorage: NewMemoryStorage(), unavailable: true}
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 10, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 10})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+
+	// the peer is caught up to the snapshot, entries are sent
+	r.Prs[2].Match, r.Prs[2].Next = 10, 11
+	if !r.sendAppend(2) {
+		t.Fatal("sendAppend = false, want true")
+	}
+	if msgs := r.readMessages(); len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgAppend {
+		t.Fatalf("msgs = %+v, want one append", msgs)
+	}
+
+	r.Prs[2].Match, r.Prs[2].Next = 0, 5
+	if r.sendAppend(2) {
+		t.Error("sendAppend = true while snapshot is unavailable, want false")
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+
+	storage.unavailable = false
+	if !r.sendAppend(2) {
+		t.Fatal("sendAppend = false, want true")
+	}
+	msgs := r.readMessages()
+	if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgSnapshot || msgs[0].Snapshot.Metadata.Index != 10 {
+		t.Errorf("msgs = %+v, want a snapshot at 10", msgs)
+	}
+}
+
+// TestSnapshotRetryUnavailable2C verifies that a retry finding the snapshot
+// unavailable sends nothing and doesn't grow the backoff, only real sends do.
+func TestSnapshotRetryUnavailable2C(t *testing.T) {
+	storage := &unavailableSnapshotStorage{MemoryStorage: NewMemoryStorage()}
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 10, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 10})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	pr := r.Prs[2]
+	if pr.PendingSnapshot != 10 || pr.retryBackoff != 1 {
+		t.Fatalf("progress = %+v, want the snapshot sent once", pr)
+	}
+
+	storage.unavailable = true
+	for i := 0; i < 5; i++ {
+		r.tick()
+	}
+	if msgs := r.readMessages(); len(msgs) != 5 {
+		t.Fatalf("msgs = %+v, want only the heartbeats", msgs)
+	}
+	if pr.retryBackoff != 1 {
+		t.Errorf("retryBackoff = %d after unavailable retries, want 1", pr.retryBackoff)
+	}
+
+	storage.unavailable = false
+	r.tick()
+	var snaps int
+	for _, m := range r.readMessages() {
+		if m.MsgType == pb.MessageType_MsgSnapshot {
+			snaps++
+		}
+	}
+	if snaps != 1 || pr.retryBackoff != 2 {
+		t.Errorf("snapshots, retryBackoff = %d, %d, want 1, 2", snaps, pr.retryBackoff)
+	}
+}
+
+// TestSnapshotTimeout2C verifies that a snapshot left unacknowledged for
+// snapshotTimeout heartbeat intervals is given up, the peer goes back to
+// probe and gets a new snapshot once it responds again.
+func TestSnapshotTimeout2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 10, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 10})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 2, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	pr := r.Prs[2]
+
+	for i := 0; i < snapshotTimeout*r.heartbeatTimeout-1; i++ {
+		r.tick()
+	}
+	if pr.State != ProgressStateSnapshot || pr.PendingSnapshot != 10 {
+		t.Fatalf("progress = %+v, want the snapshot still pending", pr)
+	}
+	r.tick()
+	if pr.State != ProgressStateProbe || pr.PendingSnapshot != 0 || pr.retryBackoff != 0 {
+		t.Fatalf("progress = %+v, want probe without a pending snapshot", pr)
+	}
+	r.readMessages()
+	r.tick()
+	for _, m := range r.readMessages() {
+		if m.MsgType == pb.MessageType_MsgSnapshot {
+			t.Fatalf("msgs = %+v, want no snapshot before the peer responds", m)
+		}
+	}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgHeartbeatResponse})
+	msgs := r.readMessages()
+	if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgSnapshot || pr.State != ProgressStateSnapshot {
+		t.Errorf("msgs = %+v, progress = %+v, want a new snapshot", msgs, pr)
+	}
+}
+
+func TestRaftLogEmpty2AB(t *testing.T) {
+	l := newLog(NewMemoryStorage())
+
+	if l.firstIndex() != 1 || l.LastIndex() != 0 {
+		t.Errorf("[firstIndex, LastIndex] = [%d, %d], want [1, 0]", l.firstIndex(), l.LastIndex())
+	}
+	if term, err := l.Term(0); term != 0 || err != nil {
+		t.Errorf("Term(0) = (%d, %v), want (0, nil)", term, err)
+	}
+	if _, err := l.Term(1); err != ErrUnavailable {
+		t.Errorf("Term(1) err = %v, want %v", err, ErrUnavailable)
+	}
+	if n := len(l.allEntries()) + len(l.unstableEntries()) + len(l.nextEnts()); n != 0 {
+		t.Errorf("empty log returns %d entries, want 0", n)
+	}
+	if g := l.slice(1, 1); len(g) != 0 {
+		t.Errorf("slice(1, 1) = %+v, want empty", g)
+	}
+
+	l.appendEntry(1, &pb.Entry{})
+	wents := []pb.Entry{{Index: 1, Term: 1}}
+	if g := l.unstableEntries(); !reflect.DeepEqual(g, wents) {
+		t.Errorf("unstable = %+v, want %+v", g, wents)
+	}
+}
+
+func TestRaftLogAfterSnapshot2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 5, Term: 3, ConfState: &pb.ConfState{}}})
+	storage.Append([]pb.Entry{{Index: 6, Term: 3}, {Index: 7, Term: 4}})
+	l := newLog(storage)
+
+	if l.firstIndex() != 6 || l.LastIndex() != 7 {
+		t.Errorf("[firstIndex, LastIndex] = [%d, %d], want [6, 7]", l.firstIndex(), l.LastIndex())
+	}
+	// the term of the snapshot index is still known
+	tests := []struct {
+		index, wterm uint64
+		werr         error
+	}{
+		{4, 0, ErrCompacted},
+		{5, 3, nil},
+		{6, 3, nil},
+		{7, 4, nil},
+		{8, 0, ErrUnavailable},
+	}
+	for i, tt := range tests {
+		term, err := l.Term(tt.index)
+		if term != tt.wterm || err != tt.werr {
+			t.Errorf("#%d: Term(%d) = (%d, %v), want (%d, %v)", i, tt.index, term, err, tt.wterm, tt.werr)
+		}
+	}
+
+	l.appendEntry(4, &pb.Entry{}, &pb.Entry{})
+	if g, w := l.slice(7, 9), []pb.Entry{{Index: 7, Term: 4}, {Index: 8, Term: 4}}; !reflect.DeepEqual(g, w) {
+		t.Errorf("slice(7, 9) = %+v, want %+v", g, w)
+	}
+
+	// truncating persisted entries moves stabled back
+	l.stabled = 8
+	l.truncate(7)
+	if l.LastIndex() != 6 || l.stabled != 6 {
+		t.Errorf("LastIndex, stabled = %d, %d, want 6, 6", l.LastIndex(), l.stabled)
+	}
+
+	l.compactTo(6, 3)
+	if len(l.allEntries()) != 0 || l.LastIndex() != 6 || l.MustTerm(6) != 3 {
+		t.Errorf("after compaction entries = %+v, LastIndex = %d, want none at 6", l.allEntries(), l.LastIndex())
+	}
+}
+
+func TestRaftLogAppliedTo2AB(t *testing.T) {
+	tests := []struct {
+		applied uint64
+		wpanic  bool
+	}{
+		{3, false},
+		{4, false},
+		// beyond committed
+		{5, true},
+		// backwards
+		{2, true},
+	}
+	for i, tt := range tests {
+		func() {
+			storage := NewMemoryStorage()
+			storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}, {Index: 4, Term: 1}, {Index: 5, Term: 1}})
+			l := newLog(storage)
+			l.committed = 4
+			l.applied = 3
+			defer func() {
+				if r := recover(); (r != nil) != tt.wpanic {
+					t.Errorf("#%d: appliedTo(%d) panic = %v, want panic %v", i, tt.applied, r, tt.wpanic)
+				}
+			}()
+			l.appliedTo(tt.applied)
+			if l.applied != tt.applied {
+				t.Errorf("#%d: applied = %d, want %d", i, l.applied, tt.applied)
+			}
+		}()
+	}
+}
+
+func TestProposalThrottledByLaggingFollower2AB(t *testing.T) {
+	nt := newNetworkWithConfig(func(c *Config) { c.MaxFollowerLag = 3 }, nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	// node 3 stops receiving anything, node 2 keeps up
+	nt.isolate(3)
+
+	lead := nt.peers[1].(*Raft)
+	var dropped int
+	for i := 0; i < 10; i++ {
+		err := lead.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+		if err == ErrProposalDropped {
+			dropped++
+		}
+		nt.send(nt.filter(lead.readMessages())...)
+	}
+	// node 3 has the noop, 3 more entries are allowed
+	if wdropped := 7; dropped != wdropped {
+		t.Errorf("dropped = %d, want %d", dropped, wdropped)
+	}
+	if lead.RaftLog.committed != 4 {
+		t.Errorf("committed = %d, want 4\n%s", lead.RaftLog.committed, nt.progressTable())
+	}
+
+	nt.recover()
+	lead.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	nt.send(nt.filter(lead.readMessages())...)
+	if err := lead.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}}); err != nil {
+		t.Errorf("propose after the follower caught up: err = %v, want nil", err)
+	}
+}
+
+func TestProposalThrottledByUncommittedSize2AB(t *testing.T) {
+	nt := newNetworkWithConfig(func(c *Config) { c.MaxUncommittedEntrySize = 20 }, nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	// nothing commits while both followers are cut off
+	nt.isolate(2)
+	nt.isolate(3)
+
+	lead := nt.peers[1].(*Raft)
+	var dropped int
+	for i := 0; i < 10; i++ {
+		err := lead.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+		if err != nil {
+			if !errors.Is(err, ErrProposalDropped) || !errors.Is(err, ErrTooManyUncommittedEntries) {
+				t.Fatalf("#%d: err = %v, want %v and %v", i, err, ErrProposalDropped, ErrTooManyUncommittedEntries)
+			}
+			dropped++
+		}
+		nt.send(nt.filter(lead.readMessages())...)
+	}
+	// 8, 16 and 24 bytes are accepted, 24 bytes are over the limit
+	if wdropped := 7; dropped != wdropped {
+		t.Errorf("dropped = %d, want %d", dropped, wdropped)
+	}
+
+	// the followers catch up and commit the backlog
+	nt.recover()
+	lead.sendAppend(2)
+	lead.sendAppend(3)
+	nt.send(nt.filter(lead.readMessages())...)
+	if lead.RaftLog.committed != lead.RaftLog.LastIndex() {
+		t.Fatalf("committed = %d, want %d\n%s", lead.RaftLog.committed, lead.RaftLog.LastIndex(), nt.progressTable())
+	}
+	if err := lead.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}}); err != nil {
+		t.Errorf("propose after the followers caught up: err = %v, want nil", err)
+	}
+}
+
+// TestMultiNodeElectionAfterCrashRestart verifies that a node restarted from
+// its persisted hard state and log rejoins as a follower of the existing
+// leader instead of starting a new election.
+func TestMultiNodeElectionAfterCrashRestart2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+
+	// persist node 3 and crash it
+	old := nt.peers[3].(*Raft)
+	storage := nt.storage[3]
+	storage.Append(old.RaftLog.unstableEntries())
+	storage.SetHardState(pb.HardState{Term: old.Term, Vote: old.Vote, Commit: old.RaftLog.committed})
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("moredata")}}})
+
+	r := newRaft(newTestConfig(3, []uint64{1, 2, 3}, 10, 1, storage))
+	if r.Term != old.Term || r.Vote != old.Vote {
+		t.Fatalf("restarted term, vote = %d, %d, want %d, %d", r.Term, r.Vote, old.Term, old.Vote)
+	}
+	nt.peers[3] = r
+	nt.recover()
+
+	lead := nt.peers[1].(*Raft)
+	for i := 0; i < r.electionTimeout; i++ {
+		lead.tick()
+		nt.send(nt.filter(lead.readMessages())...)
+		r.tick()
+		nt.send(nt.filter(r.readMessages())...)
+	}
+
+	if r.State != StateFollower || r.Lead != 1 || r.Term != lead.Term {
+		t.Errorf("restarted node state, lead, term = %s, %d, %d, want %s, 1, %d", r.State, r.Lead, r.Term, StateFollower, lead.Term)
+	}
+	if lead.State != StateLeader {
+		t.Errorf("leader state = %s, want %s", lead.State, StateLeader)
+	}
+	if r.RaftLog.committed != lead.RaftLog.committed {
+		t.Errorf("restarted node committed = %d, want %d", r.RaftLog.committed, lead.RaftLog.committed)
+	}
+	if g, w := ltoa(r.RaftLog), ltoa(lead.RaftLog); g != w {
+		t.Errorf("restarted node log differs from leader:\n%s", diffu(w, g))
+	}
+}
+
+func TestLogsConsistentAfterPartition2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil, nil, nil)
+	propose := func(id uint64) {
+		nt.send(pb.Message{From: id, To: id, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	}
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	propose(1)
+	assertLogsConsistent(t, nt.peers)
+
+	// the old leader keeps appending entries that can never commit
+	nt.isolate(1)
+	propose(1)
+	propose(1)
+	nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgHup})
+	propose(2)
+	assertLogsConsistent(t, nt.peers)
+
+	nt.recover()
+	propose(2)
+	assertLogsConsistent(t, nt.peers)
+
+	lead := nt.peers[2].(*Raft)
+	if lead.State != StateLeader {
+		t.Fatalf("node 2 state = %s, want %s", lead.State, StateLeader)
+	}
+	for id, p := range nt.peers {
+		r := p.(*Raft)
+		if r.RaftLog.committed != lead.RaftLog.committed {
+			t.Errorf("node %d committed = %d, want %d\n%s", id, r.RaftLog.committed, lead.RaftLog.committed, nt.progressTable())
+		}
+	}
+}
+
+// TestLeaderCompletenessSafety commits an entry on a bare quorum, removes the
+// leader and runs elections among the rest in a random order, only a node
+// holding the entry may win any of them.
+func TestLeaderCompletenessSafety2AB(t *testing.T) {
+	for seed := int64(0); seed < 100; seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(seed))
+			nt := newNetwork(nil, nil, nil, nil, nil)
+			nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+
+			// only 1, 2 and 3 receive the entry
+			nt.cut(1, 4)
+			nt.cut(1, 5)
+			nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("E")}}})
+			l1 := nt.peers[1].(*Raft)
+			eIndex := l1.RaftLog.LastIndex()
+			eTerm := mustTerm(l1.RaftLog.Term(eIndex))
+			if l1.RaftLog.committed != eIndex {
+				t.Fatalf("committed = %d, want %d", l1.RaftLog.committed, eIndex)
+			}
+			nt.recover()
+			nt.isolate(1)
+
+			hasE := func(r *Raft) bool {
+				term, err := r.RaftLog.Term(eIndex)
+				return err == nil && term == eTerm
+			}
+			for round := 0; round < 10; round++ {
+				id := 2 + uint64(rnd.Intn(4))
+				nt.send(pb.Message{From: id, To: id, MsgType: pb.MessageType_MsgHup})
+				for _, pid := range []uint64{2, 3, 4, 5} {
+					r := nt.peers[pid].(*Raft)
+					if r.State == StateLeader && !hasE(r) {
+						t.Fatalf("round %d: node %d won term %d without the committed entry at %d", round, pid, r.Term, eIndex)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStepErrors2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	tests := []struct {
+		m     pb.Message
+		wtype string
+	}{
+		// a follower does not handle responses
+		{pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppendResponse}, "MsgAppendResponse"},
+		// nor a leader transfer while it knows no leader to forward it to
+		{pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgTransferLeader}, "MsgTransferLeader"},
+	}
+	for i, tt := range tests {
+		err := r.Step(tt.m)
+		if !errors.Is(err, ErrDropped) {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrDropped)
+		} else if !strings.Contains(err.Error(), tt.wtype) {
+			t.Errorf("#%d: err = %q, want it tagged with %s", i, err, tt.wtype)
+		}
+	}
+
+	// proposal errors are not wrapped
+	r.becomeCandidate()
+	if err := r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}}); err != (ErrNotLeader{}) {
+		t.Errorf("propose err = %v, want %v", err, ErrNotLeader{})
+	}
+}
+
+func TestFollowerCommitInAppendResponse2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead := nt.peers[1].(*Raft)
+
+	for i := 0; i < 3; i++ {
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+		if w := uint64(i + 2); lead.RaftLog.committed != w {
+			t.Fatalf("#%d: committed = %d, want %d", i, lead.RaftLog.committed, w)
+		}
+		for _, id := range []uint64{2, 3} {
+			// the leader broadcasts the commit and the followers acknowledge it
+			if g, w := lead.Prs[id].Committed, lead.RaftLog.committed; g != w {
+				t.Errorf("#%d: Prs[%d].Committed = %d, want %d", i, id, g, w)
+			}
+		}
+	}
+
+	// an isolated follower's commit stays where it last reported it
+	wlag := lead.RaftLog.committed
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	if g, w := lead.Prs[2].Committed, lead.RaftLog.committed; g != w {
+		t.Errorf("Prs[2].Committed = %d, want %d", g, w)
+	}
+	if g := lead.Prs[3].Committed; g != wlag {
+		t.Errorf("Prs[3].Committed = %d, want %d", g, wlag)
+	}
+}
+
+// TestHandleAppendEntriesStepsDownFirst checks that the append handler itself
+// turns a stale leader into a follower of the sender before taking its log,
+// without relying on Step to do it.
+func TestHandleAppendEntriesStepsDownFirst2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.leadTransferee = 3
+	r.readMessages()
+
+	r.handleAppendEntries(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppend, Term: 2,
+		Entries: []*pb.Entry{{Index: 1, Term: 2}, {Index: 2, Term: 2}}})
+	if r.State != StateFollower || r.Term != 2 || r.Lead != 2 {
+		t.Fatalf("state, term, lead = %s, %d, %d, want %s, 2, 2", r.State, r.Term, r.Lead, StateFollower)
+	}
+	if r.Vote != None || r.leadTransferee != None {
+		t.Errorf("vote, leadTransferee = %d, %d, want none", r.Vote, r.leadTransferee)
+	}
+	// the leader's own noop at index 1 is replaced by the new leader's log
+	wents := []pb.Entry{{Index: 1, Term: 2}, {Index: 2, Term: 2}}
+	if g := r.RaftLog.allEntries(); !reflect.DeepEqual(g, wents) {
+		t.Errorf("entries = %+v, want %+v", g, wents)
+	}
+	msgs := r.readMessages()
+	if len(msgs) != 1 || msgs[0].Reject || msgs[0].Index != 2 {
+		t.Errorf("msgs = %+v, want one accepting append response at 2", msgs)
+	}
+
+	// a leader that sees an append of its own term also steps down
+	r = newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.Step(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppend, Term: r.Term, Index: 1, LogTerm: r.Term})
+	if r.State != StateFollower || r.Lead != 2 {
+		t.Errorf("state, lead = %s, %d, want %s, 2", r.State, r.Lead, StateFollower)
+	}
+}
+
+func TestReadMessagesDrains2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	msgs := r.readMessages()
+	if len(msgs) != 2 || len(r.msgs) != 0 {
+		t.Fatalf("read %d messages leaving %d, want 2 leaving 0", len(msgs), len(r.msgs))
+	}
+	want := append([]pb.Message(nil), msgs...)
+
+	// new messages neither show up in nor overwrite the drained ones
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("drained messages changed to %+v, want %+v", msgs, want)
+	}
+	if g := r.readMessages(); len(g) != 2 || g[0].MsgType != pb.MessageType_MsgHeartbeat {
+		t.Errorf("msgs = %+v, want two heartbeats", g)
+	}
+}
+
+func TestStorageEntriesMaxSize2AB(t *testing.T) {
+	ents := []pb.Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 6}}
+	size := uint64(ents[1].Size())
+	tests := []struct {
+		lo, hi, maxSize uint64
+
+		wentries []pb.Entry
+	}{
+		{4, 7, math.MaxUint64, ents[1:4]},
+		{4, 7, size * 3, ents[1:4]},
+		{4, 7, size*3 - 1, ents[1:3]},
+		{4, 7, size * 2, ents[1:3]},
+		// at least one entry is returned however small maxSize is
+		{4, 7, size, ents[1:2]},
+		{4, 7, 0, ents[1:2]},
+	}
+	for i, tt := range tests {
+		s := &MemoryStorage{ents: ents}
+		entries, err := s.Entries(tt.lo, tt.hi, tt.maxSize)
+		if err != nil {
+			t.Fatalf("#%d: err = %v", i, err)
+		}
+		if !reflect.DeepEqual(entries, tt.wentries) {
+			t.Errorf("#%d: entries = %v, want %v", i, entries, tt.wentries)
+		}
+	}
+}
+
+func TestLoadStateCommitOutOfRange2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 3})
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatalf("newRaft should panic on a commit index beyond the last index")
+		}
+		if want := "1 hardState.Commit 3 is out of range [0, 2]"; r != want {
+			t.Errorf("panic = %v, want %q", r, want)
+		}
+	}()
+	newTestRaft(1, []uint64{1}, 10, 1, storage)
+}
+
+func TestSelfAddressedVote2AA(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3, 4, 5}, 10, 1, NewMemoryStorage())
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	r.readMessages()
+
+	// a vote response from itself is dropped, its own vote is already counted
+	for i := 0; i < 2; i++ {
+		err := r.Step(pb.Message{From: 1, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgRequestVoteResponse})
+		if !errors.Is(err, ErrDropped) {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrDropped)
+		}
+	}
+	// a vote request from itself is answered with its own vote, and the
+	// response is dropped in turn
+	r.Step(pb.Message{From: 1, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgRequestVote})
+	for _, m := range r.readMessages() {
+		r.Step(m)
+	}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if r.State != StateCandidate {
+		t.Fatalf("state = %s, want %s", r.State, StateCandidate)
+	}
+	if r.voteCount != 2 || r.Vote != 1 {
+		t.Errorf("voteCount = %d, vote = %d, want 2, 1", r.voteCount, r.Vote)
+	}
+	r.Step(pb.Message{From: 3, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if r.State != StateLeader {
+		t.Errorf("state = %s, want %s", r.State, StateLeader)
+	}
+}
+
+// TestSplitVoteRecovery2AA drives two nodes to time out on the same tick and
+// split the vote, then lets the one with the shorter timeout win the next
+// election.
+func TestSplitVoteRecovery2AA(t *testing.T) {
+	nt := newNetwork(nil, nil, nil, nil)
+	r1, r2 := nt.peers[1].(*Raft), nt.peers[2].(*Raft)
+	for _, p := range nt.peers {
+		fixedTimeout(p.(*Raft), 0)
+	}
+	fixedTimeout(r2, 5)
+	// 3 can only hear 1 and 4 only 2, so each candidate gets 2 of 4 votes
+	nt.cut(1, 4)
+	nt.cut(2, 3)
+
+	skewClock(r1, r1.electionTimeout-1, 0)
+	skewClock(r2, r2.electionTimeout-1, 0)
+	r1.tick()
+	r2.tick()
+	nt.send(nt.filter(append(r1.readMessages(), r2.readMessages()...))...)
+	for _, r := range []*Raft{r1, r2} {
+		if r.State != StateCandidate || r.Term != 1 {
+			t.Fatalf("%d: state = %s, term = %d, want %s, 1", r.id, r.State, r.Term, StateCandidate)
+		}
+	}
+
+	// 1 times out 5 ticks before 2 and wins the next term
+	nt.recover()
+	ticks := 0
+	for ; r1.State != StateLeader && ticks < 20; ticks++ {
+		for _, id := range idsBySize(4) {
+			r := nt.peers[id].(*Raft)
+			r.tick()
+			nt.send(nt.filter(r.readMessages())...)
+		}
+	}
+	if r1.State != StateLeader || r1.Term != 2 {
+		t.Fatalf("1: state = %s, term = %d, want %s, 2", r1.State, r1.Term, StateLeader)
+	}
+	if ticks != r1.baseTimeout {
+		t.Errorf("elected after %d ticks, want %d", ticks, r1.baseTimeout)
+	}
+	if r2.State != StateFollower || r2.Lead != 1 {
+		t.Errorf("2: state = %s, lead = %d, want %s, 1", r2.State, r2.Lead, StateFollower)
+	}
+}
+
+func TestStepDown2AA(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.StepDown()
+	if r.State != StateFollower || r.Term != 0 {
+		t.Fatalf("follower: state, term = %s, %d, want %s, 0", r.State, r.Term, StateFollower)
+	}
+
+	r.becomeCandidate()
+	r.StepDown()
+	if r.State != StateCandidate {
+		t.Fatalf("candidate: state = %s, want %s", r.State, StateCandidate)
+	}
+
+	r.becomeLeader()
+	r.readMessages()
+	r.StepDown()
+	if r.State != StateFollower || r.Lead != None || r.Term != 1 || r.Vote != 1 {
+		t.Errorf("leader: state, lead, term, vote = %s, %d, %d, %d, want %s, %d, 1, 1",
+			r.State, r.Lead, r.Term, r.Vote, StateFollower, None)
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+}
+
+func TestCommitBroadcastOnlyToLagging2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3, 4, 5}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+
+	// 3 has the noop but doesn't know it is committed, 4 has it and has
+	// reported the commit index it is about to reach, 5 lacks it
+	r.Prs[3].Match, r.Prs[3].Next = 1, 2
+	r.Prs[4].Match, r.Prs[4].Next, r.Prs[4].Committed = 1, 2, 1
+	r.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+	if r.RaftLog.committed != 1 {
+		t.Fatalf("committed = %d, want 1", r.RaftLog.committed)
+	}
+
+	var to []uint64
+	for _, m := range r.readMessages() {
+		if m.MsgType == pb.MessageType_MsgAppend {
+			to = append(to, m.To)
+		}
+	}
+	sort.Slice(to, func(i, j int) bool { return to[i] < to[j] })
+	if wto := []uint64{2, 3, 5}; !reflect.DeepEqual(to, wto) {
+		t.Errorf("appends to %v, want %v", to, wto)
+	}
+}
+
+// TestProposeStaleTerm2AB tests that a proposal tagged with the term of a
+// previous leader is dropped once leadership has changed, while a proposal
+// tagged with the current term is appended.
+func TestProposeStaleTerm2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	staleTerm := nt.peers[1].(*Raft).Term
+
+	nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgHup})
+	r := nt.peers[2].(*Raft)
+	if r.State != StateLeader || r.Term == staleTerm {
+		t.Fatalf("node 2 state = %s at term %d, want leader of a newer term than %d", r.State, r.Term, staleTerm)
+	}
+
+	lastIndex := r.RaftLog.LastIndex()
+	err := r.Step(pb.Message{From: 2, To: 2, Term: staleTerm, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("stale")}}})
+	if !errors.Is(err, ErrProposalDropped) {
+		t.Errorf("stale propose err = %v, want %v", err, ErrProposalDropped)
+	}
+	if r.RaftLog.LastIndex() != lastIndex {
+		t.Errorf("lastIndex = %d, want %d", r.RaftLog.LastIndex(), lastIndex)
+	}
+
+	err = r.Step(pb.Message{From: 2, To: 2, Term: r.Term, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("fresh")}}})
+	if err != nil {
+		t.Errorf("current term propose err = %v, want nil", err)
+	}
+	if r.RaftLog.LastIndex() != lastIndex+1 {
+		t.Errorf("lastIndex = %d, want %d", r.RaftLog.LastIndex(), lastIndex+1)
+	}
+}
+
+// TestRaftTermConfusion2AB tests that a delayed MsgAppendResponse from a term
+// in which the node was leader is ignored after it steps down, and still after
+// it is elected again in a later term.
+func TestRaftTermConfusion2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.Term = 4
+	r.becomeCandidate()
+	r.becomeLeader()
+	if r.Term != 5 {
+		t.Fatalf("term = %d, want 5", r.Term)
+	}
+	r.readMessages()
+	stale := pb.Message{From: 2, To: 1, Term: 5, MsgType: pb.MessageType_MsgAppendResponse, Index: r.RaftLog.LastIndex(), Commit: r.RaftLog.LastIndex()}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: 6, MsgType: pb.MessageType_MsgHeartbeat})
+	if r.State != StateFollower || r.Term != 6 {
+		t.Fatalf("state = %s at term %d, want follower at term 6", r.State, r.Term)
+	}
+	r.readMessages()
+	pr := *r.Prs[2]
+	r.Step(stale)
+	if got := r.Prs[2]; got.Match != pr.Match || got.Next != pr.Next || got.Committed != pr.Committed {
+		t.Errorf("follower progress of 2 = %+v, want %+v", *got, pr)
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("follower msgs = %+v, want none", msgs)
+	}
+
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	pr = *r.Prs[2]
+	r.Step(stale)
+	if got := r.Prs[2]; got.Match != pr.Match || got.Next != pr.Next || got.Committed != pr.Committed {
+		t.Errorf("leader progress of 2 = %+v, want %+v", *got, pr)
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("leader msgs = %+v, want none", msgs)
+	}
+}
+
+// TestMaxEntriesPerMsg2AB tests that a follower that is far behind receives
+// the backlog in append messages of at most MaxEntriesPerMsg entries each,
+// the next batch following the acknowledgement of the previous one.
+func TestMaxEntriesPerMsg2AB(t *testing.T) {
+	const maxEntries = 2
+	nt := newNetworkWithConfig(func(c *Config) { c.MaxEntriesPerMsg = maxEntries }, nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.isolate(3)
+	for i := 0; i < 9; i++ {
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+	}
+	lead := nt.peers[1].(*Raft)
+	follower := nt.peers[3].(*Raft)
+	backlog := lead.RaftLog.LastIndex() - follower.RaftLog.LastIndex()
+
+	var batches []int
+	nt.recover()
+	nt.msgHook = func(m pb.Message) bool {
+		if m.MsgType == pb.MessageType_MsgAppend && m.To == 3 && len(m.Entries) != 0 {
+			batches = append(batches, len(m.Entries))
+		}
+		return true
+	}
+	lead.sendAppend(3)
+	nt.send(nt.filter(lead.readMessages())...)
+
+	if follower.RaftLog.LastIndex() != lead.RaftLog.LastIndex() {
+		t.Fatalf("follower lastIndex = %d, want %d\n%s", follower.RaftLog.LastIndex(), lead.RaftLog.LastIndex(), nt.progressTable())
+	}
+	if follower.RaftLog.committed != lead.RaftLog.committed {
+		t.Errorf("follower committed = %d, want %d", follower.RaftLog.committed, lead.RaftLog.committed)
+	}
+	sent := 0
+	for i, n := range batches {
+		if n > maxEntries {
+			t.Errorf("batch %d has %d entries, want at most %d", i, n, maxEntries)
+		}
+		sent += n
+	}
+	if want := int((backlog + maxEntries - 1) / maxEntries); len(batches) != want {
+		t.Errorf("batches = %v, want %d of them", batches, want)
+	}
+	if sent != int(backlog) {
+		t.Errorf("sent %d entries, want %d", sent, backlog)
+	}
+}
+
+// TestRemovedNodeLateResponses3A tests that the leader ignores responses that
+// arrive from a node after it was removed from the group.
+func TestRemovedNodeLateResponses3A(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	r.removeNode(3)
+
+	for _, m := range []pb.Message{
+		{From: 3, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: r.RaftLog.LastIndex()},
+		{From: 3, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgHeartbeatResponse},
+		{From: 3, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgRequestVoteResponse},
+	} {
+		r.Step(m)
+		if r.Prs[3] != nil {
+			t.Errorf("%s: progress of removed node 3 = %v, want nil", m.MsgType, r.Prs[3])
+		}
+		if msgs := r.readMessages(); len(msgs) != 0 {
+			t.Errorf("%s: msgs = %+v, want none", m.MsgType, msgs)
+		}
+	}
+}
+
+// TestRejectedVoteStepsDown2AA tests that a vote request with a higher term
+// makes the node step down and adopt the term even when the candidate's log is
+// behind and the vote is rejected, leaving the vote free for a candidate of
+// that term with an up-to-date log.
+func TestRejectedVoteStepsDown2AA(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	lastIndex, lastTerm := r.RaftLog.LastIndex(), r.RaftLog.lastTerm()
+
+	r.Step(pb.Message{From: 2, To: 1, Term: 5, MsgType: pb.MessageType_MsgRequestVote})
+	if r.State != StateFollower || r.Term != 5 || r.Vote != None {
+		t.Fatalf("state = %s, term = %d, vote = %d, want follower, 5, %d", r.State, r.Term, r.Vote, None)
+	}
+	msgs := r.readMessages()
+	if len(msgs) != 1 || !msgs[0].Reject || msgs[0].Term != 5 {
+		t.Fatalf("msgs = %+v, want one rejection at term 5", msgs)
+	}
+
+	r.Step(pb.Message{From: 3, To: 1, Term: 5, LogTerm: lastTerm, Index: lastIndex, MsgType: pb.MessageType_MsgRequestVote})
+	if r.Vote != 3 {
+		t.Errorf("vote = %d, want 3", r.Vote)
+	}
+	if msgs := r.readMessages(); len(msgs) != 1 || msgs[0].Reject {
+		t.Errorf("msgs = %+v, want one granted vote", msgs)
+	}
+}
+
+// TestAppendRecordsLeader2AA tests that a node learns the leader of its term
+// from the leader's append, whether it already followed without knowing the
+// leader or was still a candidate.
+func TestAppendRecordsLeader2AA(t *testing.T) {
+	follower := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	follower.becomeFollower(1, None)
+	candidate := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	candidate.becomeCandidate()
+
+	for i, r := range []*Raft{follower, candidate} {
+		r.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppend})
+		if r.State != StateFollower || r.Lead != 2 {
+			t.Errorf("#%d: state = %s, lead = %d, want follower of 2", i, r.State, r.Lead)
+		}
+	}
+}
+
+// a snapshot matching the follower's log compacts it, keeps the entries after
+// the snapshot and takes the membership from the snapshot's ConfState
+func TestHandleSnapshotKeepsMatchingLog2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 2}, {Index: 4, Term: 3}})
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	snap := &pb.Snapshot{Metadata: &pb.SnapshotMetadata{
+		Index:     3,
+		Term:      2,
+		ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}},
+	}}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 3, MsgType: pb.MessageType_MsgSnapshot, Snapshot: snap})
+
+	if g := sm.RaftLog.allEntries(); !reflect.DeepEqual(g, []pb.Entry{{Index: 4, Term: 3}}) {
+		t.Errorf("entries = %+v, want only the entry after the snapshot", g)
+	}
+	if sm.RaftLog.committed != 3 || sm.RaftLog.pendingSnapshot != snap {
+		t.Errorf("committed, pendingSnapshot = %d, %v, want 3, the snapshot", sm.RaftLog.committed, sm.RaftLog.pendingSnapshot)
+	}
+	if g := nodes(sm); !reflect.DeepEqual(g, []uint64{1, 2, 3}) {
+		t.Errorf("nodes = %v, want [1 2 3]", g)
+	}
+	msgs := sm.readMessages()
+	if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgAppendResponse || msgs[0].Reject || msgs[0].Index != 4 {
+		t.Errorf("msgs = %+v, want an accepting append response at index 4", msgs)
+	}
+}
+
+// a follower installing a snapshot from a leader of a higher term acks it at
+// the new term, an ack at the old term would be dropped by the leader as stale
+func TestHandleSnapshotFromHigherTerm2C(t *testing.T) {
+	tests := []struct {
+		index  uint64
+		windex uint64
+	}{
+		{11, 11},
+		// the snapshot is behind the follower's commit index and is ignored
+		{2, 3},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 3}})
+		sm := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+		sm.becomeFollower(3, None)
+		sm.RaftLog.committed = 3
+		snap := &pb.Snapshot{Metadata: &pb.SnapshotMetadata{
+			Index:     tt.index,
+			Term:      4,
+			ConfState: &pb.ConfState{Nodes: []uint64{1, 2}},
+		}}
+		sm.Step(pb.Message{From: 2, To: 1, Term: 5, MsgType: pb.MessageType_MsgSnapshot, Snapshot: snap})
+
+		if sm.Term != 5 || sm.Lead != 2 {
+			t.Errorf("#%d: term, lead = %d, %d, want 5, 2", i, sm.Term, sm.Lead)
+		}
+		msgs := sm.readMessages()
+		if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgAppendResponse || msgs[0].Reject {
+			t.Fatalf("#%d: msgs = %+v, want one accepting append response", i, msgs)
+		}
+		if msgs[0].Term != 5 || msgs[0].Index != tt.windex {
+			t.Errorf("#%d: ack term, index = %d, %d, want 5, %d", i, msgs[0].Term, msgs[0].Index, tt.windex)
+		}
+	}
+}
+
+// a rejection only tells the leader where to probe next, the index it names
+// is not verified and must never count as replicated
+func TestAppendRejectKeepsMatch2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}})
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	committed, last := r.RaftLog.committed, r.RaftLog.LastIndex()
+
+	// both followers reject, naming their last index, which is at or beyond
+	// the leader's last index
+	for _, id := range []uint64{2, 3} {
+		pr := r.Prs[id]
+		pr.Next = last + 1
+		r.Step(pb.Message{From: id, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Reject: true, Index: last + 5})
+		if pr.Match != 0 {
+			t.Errorf("peer %d: match = %d, want 0", id, pr.Match)
+		}
+		if pr.Next != last {
+			t.Errorf("peer %d: next = %d, want %d", id, pr.Next, last)
+		}
+		r.Step(pb.Message{From: id, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Reject: true, Index: 1})
+		if pr.Match != 0 || pr.Next != 2 {
+			t.Errorf("peer %d: match, next = %d, %d, want 0, 2", id, pr.Match, pr.Next)
+		}
+	}
+	if r.RaftLog.committed != committed {
+		t.Errorf("committed = %d, want %d", r.RaftLog.committed, committed)
+	}
+
+	// once accepted, the next rejection can't move Next below Match
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 3})
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Reject: true, Index: 1})
+	if pr := r.Prs[2]; pr.Match != 3 || pr.Next != 4 {
+		t.Errorf("match, next = %d, %d, want 3, 4", pr.Match, pr.Next)
+	}
+}
+
+// a follower rejecting an append names the conflicting term and skips all its
+// entries in that term, and the leader probes from its own last entry in that
+// term, so the logs converge in one round trip per term instead of per entry
+func TestAppendRejectBacktracksByTerm2AB(t *testing.T) {
+	leaderEnts := []pb.Entry{
+		{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3},
+		{Term: 4, Index: 4}, {Term: 4, Index: 5},
+		{Term: 5, Index: 6}, {Term: 5, Index: 7},
+		{Term: 6, Index: 8}, {Term: 6, Index: 9}, {Term: 6, Index: 10},
+	}
+	tests := []struct {
+		followerEnts []pb.Entry
+		wrejects     int
+	}{
+		// the follower's terms 3 and 2 are not in the leader's log
+		{[]pb.Entry{
+			{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3},
+			{Term: 2, Index: 4}, {Term: 2, Index: 5}, {Term: 2, Index: 6},
+			{Term: 3, Index: 7}, {Term: 3, Index: 8}, {Term: 3, Index: 9}, {Term: 3, Index: 10}, {Term: 3, Index: 11},
+		}, 2},
+		// the leader has term 4 and resumes from its last entry in it
+		{[]pb.Entry{
+			{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3},
+			{Term: 4, Index: 4}, {Term: 4, Index: 5}, {Term: 4, Index: 6}, {Term: 4, Index: 7},
+		}, 2},
+	}
+	for i, tt := range tests {
+		leadStorage := NewMemoryStorage()
+		leadStorage.Append(leaderEnts)
+		lead := newTestRaft(1, []uint64{1, 2}, 10, 1, leadStorage)
+		lead.Term = 7
+		lead.becomeCandidate()
+		lead.becomeLeader()
+		lead.readMessages()
+		followerStorage := NewMemoryStorage()
+		followerStorage.Append(tt.followerEnts)
+		follower := newTestRaft(2, []uint64{1, 2}, 10, 1, followerStorage)
+
+		pr := lead.Prs[2]
+		pr.Match, pr.Next = 0, 11
+		rejects := 0
+		for round := 0; round < 20; round++ {
+			lead.sendAppend(2)
+			for _, m := range lead.readMessages() {
+				follower.Step(m)
+			}
+			accepted := false
+			for _, m := range follower.readMessages() {
+				if m.Reject {
+					rejects++
+				} else {
+					accepted = true
+				}
+				lead.Step(m)
+			}
+			if accepted {
+				break
+			}
+		}
+		if rejects != tt.wrejects {
+			t.Errorf("#%d: rejects = %d, want %d", i, rejects, tt.wrejects)
+		}
+		if g, w := follower.RaftLog.allEntries(), lead.RaftLog.allEntries(); !reflect.DeepEqual(g, w) {
+			t.Errorf("#%d: follower entries = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func entsWithConfig(configFunc func(*Config), id uint64, terms ...uint64) *Raft {
+	storage := NewMemoryStorage()
+	for i, term := range terms {
+		storage.Append([]pb.Entry{{Index: uint64(i + 1), Term: term}})
+	}
+	cfg := newTestConfig(id, []uint64{}, 5, 1, storage)
+	if configFunc != nil {
+		configFunc(cfg)
+	}
+	sm := newRaft(cfg)
+	sm.Term = terms[len(terms)-1]
+	return sm
+}
+
+// votedWithConfig creates a raft state machine with Vote and Term set
+// to the given value but no log entries (indicating that it voted in
+// the given term but has not received any logs).
+func votedWithConfig(configFunc func(*Config), id, vote, term uint64) *Raft {
+	storage := NewMemoryStorage()
+	storage.SetHardState(pb.HardState{Vote: vote, Term: term})
+	cfg := newTestConfig(id, []uint64{}, 5, 1, storage)
+	if configFunc != nil {
+		configFunc(cfg)
+	}
+	sm := newRaft(cfg)
+	sm.Term = term
+	return sm
+}
+
+type network struct {
+	peers   map[uint64]stateMachine
+	storage map[uint64]*MemoryStorage
+	dropm   map[connem]float64
+	ignorem map[pb.MessageType]bool
+
+	// msgHook is called for each message sent. It may inspect the
+	// message and return true to send it or false to drop it.
+	msgHook func(pb.Message) bool
+}
+
+// newNetwork initializes a network from peers.
+// A nil node will be replaced with a new *stateMachine.
+// A *stateMachine will get its k, id.
+// When using stateMachine, the address list is always [1, n].
+func newNetwork(peers ...stateMachine) *network {
+	return newNetworkWithConfig(nil, peers...)
+}
+
+// newNetworkWithConfig is like newNetwork but calls the given func to
+// modify the configuration of any state machines it creates.
+func newNetworkWithConfig(configFunc func(*Config), peers ...stateMachine) *network {
+	size := len(peers)
+	peerAddrs := idsBySize(size)
+
+	npeers := make(map[uint64]stateMachine, size)
+	nstorage := make(map[uint64]*MemoryStorage, size)
+
+	for j, p := range peers {
+		id := peerAddrs[j]
+		switch v := p.(type) {
+		case nil:
+			nstorage[id] = NewMemoryStorage()
+			cfg := newTestConfig(id, peerAddrs, 10, 1, nstorage[id])
+			if configFunc != nil {
+				configFunc(cfg)
+			}
+			sm := newRaft(cfg)
+			npeers[id] = sm
+		case *Raft:
+			v.id = id
+			npeers[id] = v
+		case *blackHole:
+			npeers[id] = v
+		default:
+			panic(fmt.Sprintf("unexpected state machine type: %T", p))
+		}
+	}
+	return &network{
+		peers:   npeers,
+		storage: nstorage,
+		dropm:   make(map[connem]float64),
+		ignorem: make(map[pb.MessageType]bool),
+	}
+}
+
+func (nw *network) send(msgs ...pb.Message) {
+	for len(msgs) > 0 {
+		m := msgs[0]
+		p := nw.peers[m.To]
+		p.Step(m)
+		msgs = append(msgs[1:], nw.filter(p.readMessages())...)
+	}
+}
+
+// progressTable formats the progress every leader in the network keeps of its
+// peers, for failure messages.
+func (nw *network) progressTable() string {
+	var b strings.Builder
+	for _, id := range idsBySize(len(nw.peers)) {
+		r, ok := nw.peers[id].(*Raft)
+		if !ok || r.State != StateLeader {
+			continue
+		}
+		fmt.Fprintf(&b, "leader %d term %d:\n", r.id, r.Term)
+		for _, pid := range nodes(r) {
+			fmt.Fprintf(&b, "  %d: %s\n", pid, *r.Prs[pid])
+		}
+	}
+	return b.String()
+}
+
+func (nw *network) drop(from, to uint64, perc float64) {
+	nw.dropm[connem{from, to}] = perc
+}
+
+func (nw *network) cut(one, other uint64) {
+	nw.drop(one, other, 2.0) // always drop
+	nw.drop(other, one, 2.0) // always drop
+}
+
+func (nw *network) isolate(id uint64) {
+	for i := 0; i < len(nw.peers); i++ {
+		nid := uint64(i) + 1
+		if nid != id {
+			nw.drop(id, nid, 1.0) // always drop
+			nw.drop(nid, id, 1.0) // always drop
+		}
+	}
+}
+
+func (nw *network) ignore(t pb.MessageType) {
+	nw.ignorem[t] = true
+}
+
+func (nw *network) recover() {
+	nw.dropm = make(map[connem]float64)
+	nw.ignorem = make(map[pb.MessageType]bool)
+}
+
+func (nw *network) filter(msgs []pb.Message) []pb.Message {
+	mm := []pb.Message{}
+	for _, m := range msgs {
+		if nw.ignorem[m.MsgType] {
+			continue
+		}
+		switch m.MsgType {
+		case pb.MessageType_MsgHup:
+			// hups never go over the network, so don't drop them but panic
+			panic("unexpected MessageType_MsgHup")
+		default:
+			perc := nw.dropm[connem{m.From, m.To}]
+			if n := rand.Float64(); n < perc {
+				continue
+			}
+		}
+		if nw.msgHook != nil {
+			if !nw.msgHook(m) {
+				continue
+			}
+		}
+		mm = append(mm, m)
+	}
+	return mm
+}
+
+// assertLogsConsistent checks that the raft nodes among peers agree on every
+// entry up to the lowest committed index, the log matching guarantee every
+// committed prefix must keep. Entries compacted away on some node are skipped.
+func assertLogsConsistent(t *testing.T, peers map[uint64]stateMachine) {
+	t.Helper()
+	var rafts []*Raft
+	for _, id := range idsBySize(len(peers)) {
+		if r, ok := peers[id].(*Raft); ok {
+			rafts = append(rafts, r)
+		}
+	}
+	if len(rafts) < 2 {
+		return
+	}
+	lo, hi := uint64(1), rafts[0].RaftLog.committed
+	for _, r := range rafts {
+		lo = max(lo, r.RaftLog.firstIndex())
+		hi = min(hi, r.RaftLog.committed)
+	}
+	if lo > hi {
+		return
+	}
+	want := rafts[0].RaftLog.slice(lo, hi+1)
+	for _, r := range rafts[1:] {
+		if g := r.RaftLog.slice(lo, hi+1); !reflect.DeepEqual(g, want) {
+			t.Fatalf("node %d diverges from node %d in [%d, %d]:\n%s", r.id, rafts[0].id, lo, hi,
+				diffu(ltoa(rafts[0].RaftLog), ltoa(r.RaftLog)))
+		}
+	}
+}
+
+type connem struct {
 	from, to uint64
 }
 
@@ -1702,6 +3914,19 @@ func (blackHole) readMessages() []pb.Message { return nil }
 
 var nopStepper = &blackHole{}
 
+// skewClock sets the elapsed ticks of r as if its clock had run ahead, so a
+// test can fire a timeout on an exact tick.
+func skewClock(r *Raft, electionElapsed, heartbeatElapsed int) {
+	r.electionElapsed = electionElapsed
+	r.heartbeatElapsed = heartbeatElapsed
+}
+
+// fixedTimeout makes every later campaign of r wait exactly extra ticks
+// beyond the base election timeout instead of a random number.
+func fixedTimeout(r *Raft, extra int) {
+	r.randomTimeout = func(int) int { return extra }
+}
+
 func idsBySize(size int) []uint64 {
 	ids := make([]uint64, size)
 	for i := 0; i < size; i++ {
@@ -16,6 +16,9 @@ package raft
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 
 	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 )
@@ -64,18 +67,96 @@ type Ready struct {
 	// If it contains a MessageType_MsgSnapshot message, the application MUST report back to raft
 	// when the snapshot has been received or has failed by calling ReportSnapshot.
 	Messages []pb.Message
+
+	// ReadStates can be used to serve linearizable read requests locally
+	// once the applied index is greater than or equal to the index in ReadState.
+	ReadStates []ReadState
+
+	// msgsRead is the number of pending messages, stale ones included, this
+	// Ready took Messages from, Advance removes them.
+	msgsRead int
 }
 
 // RawNode is a wrapper of Raft.
+//
+// A RawNode is not safe for concurrent use: every method, Propose and Step in
+// particular, must be called from the single goroutine that owns the node.
+// Proposals are therefore serialized, each one is stamped with the indexes
+// following the current last index before the next one is looked at, so the
+// entries of a burst of proposals get strictly increasing indexes without gaps.
 type RawNode struct {
 	Raft *Raft
 	// Your Data Here (2A).
+	// prevSoftSt and prevHardSt are the states reported by the last advanced
+	// Ready, or the initial ones, a Ready only carries them when they change.
+	prevSoftSt SoftState
+	prevHardSt pb.HardState
 }
 
 // NewRawNode returns a new RawNode given configuration and a list of raft peers.
+// A node restarted without peers takes its membership from the ConfState of
+// config.Storage.
 func NewRawNode(config *Config) (*RawNode, error) {
 	// Your Code Here (2A).
-	return nil, nil
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	r := newRaft(config)
+	return &RawNode{
+		Raft:       r,
+		prevSoftSt: r.softState(),
+		prevHardSt: r.hardState(),
+	}, nil
+}
+
+// Bootstrap initializes a brand-new cluster with the given voters. It must be
+// called on a node created without peers over an empty Storage. Bootstrap
+// appends and commits one AddNode conf change entry per peer at term 1 and
+// applies them, so the node comes up with the right membership. The entries
+// are unstable, the application persists them like any other new entries and
+// later applies them again through ApplyConfChange, which is idempotent.
+func (rn *RawNode) Bootstrap(peers []uint64) error {
+	if len(peers) == 0 {
+		return errors.New("raft: bootstrap needs at least one peer")
+	}
+	r := rn.Raft
+	if len(r.Prs) != 0 {
+		return errors.New("raft: can't bootstrap a node configured with peers")
+	}
+	hs, _, err := r.RaftLog.storage.InitialState()
+	if err != nil {
+		return err
+	}
+	lastIndex, err := r.RaftLog.storage.LastIndex()
+	if err != nil {
+		return err
+	}
+	if lastIndex != 0 || !IsEmptyHardState(hs) || r.RaftLog.LastIndex() != 0 {
+		return errors.New("raft: can't bootstrap a nonempty Storage")
+	}
+
+	ccs := make([]pb.ConfChange, len(peers))
+	ents := make([]*pb.Entry, len(peers))
+	for i, id := range peers {
+		ccs[i] = pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: id}
+		data, err := ccs[i].Marshal()
+		if err != nil {
+			return err
+		}
+		ents[i] = &pb.Entry{EntryType: pb.EntryType_EntryConfChange, Data: data}
+	}
+	r.becomeFollower(1, None)
+	r.appendEntry(ents...)
+	r.RaftLog.committed = uint64(len(ents))
+	for i, cc := range ccs {
+		rn.ApplyConfChangeAt(ents[i].Index, cc)
+	}
+	// sendAppend expects Next to follow Match, start every peer from the
+	// beginning of the log as for the peers given in Config
+	for _, pr := range r.Prs {
+		pr.Match, pr.Next = 0, 1
+	}
+	return nil
 }
 
 // Tick advances the internal logical clock by a single tick.
@@ -90,7 +171,9 @@ func (rn *RawNode) Campaign() error {
 	})
 }
 
-// Propose proposes data be appended to the raft log.
+// Propose proposes data be appended to the raft log. On a node that is not the
+// leader it fails immediately with an ErrNotLeader, which is an
+// ErrProposalDropped as well, so the caller can retry against the leader.
 func (rn *RawNode) Propose(data []byte) error {
 	ent := pb.Entry{Data: data}
 	return rn.Raft.Step(pb.Message{
@@ -99,6 +182,38 @@ func (rn *RawNode) Propose(data []byte) error {
 		Entries: []*pb.Entry{&ent}})
 }
 
+// ProposeAtTerm proposes data like Propose, but only if this node is still the
+// leader of term. If leadership has changed since the caller learned the term,
+// the proposal fails with ErrProposalDropped and nothing is appended, so a
+// client retrying a request cannot get it appended twice by different leaders.
+func (rn *RawNode) ProposeAtTerm(term uint64, data []byte) error {
+	ent := pb.Entry{Data: data}
+	return rn.Raft.Step(pb.Message{
+		MsgType: pb.MessageType_MsgPropose,
+		From:    rn.Raft.id,
+		Term:    term,
+		Entries: []*pb.Entry{&ent}})
+}
+
+// ProposeWithContext proposes data like Propose and attaches ctx to the new
+// entry, EntryContext returns it once the entry is committed so the
+// application can correlate the apply with the originating request. The
+// context stays on this node, it is not replicated.
+func (rn *RawNode) ProposeWithContext(ctx, data []byte) error {
+	rn.Raft.proposalCtx = ctx
+	defer func() { rn.Raft.proposalCtx = nil }()
+	return rn.Propose(data)
+}
+
+// EntryContext returns the context ent was proposed with on this node, or nil
+// if it was proposed without one, elsewhere, or has already been applied.
+func (rn *RawNode) EntryContext(ent pb.Entry) []byte {
+	if ec, ok := rn.Raft.entryCtxs[ent.Index]; ok && ec.term == ent.Term {
+		return ec.ctx
+	}
+	return nil
+}
+
 // ProposeConfChange proposes a config change.
 func (rn *RawNode) ProposeConfChange(cc pb.ConfChange) error {
 	data, err := cc.Marshal()
@@ -112,8 +227,15 @@ func (rn *RawNode) ProposeConfChange(cc pb.ConfChange) error {
 	})
 }
 
-// ApplyConfChange applies a config change to the local node.
+// ApplyConfChange applies a config change to the local node. The change is
+// recorded in the conf change history at the index of its committed entry.
 func (rn *RawNode) ApplyConfChange(cc pb.ConfChange) *pb.ConfState {
+	return rn.ApplyConfChangeAt(rn.Raft.confChangeIndex(cc), cc)
+}
+
+// ApplyConfChangeAt applies a config change committed at the given log
+// index to the local node and records it in the conf change history.
+func (rn *RawNode) ApplyConfChangeAt(index uint64, cc pb.ConfChange) *pb.ConfState {
 	if cc.NodeId == None {
 		return &pb.ConfState{Nodes: nodes(rn.Raft)}
 	}
@@ -125,9 +247,15 @@ func (rn *RawNode) ApplyConfChange(cc pb.ConfChange) *pb.ConfState {
 	default:
 		panic("unexpected conf type")
 	}
+	rn.Raft.recordConfChange(index, cc)
 	return &pb.ConfState{Nodes: nodes(rn.Raft)}
 }
 
+// ConfChangeHistory returns the most recently applied conf changes.
+func (rn *RawNode) ConfChangeHistory() []ConfChangeRecord {
+	return rn.Raft.ConfChangeHistory()
+}
+
 // Step advances the state machine using the given message.
 func (rn *RawNode) Step(m pb.Message) error {
 	// ignore unexpected local messages receiving over network
@@ -141,21 +269,130 @@ func (rn *RawNode) Step(m pb.Message) error {
 }
 
 // Ready returns the current point-in-time state of this RawNode.
+//
+// Messages and SoftState are taken at the same moment: when the leader or the
+// role changed since the last Ready the new SoftState comes along with the
+// messages, so the application can update its routing before sending them.
+// Messages generated in an earlier term than the current one are left out,
+// they are stale once the node has moved to a new term.
+//
+// With Config.EntryChecksum the checksum of every CommittedEntries entry is
+// verified and stripped. A corrupted entry must never be applied and Ready has
+// no way to return an error, so a corrupted entry makes Ready panic with an
+// error wrapping ErrEntryChecksumMismatch. That is the only way corruption is
+// reported, an application that wants to survive it recovers the panic and
+// checks the error with errors.Is.
 func (rn *RawNode) Ready() Ready {
 	// Your Code Here (2A).
-	return Ready{}
+	r := rn.Raft
+	rd := Ready{
+		Entries:          r.RaftLog.unstableEntries(),
+		CommittedEntries: r.RaftLog.nextEnts(),
+	}
+	if r.entryChecksum {
+		ents, err := verifyEntries(rd.CommittedEntries)
+		if err != nil {
+			panic(err)
+		}
+		rd.CommittedEntries = ents
+	}
+	if ss := r.softState(); ss != rn.prevSoftSt {
+		rd.SoftState = &ss
+	}
+	if hs := r.hardState(); !isHardStateEqual(hs, rn.prevHardSt) {
+		rd.HardState = hs
+	}
+	if !IsEmptySnap(r.RaftLog.pendingSnapshot) {
+		rd.Snapshot = *r.RaftLog.pendingSnapshot
+	}
+	if len(r.msgs) != 0 {
+		rd.msgsRead = len(r.msgs)
+		for _, m := range r.msgs {
+			// 本地消息的Term为0
+			if m.Term == 0 || m.Term >= r.Term {
+				rd.Messages = append(rd.Messages, m)
+			}
+		}
+	}
+	if len(r.readStates) != 0 {
+		rd.ReadStates = r.readStates
+	}
+	return rd
 }
 
 // HasReady called when RawNode user need to check if any Ready pending.
 func (rn *RawNode) HasReady() bool {
 	// Your Code Here (2A).
+	r := rn.Raft
+	if r.softState() != rn.prevSoftSt || len(r.msgs) != 0 {
+		return true
+	}
+	if hs := r.hardState(); !IsEmptyHardState(hs) && !isHardStateEqual(hs, rn.prevHardSt) {
+		return true
+	}
+	if !IsEmptySnap(r.RaftLog.pendingSnapshot) {
+		return true
+	}
+	if len(r.RaftLog.unstableEntries()) != 0 || r.RaftLog.hasNextEnts() {
+		return true
+	}
+	if len(r.readStates) != 0 {
+		return true
+	}
 	return false
 }
 
+// ApplyNotify returns a channel that receives a value whenever the committed
+// index advances past the applied index, so the application can wait for
+// work instead of polling HasReady. The channel holds at most one value:
+// signals are never blocked on and coalesce while the previous one is not
+// received. Entries left unapplied by Advance are not signalled again until
+// the committed index moves on.
+func (rn *RawNode) ApplyNotify() <-chan struct{} {
+	if rn.Raft.applyc == nil {
+		rn.Raft.applyc = make(chan struct{}, 1)
+		rn.Raft.notifiedCommit = rn.Raft.RaftLog.applied
+		rn.Raft.notifyApply()
+	}
+	return rn.Raft.applyc
+}
+
 // Advance notifies the RawNode that the application has applied and saved progress in the
 // last Ready results.
 func (rn *RawNode) Advance(rd Ready) {
 	// Your Code Here (2A).
+	r := rn.Raft
+	if !IsEmptyHardState(rd.HardState) {
+		rn.prevHardSt = rd.HardState
+	}
+	// 只清除这次Ready交出的snapshot, 之后收到的新snapshot留到下一个Ready
+	if !IsEmptySnap(&rd.Snapshot) && !IsEmptySnap(r.RaftLog.pendingSnapshot) &&
+		r.RaftLog.pendingSnapshot.Metadata.Index == rd.Snapshot.Metadata.Index {
+		r.RaftLog.pendingSnapshot = new(pb.Snapshot)
+	}
+	if n := len(rd.Entries); n != 0 {
+		e := rd.Entries[n-1]
+		rn.Raft.RaftLog.stableTo(e.Index, e.Term)
+	}
+	if n := len(rd.CommittedEntries); n != 0 {
+		rn.Raft.RaftLog.appliedTo(rd.CommittedEntries[n-1].Index)
+		for _, ent := range rd.CommittedEntries {
+			delete(rn.Raft.entryCtxs, ent.Index)
+		}
+	}
+	if len(rd.ReadStates) != 0 {
+		rn.Raft.readStates = nil
+	}
+	if rd.SoftState != nil {
+		rn.prevSoftSt = *rd.SoftState
+	}
+	// Ready之后产生的消息留到下一个Ready
+	if n := rd.msgsRead; n != 0 {
+		if n > len(rn.Raft.msgs) {
+			n = len(rn.Raft.msgs)
+		}
+		rn.Raft.msgs = rn.Raft.msgs[n:]
+	}
 }
 
 // GetProgress return the Progress of this node and its peers, if this
@@ -170,6 +407,97 @@ func (rn *RawNode) GetProgress() map[uint64]Progress {
 	return prs
 }
 
+// Status contains information about this raft node and its peers.
+type Status struct {
+	ID uint64
+
+	pb.HardState
+	SoftState
+
+	Applied uint64
+	// Progress is the progress of every peer, it is empty unless this node
+	// is the leader.
+	Progress map[uint64]Progress
+
+	// PendingMessages and PendingMessageBytes are the number and encoded size
+	// of the outgoing messages not taken by Ready yet.
+	PendingMessages     int
+	PendingMessageBytes uint64
+}
+
+// String formats the status on one line per peer progress, in id order.
+func (s Status) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id:%d term:%d vote:%d commit:%d applied:%d lead:%d state:%s",
+		s.ID, s.Term, s.Vote, s.Commit, s.Applied, s.Lead, s.RaftState)
+	ids := make([]uint64, 0, len(s.Progress))
+	for id := range s.Progress {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fmt.Fprintf(&b, "\n%d: %s", id, s.Progress[id])
+	}
+	return b.String()
+}
+
+// Status returns the current status of the raft node.
+func (rn *RawNode) Status() Status {
+	r := rn.Raft
+	var bytes uint64
+	for i := range r.msgs {
+		bytes += uint64(r.msgs[i].Size())
+	}
+	return Status{
+		ID:                  r.id,
+		HardState:           r.hardState(),
+		SoftState:           SoftState{Lead: r.Lead, RaftState: r.State},
+		Applied:             r.RaftLog.applied,
+		Progress:            rn.GetProgress(),
+		PendingMessages:     len(r.msgs),
+		PendingMessageBytes: bytes,
+	}
+}
+
+// ReadIndex requests a read state. The read state will be set in ready.
+// Read State has a read index. Once the application advances further than the read
+// index, any linearizable read requests issued before the read request can be
+// processed safely. The read state will have the same rctx attached, so rctx
+// must be unique among the pending reads, ErrDuplicateReadCtx is returned
+// otherwise.
+func (rn *RawNode) ReadIndex(rctx []byte) error {
+	return rn.Raft.readIndex(rctx)
+}
+
+// ApplyLag returns the number of committed but not yet applied entries.
+func (rn *RawNode) ApplyLag() uint64 {
+	return rn.Raft.ApplyLag()
+}
+
+// SnapshotStatus is the result of sending a snapshot to a peer.
+type SnapshotStatus int
+
+const (
+	SnapshotFinish SnapshotStatus = iota + 1
+	SnapshotFailure
+)
+
+// ReportUnreachable reports the given node is not reachable for the last send.
+func (rn *RawNode) ReportUnreachable(id uint64) {
+	rn.Raft.reportUnreachable(id)
+}
+
+// ReportSnapshot reports the status of the sent snapshot.
+func (rn *RawNode) ReportSnapshot(id uint64, status SnapshotStatus) {
+	rn.Raft.reportSnapshot(id, status)
+}
+
+// StepDown makes the leader give up its leadership without a transfer target,
+// see Raft.StepDown.
+func (rn *RawNode) StepDown() {
+	rn.Raft.StepDown()
+}
+
 // TransferLeader tries to transfer leadership to the given transferee.
 func (rn *RawNode) TransferLeader(transferee uint64) {
 	_ = rn.Raft.Step(pb.Message{MsgType: pb.MessageType_MsgTransferLeader, From: transferee})
@@ -16,6 +16,8 @@ package raft
 
 import (
 	"bytes"
+	"errors"
+	"math"
 	"reflect"
 	"testing"
 
@@ -27,7 +29,7 @@ type ignoreSizeHintMemStorage struct {
 }
 
 func (s *ignoreSizeHintMemStorage) Entries(lo, hi uint64, maxSize uint64) ([]pb.Entry, error) {
-	return s.MemoryStorage.Entries(lo, hi)
+	return s.MemoryStorage.Entries(lo, hi, math.MaxUint64)
 }
 
 // TestRawNodeProposeAndConfChange ensures that RawNode.Propose and RawNode.ProposeConfChange
@@ -140,7 +142,7 @@ func TestRawNodeProposeAddDuplicateNode3A(t *testing.T) {
 	}
 
 	// the last three entries should be: ConfChange cc1, cc1, cc2
-	entries, err := s.Entries(lastIndex-2, lastIndex+1)
+	entries, err := s.Entries(lastIndex-2, lastIndex+1, math.MaxUint64)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -250,3 +252,671 @@ func TestRawNodeRestartFromSnapshot2C(t *testing.T) {
 		t.Errorf("unexpected Ready: %+v", rawNode.HasReady())
 	}
 }
+
+func TestRawNodeConfChangeHistory3A(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1}, 10, 1, s)}
+
+	ccs := []pb.ConfChange{
+		{ChangeType: pb.ConfChangeType_AddNode, NodeId: 2},
+		{ChangeType: pb.ConfChangeType_AddNode, NodeId: 3},
+		{ChangeType: pb.ConfChangeType_RemoveNode, NodeId: 2},
+		{ChangeType: pb.ConfChangeType_AddNode, NodeId: 4},
+	}
+	for i, cc := range ccs {
+		rawNode.ApplyConfChangeAt(uint64(i+2), cc)
+	}
+
+	wnodes := []uint64{1, 3, 4}
+	if g := nodes(rawNode.Raft); !reflect.DeepEqual(g, wnodes) {
+		t.Errorf("nodes = %v, want %v", g, wnodes)
+	}
+	whistory := []ConfChangeRecord{
+		{Index: 2, ChangeType: pb.ConfChangeType_AddNode, NodeId: 2},
+		{Index: 3, ChangeType: pb.ConfChangeType_AddNode, NodeId: 3},
+		{Index: 4, ChangeType: pb.ConfChangeType_RemoveNode, NodeId: 2},
+		{Index: 5, ChangeType: pb.ConfChangeType_AddNode, NodeId: 4},
+	}
+	if g := rawNode.ConfChangeHistory(); !reflect.DeepEqual(g, whistory) {
+		t.Errorf("history = %+v, want %+v", g, whistory)
+	}
+
+	// only the latest maxConfChangeHistory changes are kept
+	for i := 0; i < maxConfChangeHistory; i++ {
+		rawNode.ApplyConfChangeAt(uint64(i+6), pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: uint64(i + 5)})
+	}
+	history := rawNode.ConfChangeHistory()
+	if len(history) != maxConfChangeHistory {
+		t.Fatalf("len(history) = %d, want %d", len(history), maxConfChangeHistory)
+	}
+	if history[0].Index != 6 || history[maxConfChangeHistory-1].Index != 5+maxConfChangeHistory {
+		t.Errorf("history spans [%d, %d], want [6, %d]", history[0].Index, history[maxConfChangeHistory-1].Index, 5+maxConfChangeHistory)
+	}
+}
+
+func TestRawNodeStatusRejectStreak2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1, 2}, 10, 1, s)}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	rawNode.Raft.readMessages()
+
+	reject := pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppendResponse, Term: 1, Reject: true}
+	for i := 1; i <= 3; i++ {
+		rawNode.Raft.Step(reject)
+		if g := rawNode.Status().Progress[2].RejectStreak; g != i {
+			t.Errorf("#%d: reject streak = %d, want %d", i, g, i)
+		}
+	}
+
+	rawNode.Raft.Step(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppendResponse, Term: 1, Index: 1})
+	if g := rawNode.Status().Progress[2].RejectStreak; g != 0 {
+		t.Errorf("reject streak = %d, want 0", g)
+	}
+}
+
+func TestRawNodeReportUnreachable2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1, 2}, 10, 1, s)}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	rawNode.Raft.readMessages()
+
+	rawNode.Raft.Step(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppendResponse, Term: 1, Index: 1})
+	if g := rawNode.Status().Progress[2].State; g != ProgressStateReplicate {
+		t.Fatalf("state = %s, want %s", g, ProgressStateReplicate)
+	}
+
+	rawNode.ReportUnreachable(2)
+	pr := rawNode.Status().Progress[2]
+	if pr.State != ProgressStateProbe {
+		t.Errorf("state = %s, want %s", pr.State, ProgressStateProbe)
+	}
+	if pr.Next != pr.Match+1 {
+		t.Errorf("next = %d, want %d", pr.Next, pr.Match+1)
+	}
+}
+
+func TestRawNodeStepDown2AA(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead := nt.peers[1].(*Raft)
+	term := lead.Term
+
+	rawNode := &RawNode{Raft: lead}
+	rawNode.StepDown()
+	if lead.State != StateFollower || lead.Lead != None || lead.Term != term || lead.Vote != 1 {
+		t.Fatalf("state, lead, term, vote = %s, %d, %d, %d, want %s, %d, %d, 1",
+			lead.State, lead.Lead, lead.Term, lead.Vote, StateFollower, None, term)
+	}
+
+	lead.tick()
+	for _, m := range lead.readMessages() {
+		if m.MsgType == pb.MessageType_MsgHeartbeat {
+			t.Fatalf("former leader sends %+v", m)
+		}
+	}
+
+	var newLead *Raft
+	for i := 0; i < 10*lead.electionTimeout && newLead == nil; i++ {
+		for id := uint64(1); id <= 3; id++ {
+			r := nt.peers[id].(*Raft)
+			r.tick()
+			nt.send(nt.filter(r.readMessages())...)
+			if r.State == StateLeader {
+				newLead = r
+			}
+		}
+	}
+	if newLead == nil {
+		t.Fatal("no leader elected after step down")
+	}
+	if newLead.Term <= term {
+		t.Errorf("new leader term = %d, want > %d", newLead.Term, term)
+	}
+}
+
+func TestRawNodeProposeNotLeader2AB(t *testing.T) {
+	rawNode := &RawNode{Raft: newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())}
+
+	rawNode.Raft.becomeFollower(1, 1)
+	err := rawNode.Propose([]byte("somedata"))
+	if !reflect.DeepEqual(err, ErrNotLeader{LeaderHint: 1}) {
+		t.Errorf("follower propose err = %v, want %v", err, ErrNotLeader{LeaderHint: 1})
+	}
+
+	rawNode.Raft.becomeCandidate()
+	err = rawNode.Propose([]byte("somedata"))
+	if !reflect.DeepEqual(err, ErrNotLeader{LeaderHint: None}) {
+		t.Errorf("candidate propose err = %v, want %v", err, ErrNotLeader{LeaderHint: None})
+	}
+	if n := len(rawNode.Raft.RaftLog.allEntries()); n != 0 {
+		t.Errorf("len(entries) = %d, want 0", n)
+	}
+}
+
+// committedEntries returns the CommittedEntries of the Ready of rn, or the
+// error Ready panicked with.
+func committedEntries(rn *RawNode) (ents []pb.Entry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	return rn.Ready().CommittedEntries, nil
+}
+
+func TestRawNodeEntryChecksum2AB(t *testing.T) {
+	c := newTestConfig(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	c.EntryChecksum = true
+	rawNode := &RawNode{Raft: newRaft(c)}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	if err := rawNode.Propose([]byte("somedata")); err != nil {
+		t.Fatal(err)
+	}
+
+	ents, err := committedEntries(rawNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 || ents[0].Data != nil || string(ents[1].Data) != "somedata" {
+		t.Fatalf("entries = %+v, want the noop and somedata", ents)
+	}
+
+	// the checksum goes on the logged copy, not on the proposer's entry
+	ent := &pb.Entry{Data: []byte("more")}
+	if err := rawNode.Raft.Step(pb.Message{MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{ent}}); err != nil {
+		t.Fatal(err)
+	}
+	if string(ent.Data) != "more" {
+		t.Errorf("proposed data = %q, want %q", ent.Data, "more")
+	}
+
+	// corrupt the proposal in the log
+	rawNode.Raft.RaftLog.entries[1].Data[0] ^= 0xff
+	if _, err := committedEntries(rawNode); !errors.Is(err, ErrEntryChecksumMismatch) {
+		t.Errorf("err = %v, want %v", err, ErrEntryChecksumMismatch)
+	}
+}
+
+// entries without data carry a checksum too, losing it or gaining data is
+// detected like any other corruption
+func TestRawNodeEntryChecksumEmptyData2AB(t *testing.T) {
+	tests := []func(ent *pb.Entry){
+		func(ent *pb.Entry) { ent.Data = nil },
+		func(ent *pb.Entry) { ent.Data = append([]byte("x"), ent.Data...) },
+	}
+	for i, corrupt := range tests {
+		c := newTestConfig(1, []uint64{1}, 10, 1, NewMemoryStorage())
+		c.EntryChecksum = true
+		rawNode := &RawNode{Raft: newRaft(c)}
+		rawNode.Raft.becomeCandidate()
+		rawNode.Raft.becomeLeader()
+		if err := rawNode.Propose(nil); err != nil {
+			t.Fatal(err)
+		}
+		ents, err := committedEntries(rawNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ents) != 2 || ents[0].Data != nil || ents[1].Data != nil {
+			t.Fatalf("#%d: entries = %+v, want the noop and an empty proposal", i, ents)
+		}
+		for j := range rawNode.Raft.RaftLog.entries {
+			if n := len(rawNode.Raft.RaftLog.entries[j].Data); n != checksumSize {
+				t.Fatalf("#%d: entry %d has %d bytes in the log, want only its checksum", i, j, n)
+			}
+		}
+
+		corrupt(&rawNode.Raft.RaftLog.entries[1])
+		if _, err := committedEntries(rawNode); !errors.Is(err, ErrEntryChecksumMismatch) {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrEntryChecksumMismatch)
+		}
+	}
+}
+
+// TestRawNodeAdvanceStablesEntries verifies that stabled partitions the log:
+// the entries handed to Advance stop being unstable and entries appended
+// afterwards are the only unstable ones.
+func TestRawNodeAdvanceStablesEntries2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}, {Index: 4, Term: 1}, {Index: 5, Term: 1}})
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1}, 10, 1, storage)}
+	l := rawNode.Raft.RaftLog
+	for i := 0; i < 5; i++ {
+		l.appendEntry(1, &pb.Entry{})
+	}
+	if l.stabled != 5 {
+		t.Fatalf("stabled = %d, want 5", l.stabled)
+	}
+
+	unstable := l.unstableEntries()
+	wunstable := []pb.Entry{{Index: 6, Term: 1}, {Index: 7, Term: 1}, {Index: 8, Term: 1}, {Index: 9, Term: 1}, {Index: 10, Term: 1}}
+	if !reflect.DeepEqual(unstable, wunstable) {
+		t.Fatalf("unstable = %+v, want %+v", unstable, wunstable)
+	}
+
+	rawNode.Advance(Ready{Entries: unstable})
+	if l.stabled != 10 {
+		t.Errorf("stabled = %d, want 10", l.stabled)
+	}
+	if g := l.unstableEntries(); len(g) != 0 {
+		t.Errorf("unstable = %+v, want empty", g)
+	}
+
+	l.appendEntry(2, &pb.Entry{})
+	if g, w := l.unstableEntries(), []pb.Entry{{Index: 11, Term: 2}}; !reflect.DeepEqual(g, w) {
+		t.Errorf("unstable = %+v, want %+v", g, w)
+	}
+}
+
+func TestRawNodeStatusPendingMessages2AB(t *testing.T) {
+	c := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	c.MaxPendingMessages = 8
+	rawNode := &RawNode{Raft: newRaft(c)}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	rawNode.Raft.readMessages()
+	if st := rawNode.Status(); st.PendingMessages != 0 || st.PendingMessageBytes != 0 {
+		t.Fatalf("pending = %d msgs %d bytes, want none", st.PendingMessages, st.PendingMessageBytes)
+	}
+
+	// every proposal sends an append to each of the two followers
+	var lastBytes uint64
+	for i := 1; i <= 5; i++ {
+		if err := rawNode.Propose([]byte("somedata")); err != nil {
+			t.Fatal(err)
+		}
+		st := rawNode.Status()
+		if st.PendingMessages != 2*i {
+			t.Errorf("#%d: pending messages = %d, want %d", i, st.PendingMessages, 2*i)
+		}
+		if st.PendingMessageBytes <= lastBytes {
+			t.Errorf("#%d: pending bytes = %d, want more than %d", i, st.PendingMessageBytes, lastBytes)
+		}
+		lastBytes = st.PendingMessageBytes
+		if w := 2*i > c.MaxPendingMessages; rawNode.Raft.msgsOverCap != w {
+			t.Errorf("#%d: over cap = %v, want %v", i, rawNode.Raft.msgsOverCap, w)
+		}
+	}
+
+	rawNode.Raft.readMessages()
+	rawNode.Tick()
+	if rawNode.Raft.msgsOverCap {
+		t.Error("over cap after the queue was drained, want false")
+	}
+}
+
+func TestRawNodeProposeInvalidEntries2AB(t *testing.T) {
+	c := newTestConfig(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	c.MaxEntrySize = 8
+	rawNode := &RawNode{Raft: newRaft(c)}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	cc, err := (&pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 2}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ents []*pb.Entry
+		wok  bool
+	}{
+		{[]*pb.Entry{{Data: []byte("somedata")}}, true},
+		{[]*pb.Entry{{EntryType: pb.EntryType_EntryConfChange, Data: cc}}, true},
+		{nil, false},
+		{[]*pb.Entry{{Data: []byte("toolongdata")}}, false},
+		{[]*pb.Entry{{Data: []byte("data")}, nil}, false},
+		{[]*pb.Entry{{EntryType: pb.EntryType_EntryConfChange, Data: []byte{0xff}}}, false},
+	}
+	for i, tt := range tests {
+		last := rawNode.Raft.RaftLog.LastIndex()
+		err := rawNode.Raft.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: tt.ents})
+		if tt.wok != (err == nil) {
+			t.Errorf("#%d: err = %v, want ok %v", i, err, tt.wok)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidEntry) {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrInvalidEntry)
+		}
+		if !tt.wok && rawNode.Raft.RaftLog.LastIndex() != last {
+			t.Errorf("#%d: rejected proposal appended to the log", i)
+		}
+	}
+}
+
+func TestRawNodeProposalBurstIndexes2AB(t *testing.T) {
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	first := rawNode.Raft.RaftLog.LastIndex() + 1
+
+	// single proposals interleaved with batched ones
+	want := 0
+	for i := 0; i < 20; i++ {
+		var err error
+		if i%3 == 0 {
+			err = rawNode.Raft.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose,
+				Entries: []*pb.Entry{{Data: []byte{byte(i)}}, {Data: []byte{byte(i)}}, {Data: []byte{byte(i)}}}})
+			want += 3
+		} else {
+			err = rawNode.Propose([]byte{byte(i)})
+			want++
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ents := rawNode.Raft.RaftLog.slice(first, rawNode.Raft.RaftLog.LastIndex()+1)
+	if len(ents) != want {
+		t.Fatalf("len(entries) = %d, want %d", len(ents), want)
+	}
+	for i, ent := range ents {
+		if ent.Index != first+uint64(i) || ent.Term != rawNode.Raft.Term {
+			t.Fatalf("entry %d = (index %d, term %d), want (index %d, term %d)", i, ent.Index, ent.Term, first+uint64(i), rawNode.Raft.Term)
+		}
+	}
+}
+
+func TestRawNodeStatusString2AB(t *testing.T) {
+	pr := Progress{Match: 5, Next: 6, State: ProgressStateReplicate}
+	if g, w := pr.String(), "Progress{Match:5 Next:6 State:ProgressStateReplicate}"; g != w {
+		t.Errorf("progress = %q, want %q", g, w)
+	}
+
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	w := "id:1 term:1 vote:1 commit:0 applied:0 lead:1 state:StateLeader\n" +
+		"1: Progress{Match:1 Next:2 State:ProgressStateProbe}\n" +
+		"2: Progress{Match:0 Next:1 State:ProgressStateProbe}"
+	if g := rawNode.Status().String(); g != w {
+		t.Errorf("status =\n%s\nwant\n%s", g, w)
+	}
+}
+
+func TestRawNodeApplyNotify2AC(t *testing.T) {
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1}, 10, 1, NewMemoryStorage())}
+	applyc := rawNode.ApplyNotify()
+	notified := func() bool {
+		select {
+		case <-applyc:
+			return true
+		default:
+			return false
+		}
+	}
+	apply := func() {
+		ents, err := committedEntries(rawNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawNode.Advance(Ready{CommittedEntries: ents})
+	}
+
+	if notified() {
+		t.Fatal("notified before anything is committed")
+	}
+	// the noop entry of the new leader commits at once
+	if err := rawNode.Campaign(); err != nil {
+		t.Fatal(err)
+	}
+	if !notified() {
+		t.Fatal("not notified of the committed noop entry")
+	}
+	apply()
+	rawNode.Tick()
+	if notified() {
+		t.Fatal("notified with nothing left to apply")
+	}
+
+	// signals coalesce until received
+	for i := 0; i < 3; i++ {
+		if err := rawNode.Propose([]byte("somedata")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !notified() {
+		t.Fatal("not notified of the committed proposals")
+	}
+	if notified() {
+		t.Fatal("notified twice for one batch of work")
+	}
+	apply()
+	if rawNode.Raft.RaftLog.applied != rawNode.Raft.RaftLog.committed {
+		t.Fatalf("applied = %d, want %d", rawNode.Raft.RaftLog.applied, rawNode.Raft.RaftLog.committed)
+	}
+	rawNode.Tick()
+	if notified() {
+		t.Fatal("notified with nothing left to apply")
+	}
+}
+
+func TestRawNodeBootstrap3A(t *testing.T) {
+	peers := []uint64{1, 2, 3}
+	rafts := make([]stateMachine, len(peers))
+	for i, id := range peers {
+		s := NewMemoryStorage()
+		rawNode := &RawNode{Raft: newTestRaft(id, nil, 10, 1, s)}
+		if err := rawNode.Bootstrap(peers); err != nil {
+			t.Fatal(err)
+		}
+		if g := nodes(rawNode.Raft); !reflect.DeepEqual(g, peers) {
+			t.Fatalf("node %d peers = %v, want %v", id, g, peers)
+		}
+		if err := rawNode.Bootstrap(peers); err == nil {
+			t.Fatalf("node %d bootstrapped twice", id)
+		}
+		// persist the bootstrap entries like the application would
+		ents := rawNode.Raft.RaftLog.unstableEntries()
+		if len(ents) != len(peers) {
+			t.Fatalf("node %d has %d unstable entries, want %d", id, len(ents), len(peers))
+		}
+		s.Append(ents)
+		rawNode.Raft.RaftLog.stableTo(ents[len(ents)-1].Index, ents[len(ents)-1].Term)
+		rafts[i] = rawNode.Raft
+	}
+
+	nt := newNetwork(rafts...)
+	nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgHup})
+	if r := nt.peers[2].(*Raft); r.State != StateLeader {
+		t.Fatalf("node 2 state = %s, want %s", r.State, StateLeader)
+	}
+	lead := nt.peers[2].(*Raft)
+	for _, id := range peers {
+		r := nt.peers[id].(*Raft)
+		if r.Lead != 2 {
+			t.Errorf("node %d lead = %d, want 2", id, r.Lead)
+		}
+		if r.RaftLog.committed != lead.RaftLog.LastIndex() {
+			t.Errorf("node %d committed = %d, want %d", id, r.RaftLog.committed, lead.RaftLog.LastIndex())
+		}
+	}
+
+	// a storage holding entries can't be bootstrapped
+	s := NewMemoryStorage()
+	s.Append([]pb.Entry{{Index: 1, Term: 1}})
+	rawNode := &RawNode{Raft: newTestRaft(1, nil, 10, 1, s)}
+	if err := rawNode.Bootstrap(peers); err == nil {
+		t.Error("bootstrapped a nonempty storage")
+	}
+}
+
+func TestRawNodeProposeWithContext2AB(t *testing.T) {
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1}, 10, 1, NewMemoryStorage())}
+	if err := rawNode.Campaign(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rawNode.ProposeWithContext([]byte("req-1"), []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rawNode.Propose([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	ents, err := committedEntries(rawNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the noop, foo and bar
+	if len(ents) != 3 {
+		t.Fatalf("len(ents) = %d, want 3", len(ents))
+	}
+	wctxs := [][]byte{nil, []byte("req-1"), nil}
+	for i, ent := range ents {
+		if g := rawNode.EntryContext(ent); !bytes.Equal(g, wctxs[i]) {
+			t.Errorf("#%d: context = %q, want %q", i, g, wctxs[i])
+		}
+	}
+	// an entry of another term at the same index is not the proposed one
+	if g := rawNode.EntryContext(pb.Entry{Index: ents[1].Index, Term: ents[1].Term + 1}); g != nil {
+		t.Errorf("context of an overwritten entry = %q, want nil", g)
+	}
+
+	rawNode.Advance(Ready{CommittedEntries: ents})
+	if g := rawNode.EntryContext(ents[1]); g != nil {
+		t.Errorf("context after apply = %q, want nil", g)
+	}
+	if len(rawNode.Raft.entryCtxs) != 0 {
+		t.Errorf("entryCtxs = %v, want empty", rawNode.Raft.entryCtxs)
+	}
+}
+
+func TestRawNodeReadySoftStateWithMessages2AC(t *testing.T) {
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())}
+	if rawNode.HasReady() {
+		t.Fatalf("unexpected Ready: %+v", rawNode.Ready())
+	}
+
+	// the vote requests come with the candidate state
+	if err := rawNode.Campaign(); err != nil {
+		t.Fatal(err)
+	}
+	rd := rawNode.Ready()
+	if rd.SoftState == nil || *rd.SoftState != (SoftState{Lead: None, RaftState: StateCandidate}) {
+		t.Fatalf("soft state = %+v, want candidate", rd.SoftState)
+	}
+	if len(rd.Messages) != 2 || rd.Messages[0].MsgType != pb.MessageType_MsgRequestVote {
+		t.Fatalf("msgs = %+v, want two vote requests", rd.Messages)
+	}
+	rawNode.Advance(rd)
+	if rawNode.HasReady() {
+		t.Fatalf("unexpected Ready: %+v", rawNode.Ready())
+	}
+
+	// the appends of the new leader come with the leader state
+	rawNode.Step(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgRequestVoteResponse, Term: 1})
+	rd = rawNode.Ready()
+	if rd.SoftState == nil || *rd.SoftState != (SoftState{Lead: 1, RaftState: StateLeader}) {
+		t.Fatalf("soft state = %+v, want leader", rd.SoftState)
+	}
+	if len(rd.Messages) != 2 || rd.Messages[0].MsgType != pb.MessageType_MsgAppend {
+		t.Fatalf("msgs = %+v, want two appends", rd.Messages)
+	}
+	rawNode.Advance(rd)
+
+	// the leader queues heartbeats, then learns of a newer leader before
+	// they are taken: only the reply to the new leader is left to send
+	rawNode.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	rawNode.Step(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppend, Term: 2, Index: 1, LogTerm: 1})
+	rd = rawNode.Ready()
+	if rd.SoftState == nil || *rd.SoftState != (SoftState{Lead: 2, RaftState: StateFollower}) {
+		t.Fatalf("soft state = %+v, want follower of 2", rd.SoftState)
+	}
+	if len(rd.Messages) != 1 || rd.Messages[0].MsgType != pb.MessageType_MsgAppendResponse || rd.Messages[0].Term != 2 {
+		t.Fatalf("msgs = %+v, want one append response at term 2", rd.Messages)
+	}
+	rawNode.Advance(rd)
+	if rawNode.HasReady() {
+		t.Fatalf("unexpected Ready: %+v", rawNode.Ready())
+	}
+}
+
+func TestRawNodeProposeFollowerDropped2AB(t *testing.T) {
+	rawNode := &RawNode{Raft: newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())}
+	rawNode.Raft.becomeFollower(1, 1)
+
+	err := rawNode.Propose([]byte("somedata"))
+	if !errors.Is(err, ErrProposalDropped) {
+		t.Errorf("follower propose err = %v, want %v", err, ErrProposalDropped)
+	}
+	var notLeader ErrNotLeader
+	if !errors.As(err, &notLeader) || notLeader.LeaderHint != 1 {
+		t.Errorf("follower propose err = %v, want leader hint 1", err)
+	}
+	if len(rawNode.Raft.msgs) != 0 {
+		t.Errorf("msgs = %v, want none", rawNode.Raft.msgs)
+	}
+}
+
+// TestRawNodeApplyConfChangeIndex3A tests that ApplyConfChange records a conf
+// change at the index of its committed entry.
+func TestRawNodeApplyConfChangeIndex3A(t *testing.T) {
+	rawNode := &RawNode{Raft: newTestRaft(1, []uint64{1}, 10, 1, NewMemoryStorage())}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	if err := rawNode.Propose([]byte("somedata")); err != nil {
+		t.Fatal(err)
+	}
+	cc := pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 2}
+	if err := rawNode.ProposeConfChange(cc); err != nil {
+		t.Fatal(err)
+	}
+	index := rawNode.Raft.RaftLog.LastIndex()
+	if rawNode.Raft.RaftLog.committed != index {
+		t.Fatalf("committed = %d, want %d", rawNode.Raft.RaftLog.committed, index)
+	}
+
+	rawNode.ApplyConfChange(cc)
+	whistory := []ConfChangeRecord{{Index: index, ChangeType: pb.ConfChangeType_AddNode, NodeId: 2}}
+	if g := rawNode.ConfChangeHistory(); !reflect.DeepEqual(g, whistory) {
+		t.Errorf("history = %+v, want %+v", g, whistory)
+	}
+}
+
+// TestRawNodeReadySnapshot2C tests that a snapshot received by a node built
+// with NewRawNode is handed out by Ready together with the new hard state, and
+// that Advance clears it.
+func TestRawNodeReadySnapshot2C(t *testing.T) {
+	s := NewMemoryStorage()
+	s.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}, Index: 1, Term: 1}})
+	// the membership comes from the storage, no peers are given
+	rawNode, err := NewRawNode(newTestConfig(2, nil, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := nodes(rawNode.Raft), []uint64{1, 2}; !reflect.DeepEqual(g, w) {
+		t.Fatalf("nodes = %v, want %v", g, w)
+	}
+	if rawNode.HasReady() {
+		t.Fatalf("unexpected Ready: %+v", rawNode.Ready())
+	}
+
+	snap := pb.Snapshot{Metadata: &pb.SnapshotMetadata{ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}}, Index: 10, Term: 2}}
+	if err := rawNode.Step(pb.Message{From: 1, To: 2, Term: 2, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &snap}); err != nil {
+		t.Fatal(err)
+	}
+	rd := rawNode.Ready()
+	if !reflect.DeepEqual(rd.Snapshot, snap) {
+		t.Errorf("snapshot = %+v, want %+v", rd.Snapshot, snap)
+	}
+	if w := (pb.HardState{Term: 2, Commit: 10}); !isHardStateEqual(rd.HardState, w) {
+		t.Errorf("hard state = %+v, want %+v", rd.HardState, w)
+	}
+	if len(rd.Entries) != 0 || len(rd.CommittedEntries) != 0 {
+		t.Errorf("entries = %+v, committed = %+v, want none covered by the snapshot", rd.Entries, rd.CommittedEntries)
+	}
+	if len(rd.Messages) != 1 || rd.Messages[0].Index != 10 {
+		t.Errorf("msgs = %+v, want one response at index 10", rd.Messages)
+	}
+	s.ApplySnapshot(rd.Snapshot)
+	rawNode.Advance(rd)
+	if rawNode.HasReady() {
+		t.Errorf("unexpected Ready: %+v", rawNode.Ready())
+	}
+
+	if _, err := NewRawNode(newTestConfig(0, nil, 10, 1, s)); err == nil {
+		t.Errorf("NewRawNode with id 0 succeeded, want an error")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+// ReadState provides state for read only query.
+// It's caller's responsibility to call ReadIndex first before getting
+// this state from ready, it's also caller's duty to differentiate if this
+// state is what it requests through RequestCtx, eg. given a unique id as
+// RequestCtx
+type ReadState struct {
+	Index      uint64
+	RequestCtx []byte
+}
+
+// readIndexStatus is a read only request waiting for a quorum of the
+// cluster to acknowledge the leader's heartbeat.
+type readIndexStatus struct {
+	index uint64
+	ctx   []byte
+	acks  map[uint64]bool
+}
+
+// readOnly keeps the pending read only requests in arrival order. The
+// leader only attaches the ctx of the latest request to its heartbeats, an
+// ack for that ctx also confirms every request queued before it, so any
+// number of pending reads is settled by a single heartbeat round.
+type readOnly struct {
+	pendingReadIndex map[string]*readIndexStatus
+	readIndexQueue   []string
+}
+
+func newReadOnly() *readOnly {
+	return &readOnly{
+		pendingReadIndex: make(map[string]*readIndexStatus),
+	}
+}
+
+// addRequest adds a read only request with the leader's commit index at the
+// time it was received, the leader acknowledges the request itself. It
+// returns ErrDuplicateReadCtx if a request with the same ctx is still
+// pending, the ctx is what tells the callers' ReadStates apart.
+func (ro *readOnly) addRequest(index uint64, ctx []byte, self uint64) error {
+	s := string(ctx)
+	if _, ok := ro.pendingReadIndex[s]; ok {
+		return ErrDuplicateReadCtx
+	}
+	ro.pendingReadIndex[s] = &readIndexStatus{index: index, ctx: ctx, acks: map[uint64]bool{self: true}}
+	ro.readIndexQueue = append(ro.readIndexQueue, s)
+	return nil
+}
+
+// recvAck records the ack of the given peer for the request with ctx and
+// returns the number of acks received so far from the members in prs, 0 if
+// no such request is pending. Acks of peers that have left the cluster since
+// they were received don't count towards the quorum.
+func (ro *readOnly) recvAck(id uint64, ctx []byte, prs map[uint64]*Progress) int {
+	rs, ok := ro.pendingReadIndex[string(ctx)]
+	if !ok {
+		return 0
+	}
+	if _, ok := prs[id]; ok {
+		rs.acks[id] = true
+	}
+	n := 0
+	for ackID := range rs.acks {
+		if _, ok := prs[ackID]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// advance removes the request with ctx and all requests queued before it,
+// and returns them in arrival order.
+func (ro *readOnly) advance(ctx []byte) []*readIndexStatus {
+	s := string(ctx)
+	for i, okctx := range ro.readIndexQueue {
+		if okctx != s {
+			continue
+		}
+		rss := make([]*readIndexStatus, 0, i+1)
+		for _, c := range ro.readIndexQueue[:i+1] {
+			rss = append(rss, ro.pendingReadIndex[c])
+			delete(ro.pendingReadIndex, c)
+		}
+		ro.readIndexQueue = ro.readIndexQueue[i+1:]
+		return rss
+	}
+	return nil
+}
+
+// lastPendingRequestCtx returns the ctx of the latest pending request, or
+// nil if there is none.
+func (ro *readOnly) lastPendingRequestCtx() []byte {
+	if len(ro.readIndexQueue) == 0 {
+		return nil
+	}
+	return []byte(ro.readIndexQueue[len(ro.readIndexQueue)-1])
+}
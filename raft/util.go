@@ -40,6 +40,23 @@ func max(a, b uint64) uint64 {
 	return b
 }
 
+// limitSize returns the longest prefix of ents whose total size does not
+// exceed maxSize, but at least the first entry if there is any.
+func limitSize(ents []pb.Entry, maxSize uint64) []pb.Entry {
+	if len(ents) == 0 {
+		return ents
+	}
+	size := uint64(ents[0].Size())
+	limit := 1
+	for ; limit < len(ents); limit++ {
+		size += uint64(ents[limit].Size())
+		if size > maxSize {
+			break
+		}
+	}
+	return ents[:limit]
+}
+
 // IsEmptyHardState returns true if the given HardState is empty.
 func IsEmptyHardState(st pb.HardState) bool {
 	return isHardStateEqual(st, pb.HardState{})